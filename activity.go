@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// hostCount is the number of requests to a host.
+type hostCount struct {
+	Host  string `json:"host"`
+	Count int    `json:"count"`
+}
+
+// activitySummary is a snapshot of the activity counters.
+type activitySummary struct {
+	Allowed    int         `json:"allowed"`
+	Blocked    int         `json:"blocked"`
+	TopBlocked []hostCount `json:"topBlocked"`
+}
+
+// activity keeps the live counters since start.
+type activity struct {
+	mu           sync.Mutex
+	allowed      int
+	blocked      int
+	blockedHosts map[string]int
+}
+
+func newActivity() *activity {
+	return &activity{
+		blockedHosts: make(map[string]int),
+	}
+}
+
+// record counts a query.
+func (a *activity) record(q query) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if q.Blocked {
+		a.blocked++
+		a.blockedHosts[q.Host]++
+	} else {
+		a.allowed++
+	}
+}
+
+// summary returns the counters with the top n blocked hosts.
+func (a *activity) summary(n int) activitySummary {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return activitySummary{
+		Allowed:    a.allowed,
+		Blocked:    a.blocked,
+		TopBlocked: topHosts(a.blockedHosts, n),
+	}
+}
+
+// topHosts returns the n hosts with the most requests.
+func topHosts(counts map[string]int, n int) []hostCount {
+	top := []hostCount{}
+	for host, count := range counts {
+		top = append(top, hostCount{host, count})
+	}
+	sortHostCounts(top)
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// sortHostCounts sorts by count descending and host ascending.
+func sortHostCounts(counts []hostCount) {
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Host < counts[j].Host
+	})
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestActivitySummary(t *testing.T) {
+	a := newActivity()
+	a.record(query{Host: "a.com", Blocked: true})
+	a.record(query{Host: "b.com", Blocked: true})
+	a.record(query{Host: "b.com", Blocked: true})
+	a.record(query{Host: "c.com"})
+
+	summary := a.summary(1)
+	if summary.Allowed != 1 {
+		t.Errorf("allowed should be 1; got: %v", summary.Allowed)
+	}
+	if summary.Blocked != 3 {
+		t.Errorf("blocked should be 3; got: %v", summary.Blocked)
+	}
+	if len(summary.TopBlocked) != 1 || summary.TopBlocked[0] != (hostCount{"b.com", 2}) {
+		t.Errorf("top blocked should be [b.com 2]; got: %v", summary.TopBlocked)
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const apiPrefix = "/api/v1"
+
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+//go:embed web
+var dashboardFiles embed.FS
+
+// RunAdmin serves the admin API and the dashboard.
+func (app *App) RunAdmin() error {
+	log.Println("Admin API listening on: ", app.adminAddress)
+	return http.ListenAndServe(app.adminAddress, newAdminHandler(app, app.adminToken))
+}
+
+// loadAdminToken returns the configured admin token. Without one, a random
+// token is generated and stored in a file readable only by the user.
+func loadAdminToken(token, path string) (string, error) {
+	if token != "" {
+		return token, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err == nil && strings.TrimSpace(string(content)) != "" {
+		return strings.TrimSpace(string(content)), nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token = hex.EncodeToString(b)
+	if err := createDir(filepath.Dir(path)); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+	log.Println("Admin token generated: ", path)
+	return token, nil
+}
+
+// dashboardURL returns the URL of the dashboard served on the admin address.
+// The token is passed in the fragment so it is not sent to the server.
+func dashboardURL(address, token string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "http://" + address + "/"
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port) + "/#token=" + token
+}
+
+// newAdminHandler returns the handler of the admin listener.
+func newAdminHandler(app *App, token string) http.Handler {
+	mux := http.NewServeMux()
+	web, _ := fs.Sub(dashboardFiles, "web")
+	mux.Handle("/", http.FileServer(http.FS(web)))
+	mux.Handle(apiPrefix+"/", requireToken(token, newAPIHandler(app)))
+	mux.Handle("/metrics", requireToken(token, method(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := app.WriteMetrics(w); err != nil {
+			log.Println("Error writing metrics: ", err)
+		}
+	})))
+	mux.HandleFunc(apiPrefix+"/openapi.yaml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(openAPISpec)
+	})
+	return mux
+}
+
+// requireToken rejects the requests without the bearer token.
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid or missing token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newAPIHandler returns the handler of the JSON API.
+func newAPIHandler(app *App) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiPrefix+"/status", method(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, app.Status())
+	}))
+	mux.HandleFunc(apiPrefix+"/enable", method(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		app.SetEnabled(true)
+		writeJSON(w, http.StatusOK, app.Status())
+	}))
+	mux.HandleFunc(apiPrefix+"/disable", method(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		app.SetEnabled(false)
+		writeJSON(w, http.StatusOK, app.Status())
+	}))
+	mux.HandleFunc(apiPrefix+"/focus/enable", method(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		app.SetFocus(true)
+		writeJSON(w, http.StatusOK, app.Status())
+	}))
+	mux.HandleFunc(apiPrefix+"/focus/disable", method(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		app.SetFocus(false)
+		writeJSON(w, http.StatusOK, app.Status())
+	}))
+	mux.HandleFunc(apiPrefix+"/access", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, app.AccessRequests())
+		case http.MethodDelete:
+			if err := app.DismissAccess(r.URL.Query().Get("host")); err != nil {
+				writeError(w, ruleErrorStatus(err), err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		}
+	})
+	mux.HandleFunc(apiPrefix+"/reload", method(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		if err := app.Reload(); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, app.Status())
+	}))
+	mux.HandleFunc(apiPrefix+"/sources", method(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		sources, err := app.Sources()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, sources)
+	}))
+	mux.HandleFunc(apiPrefix+"/decision", method(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		host := r.URL.Query().Get("host")
+		if host == "" {
+			writeError(w, http.StatusBadRequest, errors.New("host is required"))
+			return
+		}
+		c := client{Address: r.URL.Query().Get("client"), User: r.URL.Query().Get("user")}
+		writeJSON(w, http.StatusOK, app.DecideFor(host, c))
+	}))
+	mux.HandleFunc(apiPrefix+"/activity", method(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, app.Activity(intParam(r, "top", 10)))
+	}))
+	mux.HandleFunc(apiPrefix+"/queries", method(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		f, err := parseQueryFilter(r.URL.Query(), time.Now())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		queries, err := app.Queries(f)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, queries)
+	}))
+	mux.HandleFunc(apiPrefix+"/stats", method(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		req, err := parseStatsRequest(r.URL.Query(), time.Now())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		report, err := app.Stats(req.Period, req.Since, req.Top)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if req.Format == "csv" {
+			w.Header().Set("Content-Type", "text/csv")
+			writeStatsCSV(w, report)
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}))
+	mux.HandleFunc(apiPrefix+"/events", method(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		f, err := parseQueryFilter(r.URL.Query(), time.Now())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		serveEvents(w, r, app.events, f)
+	}))
+	mux.HandleFunc(apiPrefix+"/validate", method(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		result := ruleValidation{Valid: true}
+		if err := validateRule(r.URL.Query().Get("rule")); err != nil {
+			result = ruleValidation{Error: err.Error()}
+		}
+		writeJSON(w, http.StatusOK, result)
+	}))
+	mux.HandleFunc(apiPrefix+"/rules/", func(w http.ResponseWriter, r *http.Request) {
+		list := strings.TrimPrefix(r.URL.Path, apiPrefix+"/rules/")
+		switch r.Method {
+		case http.MethodGet:
+			rules, err := app.Rules(list)
+			if err != nil {
+				writeError(w, ruleErrorStatus(err), err)
+				return
+			}
+			writeJSON(w, http.StatusOK, ruleList{List: list, Rules: rules})
+		case http.MethodPost:
+			var req ruleRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			if err := app.AddRule(list, req.Rule); err != nil {
+				writeError(w, ruleErrorStatus(err), err)
+				return
+			}
+			writeJSON(w, http.StatusCreated, req)
+		case http.MethodDelete:
+			rule := r.URL.Query().Get("rule")
+			if err := app.RemoveRule(list, rule); err != nil {
+				writeError(w, ruleErrorStatus(err), err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		}
+	})
+	mux.HandleFunc(apiPrefix+"/temporary", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, app.Temporary())
+		case http.MethodPost:
+			var req tempRuleRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			rule, err := parseTempRule(req.Action, req.Host, req.Duration, time.Now())
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			if err := app.AddTemporary(rule); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			writeJSON(w, http.StatusCreated, rule)
+		case http.MethodDelete:
+			if err := app.RemoveTemporary(r.URL.Query().Get("host")); err != nil {
+				writeError(w, ruleErrorStatus(err), err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		}
+	})
+	mux.HandleFunc(apiPrefix+"/budgets", method(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, app.Budgets())
+	}))
+	mux.HandleFunc(apiPrefix+"/rulesets", method(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		sets, err := app.RuleSets()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, sets)
+	}))
+	mux.HandleFunc(apiPrefix+"/rulehits", method(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		lists := ruleLists
+		if list := r.URL.Query().Get("list"); list != "" {
+			lists = []string{list}
+		}
+		usage, err := app.RuleUsage(lists)
+		if err != nil {
+			writeError(w, ruleErrorStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusOK, usage)
+	}))
+	mux.HandleFunc(apiPrefix+"/rulehits/dead", method(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		days := intParam(r, "days", defaultDeadRuleDays)
+		usage, err := app.DeadRules(time.Duration(days) * 24 * time.Hour)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, usage)
+	}))
+	mux.HandleFunc(apiPrefix+"/rulehits/redundant", method(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		usage, err := app.RedundantRules()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, usage)
+	}))
+	return mux
+}
+
+type ruleList struct {
+	List  string   `json:"list"`
+	Rules []string `json:"rules"`
+}
+
+type ruleRequest struct {
+	Rule string `json:"rule"`
+}
+
+type tempRuleRequest struct {
+	Host   string `json:"host"`
+	Action string `json:"action"`
+	// Duration is a Go duration like 10m
+	Duration string `json:"duration"`
+}
+
+type ruleValidation struct {
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+}
+
+// intParam returns a positive integer query parameter or def.
+func intParam(r *http.Request, name string, def int) int {
+	n, err := strconv.Atoi(r.URL.Query().Get(name))
+	if err != nil || n <= 0 {
+		return def
+	}
+	return n
+}
+
+func ruleErrorStatus(err error) int {
+	switch err {
+	case errUnknownList, errRuleNotFound:
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
+
+// method rejects the requests with a different method.
+func method(m string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != m {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
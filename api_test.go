@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testToken = "secret"
+
+func newTestAPI(t *testing.T) (*App, *httptest.Server, func()) {
+	dir, err := ioutil.TempDir("", "lycurgus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	budgets, _ := newBudgets(nil, "")
+	app := &App{
+		events:    newEventBus(),
+		activity:  newActivity(),
+		queryLog:  newQueryLog(10, "", 0),
+		stats:     newStats(""),
+		ruleHits:  newRuleHits(""),
+		temporary: newTempRules(""),
+		budgets:   budgets,
+		access:    newAccessRequests(),
+
+		ruleErrors:  make(map[string]ruleErrors),
+		loadedLists: make(map[string]bool),
+		blocker:     NewBlocker(WithBlockerEnabled(true)),
+		storage: &Storage{
+			blacklistPath: filepath.Join(dir, "blacklist"),
+			whitelistPath: filepath.Join(dir, "whitelist"),
+		},
+	}
+	server := httptest.NewServer(newAdminHandler(app, testToken))
+	return app, server, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func apiRequest(t *testing.T, method, url, body string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestAPIToken(t *testing.T) {
+	_, server, done := newTestAPI(t)
+	defer done()
+
+	resp, err := http.Get(server.URL + apiPrefix + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status should be %v; got: %v", http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	resp, err = http.Get(server.URL + apiPrefix + "/openapi.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("openapi status should be %v; got: %v", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestAPIEnable(t *testing.T) {
+	app, server, done := newTestAPI(t)
+	defer done()
+
+	resp := apiRequest(t, http.MethodGet, server.URL+apiPrefix+"/disable", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("status should be %v; got: %v", http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+
+	resp = apiRequest(t, http.MethodPost, server.URL+apiPrefix+"/disable", "")
+	status := Status{}
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if status.Enabled || app.blocker.Enabled() {
+		t.Errorf("blocker should be disabled")
+	}
+}
+
+func TestAPIRules(t *testing.T) {
+	app, server, done := newTestAPI(t)
+	defer done()
+	url := server.URL + apiPrefix + "/rules/blacklist"
+
+	resp := apiRequest(t, http.MethodPost, url, `{"rule": "("}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid rule status should be %v; got: %v", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	resp = apiRequest(t, http.MethodPost, url, `{"rule": "blacklist\\.com"}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("status should be %v; got: %v", http.StatusCreated, resp.StatusCode)
+	}
+	if decision := app.Decide("blacklist.com"); !decision.Blocked || decision.Stage != stageBlacklist {
+		t.Errorf("host should be blocked by the blacklist; got: %+v", decision)
+	}
+
+	resp = apiRequest(t, http.MethodGet, url, "")
+	list := ruleList{}
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list.Rules) != 1 || list.Rules[0] != `blacklist\.com` {
+		t.Errorf("rules should be [blacklist\\.com]; got: %v", list.Rules)
+	}
+
+	resp = apiRequest(t, http.MethodDelete, url+`?rule=blacklist%5C.com`, "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("status should be %v; got: %v", http.StatusNoContent, resp.StatusCode)
+	}
+	if decision := app.Decide("blacklist.com"); decision.Blocked {
+		t.Errorf("host should not be blocked; got: %+v", decision)
+	}
+
+	resp = apiRequest(t, http.MethodGet, server.URL+apiPrefix+"/rules/nothing", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown list status should be %v; got: %v", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestLoadAdminToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lycurgus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "admintoken")
+
+	if token, _ := loadAdminToken("configured", path); token != "configured" {
+		t.Errorf("token should be configured; got: %v", token)
+	}
+	generated, err := loadAdminToken("", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(generated) != 32 {
+		t.Errorf("generated token should have 32 characters; got: %v", generated)
+	}
+	if token, _ := loadAdminToken("", path); token != generated {
+		t.Errorf("token should be read back; got: %v", token)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	_, server, done := newTestAPI(t)
+	defer done()
+
+	resp, err := http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "app.js") {
+		t.Errorf("dashboard should be served; got: %v", resp.StatusCode)
+	}
+}
+
+func TestDashboardURL(t *testing.T) {
+	tt := []struct {
+		address, expected string
+	}{
+		{"127.0.0.1:5679", "http://127.0.0.1:5679/#token=t"},
+		{":5679", "http://localhost:5679/#token=t"},
+		{"[::1]:5679", "http://[::1]:5679/#token=t"},
+	}
+	for _, tc := range tt {
+		if url := dashboardURL(tc.address, "t"); url != tc.expected {
+			t.Errorf("URL should be %v; got: %v", tc.expected, url)
+		}
+	}
+}
+
+func TestAPIQueries(t *testing.T) {
+	app, server, done := newTestAPI(t)
+	defer done()
+	app.queryLog.record(query{Host: "a.com", Blocked: true})
+	app.queryLog.record(query{Host: "b.com"})
+
+	resp := apiRequest(t, http.MethodGet, server.URL+apiPrefix+"/queries?search=a.", "")
+	queries := []query{}
+	json.NewDecoder(resp.Body).Decode(&queries)
+	resp.Body.Close()
+	if len(queries) != 1 || queries[0].Host != "a.com" || !queries[0].Blocked {
+		t.Errorf("queries should be [a.com]; got: %v", queries)
+	}
+
+	resp = apiRequest(t, http.MethodGet, server.URL+apiPrefix+"/queries?decision=maybe", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status should be %v; got: %v", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	resp = apiRequest(t, http.MethodGet, server.URL+apiPrefix+"/validate?rule=(", "")
+	validation := ruleValidation{}
+	json.NewDecoder(resp.Body).Decode(&validation)
+	resp.Body.Close()
+	if validation.Valid || validation.Error == "" {
+		t.Errorf("rule should be invalid; got: %+v", validation)
+	}
+}
+
+func TestAPIStats(t *testing.T) {
+	app, server, done := newTestAPI(t)
+	defer done()
+	app.stats.record(query{Time: time.Now(), Host: "a.com", Blocked: true})
+
+	resp := apiRequest(t, http.MethodGet, server.URL+apiPrefix+"/stats?since=1d", "")
+	report := statsReport{}
+	json.NewDecoder(resp.Body).Decode(&report)
+	resp.Body.Close()
+	if report.Blocked != 1 || len(report.TopBlocked) != 1 {
+		t.Errorf("report should have a.com blocked; got: %+v", report)
+	}
+
+	resp = apiRequest(t, http.MethodGet, server.URL+apiPrefix+"/stats?format=csv", "")
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.HasPrefix(string(body), "start,allowed,blocked\n") {
+		t.Errorf("body should be CSV; got: %v", string(body))
+	}
+
+	resp = apiRequest(t, http.MethodGet, server.URL+apiPrefix+"/stats?period=weekly", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status should be %v; got: %v", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestInvalidRules(t *testing.T) {
+	app, server, done := newTestAPI(t)
+	defer done()
+
+	ioutil.WriteFile(app.storage.blacklistPath, []byte("^a\\.com$\n"), 0644)
+	if err := app.LoadBlacklist(); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(app.storage.blacklistPath, []byte("^b\\.com$\n(\n"), 0644)
+	if err := app.LoadBlacklist(); err != nil {
+		t.Errorf("invalid rules should be skipped; got: %v", err)
+	}
+	if app.Decide("a.com").Blocked || !app.Decide("b.com").Blocked {
+		t.Errorf("the valid rules should be loaded")
+	}
+
+	resp := apiRequest(t, http.MethodGet, server.URL+apiPrefix+"/status", "")
+	status := Status{}
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if len(status.InvalidRules) != 1 || status.InvalidRules[0].Line != 2 {
+		t.Errorf("status should report the invalid rule on line 2; got: %+v", status.InvalidRules)
+	}
+
+	app.invalidRules = invalidRulesKeep
+	ioutil.WriteFile(app.storage.blacklistPath, []byte("^c\\.com$\n(\n"), 0644)
+	if err := app.LoadBlacklist(); err == nil {
+		t.Errorf("keeping the previous rules should return an error")
+	}
+	if !app.Decide("b.com").Blocked || app.Decide("c.com").Blocked {
+		t.Errorf("the previous rules should be kept")
+	}
+}
+
+func TestAPITemporary(t *testing.T) {
+	app, server, done := newTestAPI(t)
+	defer done()
+
+	resp := apiRequest(t, http.MethodPost, server.URL+apiPrefix+"/temporary", `{"host":"shop.com","action":"allow","duration":"10m"}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("status should be %v; got: %v", http.StatusCreated, resp.StatusCode)
+	}
+	resp = apiRequest(t, http.MethodPost, server.URL+apiPrefix+"/temporary", `{"host":"shop.com","action":"allow"}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status should be %v; got: %v", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	resp = apiRequest(t, http.MethodGet, server.URL+apiPrefix+"/temporary", "")
+	rules := []tempRule{}
+	json.NewDecoder(resp.Body).Decode(&rules)
+	resp.Body.Close()
+	if len(rules) != 1 || rules[0].Host != "shop.com" || rules[0].Action != tempAllow {
+		t.Errorf("temporary should be [allow shop.com]; got: %v", rules)
+	}
+
+	resp = apiRequest(t, http.MethodDelete, server.URL+apiPrefix+"/temporary?host=shop.com", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || len(app.Temporary()) != 0 {
+		t.Errorf("rule should be removed; got: %v %v", resp.StatusCode, app.Temporary())
+	}
+	resp = apiRequest(t, http.MethodDelete, server.URL+apiPrefix+"/temporary?host=shop.com", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status should be %v; got: %v", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestAPIFocus(t *testing.T) {
+	app, server, done := newTestAPI(t)
+	defer done()
+
+	resp := apiRequest(t, http.MethodPost, server.URL+apiPrefix+"/focus/enable", "")
+	var status Status
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if !status.Focus || !app.blocker.Focus() {
+		t.Errorf("focus mode should be on; got: %+v", status)
+	}
+
+	app.RequestAccess(accessRequest{Host: "news.com", Client: "127.0.0.1", Time: time.Now()})
+	app.RequestAccess(accessRequest{Host: "docs.com", Client: "127.0.0.1", Time: time.Now()})
+	resp = apiRequest(t, http.MethodGet, server.URL+apiPrefix+"/access", "")
+	requests := []accessRequest{}
+	json.NewDecoder(resp.Body).Decode(&requests)
+	resp.Body.Close()
+	if len(requests) != 2 {
+		t.Errorf("access requests should be 2; got: %v", requests)
+	}
+
+	// allowing a host grants its request
+	resp = apiRequest(t, http.MethodPost, server.URL+apiPrefix+"/temporary", `{"host":"news.com","action":"allow","duration":"1h"}`)
+	resp.Body.Close()
+	resp = apiRequest(t, http.MethodDelete, server.URL+apiPrefix+"/access?host=docs.com", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || len(app.AccessRequests()) != 0 {
+		t.Errorf("access requests should be empty; got: %v %v", resp.StatusCode, app.AccessRequests())
+	}
+	resp = apiRequest(t, http.MethodDelete, server.URL+apiPrefix+"/access?host=docs.com", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status should be %v; got: %v", http.StatusNotFound, resp.StatusCode)
+	}
+
+	resp = apiRequest(t, http.MethodPost, server.URL+apiPrefix+"/focus/disable", "")
+	resp.Body.Close()
+	if app.blocker.Focus() {
+		t.Errorf("focus mode should be off")
+	}
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"sync"
+	"time"
 )
 
 const (
@@ -30,8 +35,36 @@ type App struct {
 	blockerEnabled   bool
 	autostartEnabled bool
 	proxyAddress     string
+	controlAddress   string
+	adminAddress     string
+	adminToken       string
+	invalidRules     string
+	// acl are the client ranges allowed to use the proxy and
+	// maxClientConns the open connections per client
+	acl            []*net.IPNet
+	maxClientConns int
+
+	mu         sync.Mutex
+	pauseTimer *time.Timer
+	// paused is set while blocking is paused until pausedUntil, or until
+	// restart if pausedUntil is zero
+	paused      bool
+	pausedUntil time.Time
+	// ruleErrors are the invalid rules of the rule lists
+	ruleErrors map[string]ruleErrors
+	// loadedLists are the rule lists loaded at least once
+	loadedLists map[string]bool
 
 	storage   *Storage
+	events    *eventBus
+	activity  *activity
+	queryLog  *queryLog
+	stats     *stats
+	ruleHits  *ruleHits
+	temporary *tempRules
+	budgets   *budgets
+	access    *accessRequests
+	metrics   *metrics
 	blocker   *Blocker
 	gui       *GUI
 	autostart *Autostart
@@ -41,18 +74,127 @@ type App struct {
 
 // NewApp creates and initializes an App.
 func NewApp(config Config) (*App, error) {
+	if config.QueryLogSize < 0 {
+		return nil, fmt.Errorf("invalid querylogsize: %d", config.QueryLogSize)
+	}
+	if err := validateRuleSets(config.RuleSets); err != nil {
+		return nil, err
+	}
+	schedules, err := parseSchedules(config.Schedules, config.RuleSets)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := parseClientGroups(config.Clients, config.RuleSets)
+	if err != nil {
+		return nil, err
+	}
+	acl, err := parseACL(config.ACL)
+	if err != nil {
+		return nil, err
+	}
+	allowIPs, err := parseACL(config.AllowIPs)
+	if err != nil {
+		return nil, err
+	}
+	// the resolvers replace the system resolver of the dials
+	var res *resolver
+	lookup := net.DefaultResolver.LookupIPAddr
+	if len(config.Resolvers) > 0 {
+		transport, err := newDNSTransport(config.Resolvers, config.ProxyAddress)
+		if err != nil {
+			return nil, err
+		}
+		res = newResolver(transport)
+		lookup = res.lookupIPAddr
+	}
+	var rebind *rebindGuard
+	if config.Rebinding {
+		if rebind, err = newRebindGuard(config.RebindAllow, lookup); err != nil {
+			return nil, err
+		}
+	}
+	var uncloak *uncloaker
+	if config.Uncloak {
+		// without a name server in /etc/resolv.conf, as on Windows, the
+		// system resolver is asked
+		if len(config.Resolvers) == 0 && systemDNSServer() == "" {
+			uncloak = newSystemUncloaker(net.DefaultResolver)
+		} else {
+			transport, err := newDNSTransport(config.Resolvers, config.ProxyAddress)
+			if err != nil {
+				return nil, err
+			}
+			uncloak = newUncloaker(transport)
+		}
+	}
+	ports, err := newPortPolicy(config.Ports, config.PortRules)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := newProxyAuth(config.Users)
+	if err != nil {
+		return nil, err
+	}
+	budgets, err := newBudgets(config.Budgets, budgetsFile())
+	if err != nil {
+		return nil, err
+	}
 	app := &App{
 		blockerAddress:   config.BlockerAddress,
 		blockerEnabled:   defaultBlockerEnabled,
 		autostartEnabled: config.AutostartEnabled,
-		storage: &Storage{
-			blocklistPath:  config.BlocklistPath,
-			blacklistPath:  config.BlacklistPath,
-			whitelistPath:  config.WhitelistPath,
-			updateInterval: config.UpdateInterval,
-		},
-		QuitCh: make(chan struct{}, 1),
+		controlAddress:   config.ControlAddress,
+		adminAddress:     config.AdminAddress,
+		adminToken:       config.AdminToken,
+		invalidRules:     config.InvalidRules,
+		acl:              acl,
+		maxClientConns:   config.MaxClientConns,
+		ruleErrors:       make(map[string]ruleErrors),
+		loadedLists:      make(map[string]bool),
+		storage:          newStorage(&config),
+		events:           newEventBus(),
+		activity:         newActivity(),
+		queryLog:         newQueryLog(config.QueryLogSize, config.QueryLogPath, config.QueryLogRetention),
+		stats:            newStats(statsFile()),
+		ruleHits:         newRuleHits(ruleHitsFile()),
+		temporary:        newTempRules(temporaryFile()),
+		budgets:          budgets,
+		access:           newAccessRequests(),
+		metrics:          newMetrics(),
+		QuitCh:           make(chan struct{}, 1),
+	}
+
+	if err := app.queryLog.load(); err != nil {
+		log.Println("Error reading query log: ", err)
+	}
+	if err := app.stats.load(); err != nil {
+		log.Println("Error reading statistics: ", err)
+	}
+	app.stats.autosave(statsSaveInterval)
+	if err := app.ruleHits.load(); err != nil {
+		log.Println("Error reading rule hits: ", err)
+	}
+	app.ruleHits.autosave(statsSaveInterval)
+	app.temporary.expired = func(rules []tempRule) {
+		for _, r := range rules {
+			log.Println("Temporary rule expired: ", r)
+		}
+		app.updateTemporary()
+	}
+	if err := app.temporary.load(); err != nil {
+		log.Println("Error reading temporary rules: ", err)
+	}
+	if err := app.budgets.load(); err != nil {
+		log.Println("Error reading budgets: ", err)
 	}
+	app.budgets.autosave(statsSaveInterval)
+	app.events.handle(func(e event) {
+		app.activity.record(e.query)
+		app.queryLog.record(e.query)
+		app.stats.record(e.query)
+		app.ruleHits.record(e.query)
+		app.metrics.observe(e)
+	})
 
 	// set upstream proxy for default http client
 	if app.proxyAddress != "" {
@@ -65,6 +207,22 @@ func NewApp(config Config) (*App, error) {
 	app.blocker = NewBlocker(
 		WithBlockerEnabled(app.blockerEnabled),
 		WithBlockerProxyAddress(app.proxyAddress),
+		WithBlockerTemporary(app.temporary),
+		WithBlockerBudgets(app.budgets),
+		WithBlockerSchedules(schedules),
+		WithBlockerGroups(groups),
+		WithBlockerPorts(ports),
+		WithBlockerRebinding(rebind),
+		WithBlockerUncloak(uncloak),
+		WithBlockerResolver(res),
+		WithBlockerLookup(lookup),
+		WithBlockerIPs(config.BlockIPs, allowIPs),
+		WithBlockerResolveRanges(config.ResolveRanges),
+		WithBlockerAuth(auth),
+		WithBlockerFocus(config.FocusEnabled),
+		WithBlockerAccess(app.RequestAccess),
+		WithBlockerEvents(app.events),
+		WithBlockerMetrics(app.metrics),
 	)
 	if err := app.LoadBlocklist(true); err != nil {
 		return nil, err
@@ -75,15 +233,37 @@ func NewApp(config Config) (*App, error) {
 	if err := app.LoadWhitelist(); err != nil {
 		return nil, err
 	}
+	if err := app.LoadFocuslist(); err != nil {
+		return nil, err
+	}
+	if err := app.LoadRanges(); err != nil {
+		return nil, err
+	}
+	if err := app.LoadOverrides(); err != nil {
+		return nil, err
+	}
+
+	if app.adminAddress != "" {
+		token, err := loadAdminToken(app.adminToken, adminTokenFile())
+		if err != nil {
+			return nil, err
+		}
+		app.adminToken = token
+	}
 
 	gui, err := NewGUI(
 		WithGUIEnabled(app.blockerEnabled),
 		WithGUIAutostart(app.autostartEnabled),
+		WithGUIDashboard(app.adminAddress != ""),
+		WithGUIBudgets(app.Budgets),
 	)
 	if err != nil {
 		return nil, err
 	}
 	app.gui = gui
+	app.gui.SetInvalidRules(len(app.Status().InvalidRules))
+	app.updateTemporary()
+	app.gui.SetFocus(app.blocker.Focus())
 
 	autostart, err := NewAutostart()
 	if err != nil {
@@ -104,37 +284,479 @@ func (app *App) LoadBlocklist(allowCache bool) error {
 	if err != nil {
 		return err
 	}
-	app.blocker.blocklist = blocklist
+	app.blocker.SetBlocklist(blocklist)
 	return nil
 }
 
-// LoadBlacklist reads the blacklist file
+// LoadBlacklist reads the blacklist of the rule sets
 // and initializes the blocker's blacklist matcher.
 func (app *App) LoadBlacklist() error {
 	blacklist, err := app.storage.GetBlacklist()
-	if err != nil {
+	if err := app.checkRules(listBlacklist, err); err != nil {
 		return err
 	}
 	log.Println("Blacklist loaded")
-	app.blocker.blacklist = blacklist
+	app.blocker.SetBlacklist(blacklist)
+	app.seenRules(listBlacklist)
 	return nil
 }
 
-// LoadWhitelist reads the whitelist file
+// LoadWhitelist reads the whitelist of the rule sets
 // and initializes the blocker's whitelist matcher.
 func (app *App) LoadWhitelist() error {
 	whitelist, err := app.storage.GetWhitelist()
-	if err != nil {
+	if err := app.checkRules(listWhitelist, err); err != nil {
 		return err
 	}
 	log.Println("Whitelist loaded")
-	app.blocker.whitelist = whitelist
+	app.blocker.SetWhitelist(whitelist)
+	app.seenRules(listWhitelist)
+	return nil
+}
+
+// LoadFocuslist reads the focus list
+// and initializes the blocker's focus list matcher.
+func (app *App) LoadFocuslist() error {
+	focuslist, err := app.storage.GetFocuslist()
+	if err := app.checkRules(listFocuslist, err); err != nil {
+		return err
+	}
+	log.Println("Focus list loaded")
+	app.blocker.SetFocuslist(focuslist)
+	return nil
+}
+
+// LoadRanges reads the blocked address ranges
+func (app *App) LoadRanges() error {
+	ranges, err := app.storage.GetRanges()
+	if err := app.checkRules(listRanges, err); err != nil {
+		return err
+	}
+	log.Println("Blocked ranges loaded")
+	app.blocker.SetRanges(ranges)
 	return nil
 }
 
-// RunBlocker serves the Blocker.
+// LoadOverrides reads the host overrides
+func (app *App) LoadOverrides() error {
+	overrides, err := app.storage.GetOverrides()
+	if err := app.checkRules(listOverrides, err); err != nil {
+		return err
+	}
+	log.Println("Host overrides loaded")
+	app.blocker.SetOverrides(overrides)
+	return nil
+}
+
+// Handling of the invalid rules of a rule list.
+const (
+	// invalidRulesSkip loads the valid rules
+	invalidRulesSkip = "skip"
+	// invalidRulesKeep keeps the previously loaded rules
+	invalidRulesKeep = "keep"
+)
+
+// checkRules records the invalid rules of a rule list. It returns an error
+// if the list cannot be read or its previously loaded rules are kept.
+func (app *App) checkRules(list string, err error) error {
+	errs, invalid := err.(ruleErrors)
+	if err != nil && !invalid {
+		return err
+	}
+	for _, e := range errs {
+		log.Println("Invalid rule: ", e)
+	}
+
+	app.mu.Lock()
+	app.ruleErrors[list] = errs
+	keep := invalid && app.invalidRules == invalidRulesKeep && app.loadedLists[list]
+	if !keep {
+		app.loadedLists[list] = true
+	}
+	count := 0
+	for _, errs := range app.ruleErrors {
+		count += len(errs)
+	}
+	app.mu.Unlock()
+
+	if app.gui != nil {
+		app.gui.SetInvalidRules(count)
+	}
+	if keep {
+		log.Printf("Keeping the previous %s\n", list)
+		return errs
+	}
+	return nil
+}
+
+// seenRules updates the rule hit counters with the rules of a list.
+func (app *App) seenRules(list string) {
+	rules, err := app.storage.ListRules(list)
+	if err != nil {
+		log.Printf("Error reading %s: %v\n", list, err)
+		return
+	}
+	app.ruleHits.seen(list, rules, time.Now())
+}
+
+// Reload updates the blocklist and reloads the blacklist and whitelist.
+func (app *App) Reload() error {
+	var failed error
+	if err := app.LoadBlocklist(false); err != nil {
+		log.Println("Error reloading blocklist: ", err)
+		failed = err
+	}
+	if err := app.LoadBlacklist(); err != nil {
+		log.Println("Error reloading blacklist: ", err)
+		failed = err
+	}
+	if err := app.LoadWhitelist(); err != nil {
+		log.Println("Error reloading whitelist: ", err)
+		failed = err
+	}
+	if err := app.LoadFocuslist(); err != nil {
+		log.Println("Error reloading focus list: ", err)
+		failed = err
+	}
+	if err := app.LoadRanges(); err != nil {
+		log.Println("Error reloading blocked ranges: ", err)
+		failed = err
+	}
+	if err := app.LoadOverrides(); err != nil {
+		log.Println("Error reloading host overrides: ", err)
+		failed = err
+	}
+	return failed
+}
+
+// SetEnabled enables or disables blocking and cancels a pending pause.
+func (app *App) SetEnabled(enabled bool) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	app.stopPause()
+	app.setEnabled(enabled)
+}
+
+func (app *App) setEnabled(enabled bool) {
+	app.blocker.SetEnabled(enabled)
+	if app.gui != nil {
+		app.gui.SetEnabled(enabled)
+	}
+	log.Println("Blocker enabled set to: ", enabled)
+}
+
+// Pause disables blocking for the given duration, or until restart if
+// the duration is not positive.
+func (app *App) Pause(d time.Duration) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	app.pause(d)
+}
+
+func (app *App) pause(d time.Duration) {
+	app.stopPause()
+	app.setEnabled(false)
+	app.paused = true
+	if d <= 0 {
+		log.Println("Blocking paused until restart")
+		app.setPaused()
+		return
+	}
+	app.pausedUntil = time.Now().Add(d)
+	log.Println("Blocking paused for: ", d)
+	app.setPaused()
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
+		app.mu.Lock()
+		defer app.mu.Unlock()
+		// a timer stopped while waiting for the lock does nothing
+		if app.pauseTimer != timer {
+			return
+		}
+		app.stopPause()
+		app.setEnabled(true)
+		log.Println("Pause ended, blocking resumed")
+	})
+	app.pauseTimer = timer
+}
+
+func (app *App) stopPause() {
+	if app.pauseTimer != nil {
+		app.pauseTimer.Stop()
+		app.pauseTimer = nil
+	}
+	if app.paused {
+		app.paused = false
+		app.pausedUntil = time.Time{}
+		app.setPaused()
+	}
+}
+
+func (app *App) setPaused() {
+	if app.gui != nil {
+		app.gui.SetPaused(app.paused, app.pausedUntil)
+	}
+}
+
+// SetFocus switches focus mode on or off.
+func (app *App) SetFocus(focus bool) {
+	app.blocker.SetFocus(focus)
+	if app.gui != nil {
+		app.gui.SetFocus(focus)
+	}
+	log.Println("Focus mode set to: ", focus)
+}
+
+// RequestAccess records a request to allow a host blocked in focus mode.
+func (app *App) RequestAccess(r accessRequest) {
+	app.access.add(r)
+	log.Println("Access requested: ", r)
+	app.updateAccess()
+}
+
+// AccessRequests returns the pending access requests, the oldest first.
+func (app *App) AccessRequests() []accessRequest {
+	return app.access.list()
+}
+
+// DismissAccess removes the access request of a host.
+func (app *App) DismissAccess(host string) error {
+	if !app.access.remove(host) {
+		return errRuleNotFound
+	}
+	log.Println("Access request dismissed: ", host)
+	app.updateAccess()
+	return nil
+}
+
+// grantAccess removes the access request of an allowed host.
+func (app *App) grantAccess(host string) {
+	if app.access.remove(host) {
+		log.Println("Access request granted: ", host)
+		app.updateAccess()
+	}
+}
+
+func (app *App) updateAccess() {
+	if app.gui != nil {
+		app.gui.SetAccessRequests(len(app.AccessRequests()))
+	}
+}
+
+// Allow allows a host until restart.
+func (app *App) Allow(host string) {
+	app.blocker.Allow(host)
+	log.Println("Host allowed: ", host)
+	app.grantAccess(host)
+}
+
+// AddTemporary adds a temporary allow or block rule.
+func (app *App) AddTemporary(r tempRule) error {
+	if err := app.temporary.add(r); err != nil {
+		return err
+	}
+	log.Println("Temporary rule added: ", r)
+	app.updateTemporary()
+	if r.Action == tempAllow {
+		app.grantAccess(r.Host)
+	}
+	return nil
+}
+
+// RemoveTemporary removes the temporary rule of a host.
+func (app *App) RemoveTemporary(host string) error {
+	if err := app.temporary.remove(host); err != nil {
+		return err
+	}
+	log.Println("Temporary rule removed: ", host)
+	app.updateTemporary()
+	return nil
+}
+
+// Temporary returns the temporary rules, the first to expire first.
+func (app *App) Temporary() []tempRule {
+	return app.temporary.list(time.Now())
+}
+
+func (app *App) updateTemporary() {
+	if app.gui != nil {
+		app.gui.SetTemporary(len(app.Temporary()))
+	}
+}
+
+// Budgets returns the usage of the time budgets today.
+func (app *App) Budgets() []budgetStatus {
+	return app.budgets.list()
+}
+
+// Sources returns the blocklist sources with the status of their last fetch.
+func (app *App) Sources() ([]sourceStatus, error) {
+	return app.storage.GetSources()
+}
+
+// Decide returns the decision of the blocker about a host.
+func (app *App) Decide(host string) Decision {
+	return app.blocker.Decide(host)
+}
+
+// DecideFor returns the decision of the blocker about a host for a client.
+func (app *App) DecideFor(host string, c client) Decision {
+	return app.blocker.DecideFor(host, c)
+}
+
+// Rules returns the rules of a rule list.
+func (app *App) Rules(list string) ([]string, error) {
+	return app.storage.GetRules(list)
+}
+
+// AddRule adds a rule to a rule list file and reloads the list.
+func (app *App) AddRule(list, rule string) error {
+	if err := validateRule(rule); err != nil {
+		return err
+	}
+	if err := app.storage.AddRule(list, rule); err != nil {
+		return err
+	}
+	log.Printf("Rule added to %s: %s\n", list, rule)
+	return app.loadRules(list)
+}
+
+// RemoveRule removes a rule from a rule list file and reloads the list.
+func (app *App) RemoveRule(list, rule string) error {
+	if err := app.storage.RemoveRule(list, rule); err != nil {
+		return err
+	}
+	log.Printf("Rule removed from %s: %s\n", list, rule)
+	return app.loadRules(list)
+}
+
+func (app *App) loadRules(list string) error {
+	switch list {
+	case listWhitelist:
+		return app.LoadWhitelist()
+	case listBlacklist:
+		return app.LoadBlacklist()
+	}
+	return errUnknownList
+}
+
+// RuleSets returns the status of the rule sets in merge order.
+func (app *App) RuleSets() ([]ruleSetStatus, error) {
+	return ruleSetStatuses(app.storage.RuleSets())
+}
+
+// Activity returns the activity counters with the top n blocked hosts.
+func (app *App) Activity(n int) activitySummary {
+	return app.activity.summary(n)
+}
+
+// Queries returns the logged queries matching the filter, newest first.
+func (app *App) Queries(f queryFilter) ([]query, error) {
+	return app.queryLog.search(f)
+}
+
+// Stats returns the statistics report of a period since a time.
+func (app *App) Stats(period string, since time.Time, n int) (statsReport, error) {
+	return app.stats.report(period, since, n)
+}
+
+// RuleUsage returns the hit counters of the rules of the given lists.
+func (app *App) RuleUsage(lists []string) ([]ruleUsage, error) {
+	return listUsage(app.storage, app.ruleHits, lists, time.Now())
+}
+
+// DeadRules returns the rules that have not matched within the period.
+func (app *App) DeadRules(period time.Duration) ([]ruleUsage, error) {
+	now := time.Now()
+	usage, err := listUsage(app.storage, app.ruleHits, ruleLists, now)
+	if err != nil {
+		return nil, err
+	}
+	return deadRules(usage, period, now), nil
+}
+
+// RedundantRules returns the whitelist rules that nothing would block.
+func (app *App) RedundantRules() ([]ruleUsage, error) {
+	return redundantWhitelist(app.storage, app.ruleHits, time.Now())
+}
+
+// Close flushes and closes the persisted state of the App.
+func (app *App) Close() error {
+	app.temporary.Close()
+	if err := app.stats.Close(); err != nil {
+		log.Println("Error saving statistics: ", err)
+	}
+	if err := app.ruleHits.Close(); err != nil {
+		log.Println("Error saving rule hits: ", err)
+	}
+	if err := app.budgets.Close(); err != nil {
+		log.Println("Error saving budgets: ", err)
+	}
+	return app.queryLog.Close()
+}
+
+// WriteMetrics writes the metrics in the Prometheus text format.
+func (app *App) WriteMetrics(w io.Writer) error {
+	sources, err := app.storage.GetSources()
+	if err != nil {
+		log.Println("Error reading blocklist status: ", err)
+	}
+	return app.metrics.write(w, metricsSnapshot{
+		rules:   app.blocker.RuleCounts(),
+		sources: sources,
+	})
+}
+
+// Status is a snapshot of the runtime state of the App.
+type Status struct {
+	Enabled bool `json:"enabled"`
+	// Paused is set while blocking is paused until PausedUntil, or until
+	// restart if PausedUntil is nil
+	Paused         bool            `json:"paused,omitempty"`
+	PausedUntil    *time.Time      `json:"pausedUntil,omitempty"`
+	Allowed        []string        `json:"allowed"`
+	Temporary      []tempRule      `json:"temporary,omitempty"`
+	Schedules      []string        `json:"schedules,omitempty"`
+	Focus          bool            `json:"focus"`
+	AccessRequests []accessRequest `json:"accessRequests,omitempty"`
+	Budgets        []budgetStatus  `json:"budgets,omitempty"`
+	InvalidRules   []ruleError     `json:"invalidRules,omitempty"`
+}
+
+// Status returns the runtime state of the App.
+func (app *App) Status() Status {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	status := Status{
+		Enabled:        app.blocker.Enabled(),
+		Paused:         app.paused,
+		Allowed:        app.blocker.Allowed(),
+		Temporary:      app.Temporary(),
+		Schedules:      app.blocker.ActiveSchedules(),
+		Focus:          app.blocker.Focus(),
+		AccessRequests: app.AccessRequests(),
+		Budgets:        app.Budgets(),
+	}
+	if !app.pausedUntil.IsZero() {
+		pausedUntil := app.pausedUntil
+		status.PausedUntil = &pausedUntil
+	}
+	for _, list := range ruleLists {
+		status.InvalidRules = append(status.InvalidRules, app.ruleErrors[list]...)
+	}
+	status.InvalidRules = append(status.InvalidRules, app.ruleErrors[listFocuslist]...)
+	status.InvalidRules = append(status.InvalidRules, app.ruleErrors[listRanges]...)
+	status.InvalidRules = append(status.InvalidRules, app.ruleErrors[listOverrides]...)
+	return status
+}
+
+// RunBlocker serves the Blocker to the clients in the ACL.
 func (app *App) RunBlocker() error {
-	return http.ListenAndServe(app.blockerAddress, app.blocker)
+	listener, err := net.Listen("tcp", app.blockerAddress)
+	if err != nil {
+		return err
+	}
+	return http.Serve(newClientListener(listener, app.acl, app.maxClientConns), app.blocker)
 }
 
 // RunGUI starts the GUI.
@@ -143,21 +765,29 @@ func (app *App) RunGUI() {
 		for {
 			select {
 			case enabled := <-app.gui.EnabledCh:
-				app.blocker.enabled = enabled
+				app.SetEnabled(enabled)
+			case d := <-app.gui.PauseCh:
+				app.Pause(d)
+			case focus := <-app.gui.FocusCh:
+				app.SetFocus(focus)
 			case enabled := <-app.gui.AutostartCh:
 				if err := app.autostart.setEnabled(enabled); err != nil {
 					log.Println("Error setting autostart: ", err)
 				}
 				log.Println("Autostart set to: ", enabled)
 			case <-app.gui.UpdateCh:
-				if err := app.LoadBlocklist(false); err != nil {
-					log.Println("Error reloading blocklist: ", err)
+				app.Reload()
+			case host := <-app.gui.AllowCh:
+				rule, err := parseTempRule(tempAllow, host, guiAllowDuration.String(), time.Now())
+				if err == nil {
+					err = app.AddTemporary(rule)
 				}
-				if err := app.LoadBlacklist(); err != nil {
-					log.Println("Error reloading blacklist: ", err)
+				if err != nil {
+					log.Println("Error allowing host: ", err)
 				}
-				if err := app.LoadWhitelist(); err != nil {
-					log.Println("Error reloading whitelist: ", err)
+			case <-app.gui.DashboardCh:
+				if err := openBrowser(dashboardURL(app.adminAddress, app.adminToken)); err != nil {
+					log.Println("Error opening dashboard: ", err)
 				}
 			case <-app.gui.QuitCh:
 				app.QuitCh <- struct{}{}
@@ -165,5 +795,13 @@ func (app *App) RunGUI() {
 			}
 		}
 	}()
+	go func() {
+		events, _ := app.events.subscribe(defaultEventBuffer)
+		for e := range events {
+			if e.Blocked {
+				app.gui.SetLastBlocked(e.Host)
+			}
+		}
+	}()
 	app.gui.Run()
 }
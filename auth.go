@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/elazarl/goproxy.v1"
+)
+
+// passwordScheme is the scheme of the password hashes.
+const passwordScheme = "pbkdf2-sha256"
+
+// passwordIterations is the PBKDF2 iteration count of new password hashes.
+const passwordIterations = 100000
+
+// proxyRealm is the realm of the proxy authentication.
+const proxyRealm = "Lycurgus"
+
+var errInvalidPasswordHash = errors.New("invalid password hash")
+
+// proxyUser is a user of the proxy authentication.
+type proxyUser struct {
+	Name string `yaml:"name"`
+	// Password is the hash of the password made by the hash command
+	Password string `yaml:"password"`
+}
+
+func (u proxyUser) String() string {
+	return u.Name
+}
+
+// hashPassword returns the salted PBKDF2 hash of a password as
+// pbkdf2-sha256$<iterations>$<salt>$<key>.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2([]byte(password), salt, passwordIterations)
+	return fmt.Sprintf("%s$%d$%s$%s", passwordScheme, passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// parsePasswordHash returns the iterations, the salt and the key of a
+// password hash.
+func parsePasswordHash(hash string) (int, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != passwordScheme {
+		return 0, nil, nil, errInvalidPasswordHash
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return 0, nil, nil, errInvalidPasswordHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return 0, nil, nil, errInvalidPasswordHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) != sha256.Size {
+		return 0, nil, nil, errInvalidPasswordHash
+	}
+	return iterations, salt, key, nil
+}
+
+// checkPassword reports whether a password matches a password hash.
+func checkPassword(hash, password string) bool {
+	iterations, salt, key, err := parsePasswordHash(hash)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(pbkdf2([]byte(password), salt, iterations), key)
+}
+
+// pbkdf2 derives a key of one SHA-256 block from a password (RFC 8018).
+func pbkdf2(password, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, password)
+	prf.Write(salt)
+	prf.Write([]byte{0, 0, 0, 1})
+	u := prf.Sum(nil)
+	key := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+// maxAuthFailures is the number of failed passwords of a user from an
+// address in authFailureWindow before its passwords are not checked.
+const (
+	maxAuthFailures   = 5
+	authFailureWindow = time.Minute
+)
+
+// maxAuthFailureEntries is the number of users and addresses with
+// failed passwords kept.
+const maxAuthFailureEntries = 1000
+
+// proxyAuth checks the Proxy-Authorization Basic credentials of the
+// requests against the users.
+type proxyAuth struct {
+	users map[string]string
+	// dummy is checked for unknown users so they take as long as the others
+	dummy string
+	// key is the random key of the password MACs kept in memory
+	key []byte
+	now func() time.Time
+
+	mu sync.Mutex
+	// verified maps the users to the MAC of their last verified password,
+	// so the hash is not derived on every request
+	verified map[string][]byte
+	// failures maps the users and addresses to their recent failures
+	failures map[string]authFailure
+}
+
+// authFailure records the failed passwords of a user from an address.
+type authFailure struct {
+	// mac is the MAC of the last failed password
+	mac   []byte
+	count int
+	since time.Time
+}
+
+// newProxyAuth creates the proxy authentication of the users or returns
+// nil without users.
+func newProxyAuth(users []proxyUser) (*proxyAuth, error) {
+	if len(users) == 0 {
+		return nil, nil
+	}
+	a := &proxyAuth{
+		users: make(map[string]string),
+		dummy: fmt.Sprintf("%s$%d$%s$%s", passwordScheme, passwordIterations,
+			base64.RawStdEncoding.EncodeToString(make([]byte, 16)),
+			base64.RawStdEncoding.EncodeToString(make([]byte, sha256.Size))),
+		key:      make([]byte, 32),
+		now:      time.Now,
+		verified: make(map[string][]byte),
+		failures: make(map[string]authFailure),
+	}
+	if _, err := rand.Read(a.key); err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		if u.Name == "" || strings.Contains(u.Name, ":") {
+			return nil, fmt.Errorf("invalid user name: %q", u.Name)
+		}
+		if _, ok := a.users[u.Name]; ok {
+			return nil, fmt.Errorf("duplicate user name: %s", u.Name)
+		}
+		if _, _, _, err := parsePasswordHash(u.Password); err != nil {
+			return nil, fmt.Errorf("user %s: %v", u.Name, err)
+		}
+		a.users[u.Name] = u.Password
+	}
+	return a, nil
+}
+
+// check returns the user of a request and whether its credentials are
+// valid.
+func (a *proxyAuth) check(req *http.Request) (string, bool) {
+	user, password, ok := proxyCredentials(req)
+	if !ok {
+		return "", false
+	}
+	return user, a.verify(user, password, stripPort(req.RemoteAddr))
+}
+
+// verify reports whether a password is the password of a user. A failed
+// password of a user from an address is not checked again, and after
+// maxAuthFailures none are until authFailureWindow passes.
+func (a *proxyAuth) verify(user, password, addr string) bool {
+	mac := a.mac(user, password)
+	key := user + " " + addr
+	now := a.now()
+
+	a.mu.Lock()
+	verified, ok := a.verified[user]
+	failure, failed := a.failures[key]
+	a.mu.Unlock()
+	if ok && hmac.Equal(verified, mac) {
+		return true
+	}
+	if failed && now.Sub(failure.since) < authFailureWindow &&
+		(failure.count >= maxAuthFailures || hmac.Equal(failure.mac, mac)) {
+		return false
+	}
+
+	hash, known := a.users[user]
+	if !known {
+		hash = a.dummy
+	}
+	valid := checkPassword(hash, password) && known
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if valid {
+		a.verified[user] = mac
+		delete(a.failures, key)
+		return true
+	}
+	failure, failed = a.failures[key]
+	if !failed || now.Sub(failure.since) >= authFailureWindow {
+		failure = authFailure{since: now}
+	}
+	failure.mac = mac
+	failure.count++
+	if len(a.failures) >= maxAuthFailureEntries {
+		for k, f := range a.failures {
+			if now.Sub(f.since) >= authFailureWindow {
+				delete(a.failures, k)
+			}
+		}
+	}
+	if failed || len(a.failures) < maxAuthFailureEntries {
+		a.failures[key] = failure
+	}
+	return false
+}
+
+// mac returns the MAC of the password of a user.
+func (a *proxyAuth) mac(user, password string) []byte {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(user + ":" + password))
+	return mac.Sum(nil)
+}
+
+// authRequired returns the response asking for the proxy credentials.
+func authRequired(req *http.Request) *http.Response {
+	resp := goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusProxyAuthRequired, "Proxy authentication required\n")
+	resp.Header.Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", proxyRealm))
+	return resp
+}
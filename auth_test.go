@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHashPassword(t *testing.T) {
+	hash, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkPassword(hash, "secret") {
+		t.Errorf("secret should match its hash %v", hash)
+	}
+	if checkPassword(hash, "Secret") {
+		t.Errorf("Secret should not match the hash of secret")
+	}
+	if other, _ := hashPassword("secret"); other == hash {
+		t.Errorf("hashes of the same password should be salted; got: %v twice", hash)
+	}
+
+	// RFC 7914 test vector of PBKDF2-HMAC-SHA-256
+	key := pbkdf2([]byte("passwd"), []byte("salt"), 1)
+	if want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"; hex.EncodeToString(key) != want {
+		t.Errorf("pbkdf2 should be %v; got: %v", want, hex.EncodeToString(key))
+	}
+
+	for _, invalid := range []string{"", "secret", "md5$1$c2FsdA$a2V5", "pbkdf2-sha256$x$c2FsdA$a2V5", "pbkdf2-sha256$1$c2FsdA$a2V5"} {
+		if checkPassword(invalid, "secret") {
+			t.Errorf("invalid hash %q should not match", invalid)
+		}
+	}
+}
+
+func TestNewProxyAuth(t *testing.T) {
+	hash, _ := hashPassword("secret")
+	tt := []struct {
+		name  string
+		users []proxyUser
+		err   bool
+	}{
+		{"valid", []proxyUser{{Name: "alice", Password: hash}}, false},
+		{"no name", []proxyUser{{Password: hash}}, true},
+		{"colon", []proxyUser{{Name: "a:b", Password: hash}}, true},
+		{"duplicate", []proxyUser{{Name: "alice", Password: hash}, {Name: "alice", Password: hash}}, true},
+		{"plain password", []proxyUser{{Name: "alice", Password: "secret"}}, true},
+	}
+	for _, tc := range tt {
+		_, err := newProxyAuth(tc.users)
+		if (err != nil) != tc.err {
+			t.Errorf("%v error should be %v; got: %v", tc.name, tc.err, err)
+		}
+	}
+	if auth, err := newProxyAuth(nil); auth != nil || err != nil {
+		t.Errorf("auth without users should be nil; got: %v, %v", auth, err)
+	}
+}
+
+func TestProxyAuthCheck(t *testing.T) {
+	hash, _ := hashPassword("secret")
+	auth, err := newProxyAuth([]proxyUser{{Name: "alice", Password: hash}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		user, password string
+		ok             bool
+	}{
+		{"alice", "secret", true},
+		// verified passwords are cached
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "secret", false},
+	}
+	for _, tc := range tt {
+		req, _ := http.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+		req.Header.Set("Proxy-Authorization", basicAuth(tc.user, tc.password))
+		if user, ok := auth.check(req); ok != tc.ok || user != tc.user {
+			t.Errorf("%v:%v should be %v; got: %v %v", tc.user, tc.password, tc.ok, user, ok)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+	if _, ok := auth.check(req); ok {
+		t.Errorf("request without credentials should be rejected")
+	}
+	resp := authRequired(req)
+	if resp.StatusCode != http.StatusProxyAuthRequired || resp.Header.Get("Proxy-Authenticate") != `Basic realm="Lycurgus"` {
+		t.Errorf("response should ask for credentials; got: %v %v", resp.StatusCode, resp.Header)
+	}
+}
+
+func basicAuth(user, password string) string {
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth(user, password)
+	return req.Header.Get("Authorization")
+}
+
+func TestProxyAuthFailures(t *testing.T) {
+	hash, _ := hashPassword("secret")
+	auth, err := newProxyAuth([]proxyUser{{Name: "alice", Password: hash}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	auth.now = func() time.Time { return now }
+
+	if !auth.verify("alice", "secret", "10.0.0.1") {
+		t.Fatal("alice should be verified")
+	}
+	if sum := sha256.Sum256([]byte("secret")); bytes.Equal(auth.verified["alice"], sum[:]) {
+		t.Errorf("verified passwords should not be kept as plain hashes")
+	}
+	if auth.verify("bob", "secret", "10.0.0.1") {
+		t.Errorf("unknown user should not be verified")
+	}
+
+	for i := 0; i < maxAuthFailures; i++ {
+		if auth.verify("alice", fmt.Sprintf("wrong%d", i), "10.0.0.2") {
+			t.Fatalf("wrong password %d should not be verified", i)
+		}
+	}
+	if f := auth.failures["alice 10.0.0.2"]; f.count != maxAuthFailures {
+		t.Errorf("failures should be %d; got: %d", maxAuthFailures, f.count)
+	}
+	// the verified password is still accepted, a new one is not checked
+	if !auth.verify("alice", "secret", "10.0.0.2") {
+		t.Errorf("verified password should be accepted")
+	}
+	auth.verified = make(map[string][]byte)
+	if auth.verify("alice", "secret", "10.0.0.2") {
+		t.Errorf("password should not be checked over the failure limit")
+	}
+	if !auth.verify("alice", "secret", "10.0.0.3") {
+		t.Errorf("failures of an address should not limit the others")
+	}
+	auth.verified = make(map[string][]byte)
+	now = now.Add(authFailureWindow)
+	if !auth.verify("alice", "secret", "10.0.0.2") {
+		t.Errorf("password should be checked once the failure window passed")
+	}
+}
@@ -1,14 +1,24 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
 
 	"gopkg.in/elazarl/goproxy.v1"
 )
 
 // Blocker blocks HTTP requests based on different rules
 type Blocker struct {
+	mu           sync.RWMutex
 	enabled      bool
 	proxyAddress string
 
@@ -16,6 +26,47 @@ type Blocker struct {
 	blocklist Matcher
 	blacklist Matcher
 	whitelist Matcher
+	// focus denies the hosts not in the whitelist or the focus list
+	focus     bool
+	focuslist Matcher
+	// allowed holds the hosts allowed at runtime until restart
+	allowed   map[string]bool
+	temporary *tempRules
+	budgets   *budgets
+	schedules []schedule
+	groups    []clientGroup
+	// ranges are the blocked address ranges, checked for the resolved
+	// addresses of the host names if resolveRanges is set
+	ranges        *ipRanges
+	resolveRanges bool
+	lookup        lookupFunc
+	// blockIPs blocks the IP-literal hosts outside allowIPs
+	blockIPs bool
+	allowIPs []*net.IPNet
+	// rebind guards the dials against DNS rebinding if set
+	rebind *rebindGuard
+	// uncloak resolves the CNAME chains of the hosts if set
+	uncloak *uncloaker
+	// resolver resolves the dialed host names instead of the system
+	// resolver if set
+	resolver *resolver
+	// overrides map the hosts to the dialed addresses or block them
+	overrides *hostOverrides
+	// ports restricts the destination ports of the tunnels if set
+	ports *portPolicy
+	// auth checks the proxy credentials if set
+	auth    *proxyAuth
+	rejects rejectLog
+	// now returns the current local time
+	now func() time.Time
+	// requestAccess is called with the access requests of the block page
+	requestAccess func(accessRequest)
+	// accessKey signs the access request forms
+	accessKey    []byte
+	accessLimits *accessLimiter
+
+	events  *eventBus
+	metrics *metrics
 }
 
 // BlockerOption is a functional option for configuring Blocker.
@@ -35,10 +86,143 @@ func WithBlockerProxyAddress(url string) BlockerOption {
 	}
 }
 
+// WithBlockerFocus sets whether the blocker starts in focus mode.
+func WithBlockerFocus(focus bool) BlockerOption {
+	return func(b *Blocker) {
+		b.focus = focus
+	}
+}
+
+// WithBlockerAccess sets the function called with the access requests.
+func WithBlockerAccess(requestAccess func(accessRequest)) BlockerOption {
+	return func(b *Blocker) {
+		b.requestAccess = requestAccess
+	}
+}
+
+// WithBlockerTemporary sets the temporary allow and block rules.
+func WithBlockerTemporary(t *tempRules) BlockerOption {
+	return func(b *Blocker) {
+		b.temporary = t
+	}
+}
+
+// WithBlockerBudgets sets the daily time budgets of the tunnels.
+func WithBlockerBudgets(budgets *budgets) BlockerOption {
+	return func(b *Blocker) {
+		b.budgets = budgets
+	}
+}
+
+// WithBlockerSchedules sets the schedules evaluated on every decision.
+func WithBlockerSchedules(schedules []schedule) BlockerOption {
+	return func(b *Blocker) {
+		b.schedules = schedules
+	}
+}
+
+// WithBlockerGroups sets the client groups with their own rule sets
+// and schedules.
+func WithBlockerGroups(groups []clientGroup) BlockerOption {
+	return func(b *Blocker) {
+		b.groups = groups
+	}
+}
+
+// WithBlockerIPs sets whether the IP-literal hosts outside the allowed
+// networks are blocked.
+func WithBlockerIPs(block bool, allow []*net.IPNet) BlockerOption {
+	return func(b *Blocker) {
+		b.blockIPs = block
+		b.allowIPs = allow
+	}
+}
+
+// WithBlockerResolveRanges sets whether the resolved addresses of the
+// host names are checked against the blocked ranges.
+func WithBlockerResolveRanges(resolve bool) BlockerOption {
+	return func(b *Blocker) {
+		b.resolveRanges = resolve
+	}
+}
+
+// WithBlockerLookup sets the lookup of the addresses of the host names.
+func WithBlockerLookup(lookup lookupFunc) BlockerOption {
+	return func(b *Blocker) {
+		b.lookup = lookup
+	}
+}
+
+// WithBlockerRebinding sets the guard of the dials against DNS rebinding.
+func WithBlockerRebinding(g *rebindGuard) BlockerOption {
+	return func(b *Blocker) {
+		b.rebind = g
+	}
+}
+
+// WithBlockerUncloak sets the resolver of the CNAME chains matched
+// against the blocklist and the blacklist.
+func WithBlockerUncloak(u *uncloaker) BlockerOption {
+	return func(b *Blocker) {
+		b.uncloak = u
+	}
+}
+
+// WithBlockerResolver sets the resolver of the dialed host names.
+func WithBlockerResolver(r *resolver) BlockerOption {
+	return func(b *Blocker) {
+		b.resolver = r
+	}
+}
+
+// WithBlockerPorts sets the destination ports allowed for the tunnels.
+func WithBlockerPorts(ports *portPolicy) BlockerOption {
+	return func(b *Blocker) {
+		b.ports = ports
+	}
+}
+
+// WithBlockerAuth sets the proxy authentication of the clients.
+func WithBlockerAuth(auth *proxyAuth) BlockerOption {
+	return func(b *Blocker) {
+		b.auth = auth
+	}
+}
+
+// WithBlockerClock sets the clock of the schedules and temporary rules.
+func WithBlockerClock(now func() time.Time) BlockerOption {
+	return func(b *Blocker) {
+		b.now = now
+	}
+}
+
+// WithBlockerEvents sets the event bus the decisions are published on.
+func WithBlockerEvents(bus *eventBus) BlockerOption {
+	return func(b *Blocker) {
+		b.events = bus
+	}
+}
+
+// WithBlockerMetrics sets the metrics the tunnels are counted in.
+func WithBlockerMetrics(m *metrics) BlockerOption {
+	return func(b *Blocker) {
+		b.metrics = m
+	}
+}
+
 // NewBlocker creates and initializes a Blocker
 func NewBlocker(opts ...BlockerOption) *Blocker {
 	b := &Blocker{
 		enabled: defaultBlockerEnabled,
+		allowed: make(map[string]bool),
+		lookup:  net.DefaultResolver.LookupIPAddr,
+		now:     time.Now,
+
+		accessKey:    make([]byte, 32),
+		accessLimits: newAccessLimiter(),
+	}
+	if _, err := rand.Read(b.accessKey); err != nil {
+		log.Println("Error creating access key: ", err)
 	}
 
 	for _, opt := range opts {
@@ -48,41 +232,495 @@ func NewBlocker(opts ...BlockerOption) *Blocker {
 	b.proxy = goproxy.NewProxyHttpServer()
 	b.proxy.Logger.SetOutput(ioutil.Discard)
 	b.proxy.OnRequest().HandleConnectFunc(b.handleConnect)
+	b.proxy.OnRequest().DoFunc(b.handleRequest)
+	b.proxy.NonproxyHandler = http.HandlerFunc(b.serveAccess)
 	// set upstream proxy address
 	if b.proxyAddress != "" {
 		b.proxy.ConnectDial = b.proxy.NewConnectDialToProxy("http://" + b.proxyAddress)
 	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	direct := dialFunc(dialer.DialContext)
+	dial := direct
+	if b.resolver != nil {
+		dial = b.resolver.dialContext(dial)
+	}
+	if b.rebind != nil {
+		dial = b.rebind.dialContext(dial)
+	}
+	// the proxies of the environment are dialed as they are
+	proxies := envProxies()
+	b.proxy.Tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if proxies[addr] {
+			return direct(ctx, network, addr)
+		}
+		return dial(ctx, network, b.overrideAddr(addr))
+	}
+	// the tunnels through an upstream proxy are resolved there
+	if upstream := b.proxy.ConnectDial; upstream != nil {
+		if b.rebind != nil || b.resolver != nil {
+			source := "HTTPS_PROXY"
+			if b.proxyAddress != "" {
+				source = b.proxyAddress
+			}
+			log.Printf("Tunnels go through the upstream proxy (%s), the rebinding guard and the resolvers only apply to the direct connections", source)
+		}
+		b.proxy.ConnectDial = func(network, addr string) (net.Conn, error) {
+			return upstream(network, b.overrideAddr(addr))
+		}
+	} else {
+		b.proxy.ConnectDial = func(network, addr string) (net.Conn, error) {
+			return b.proxy.Tr.DialContext(context.Background(), network, addr)
+		}
+	}
+	if b.metrics != nil || b.budgets != nil {
+		dial := b.proxy.ConnectDial
+		if dial == nil {
+			dial = net.Dial
+		}
+		b.proxy.ConnectDial = func(network, addr string) (net.Conn, error) {
+			conn, err := dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			if b.metrics != nil {
+				conn = b.metrics.trackTunnel(conn)
+			}
+			if b.budgets != nil {
+				conn = b.budgets.track(addr, conn)
+			}
+			return conn, nil
+		}
+	}
 
 	return b
 }
 
+// envProxies returns the addresses of the proxies set by the environment
+// variables that the plain HTTP requests and the tunnels may go through.
+func envProxies() map[string]bool {
+	proxies := make(map[string]bool)
+	for _, name := range []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy"} {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		u, err := url.Parse(value)
+		if err != nil || u.Host == "" {
+			// a bare host:port like http.ProxyFromEnvironment allows
+			if u, err = url.Parse("http://" + value); err != nil {
+				continue
+			}
+		}
+		port := u.Port()
+		if port == "" {
+			port = "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+		}
+		proxies[net.JoinHostPort(u.Hostname(), port)] = true
+	}
+	return proxies
+}
+
 // Toggle toggles the enabled state
 func (b *Blocker) Toggle() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	b.enabled = !b.enabled
 }
 
+// SetEnabled sets the enabled state
+func (b *Blocker) SetEnabled(enabled bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.enabled = enabled
+}
+
+// Enabled returns the enabled state
+func (b *Blocker) Enabled() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.enabled
+}
+
+// SetBlocklist replaces the blocklist matcher
+func (b *Blocker) SetBlocklist(m Matcher) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.blocklist = m
+}
+
+// SetBlacklist replaces the blacklist matcher
+func (b *Blocker) SetBlacklist(m Matcher) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.blacklist = m
+}
+
+// SetWhitelist replaces the whitelist matcher
+func (b *Blocker) SetWhitelist(m Matcher) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.whitelist = m
+}
+
+// SetFocuslist replaces the focus list matcher
+func (b *Blocker) SetFocuslist(m Matcher) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.focuslist = m
+}
+
+// SetRanges replaces the blocked address ranges
+func (b *Blocker) SetRanges(r *ipRanges) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ranges = r
+}
+
+// SetOverrides replaces the host overrides
+func (b *Blocker) SetOverrides(o *hostOverrides) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.overrides = o
+}
+
+// SetFocus switches focus mode on or off
+func (b *Blocker) SetFocus(focus bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.focus = focus
+}
+
+// Focus returns whether focus mode is on
+func (b *Blocker) Focus() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.focus
+}
+
+// RuleCounts returns the number of loaded rules by matcher
+func (b *Blocker) RuleCounts() map[string]uint64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	counts := make(map[string]uint64)
+	for name, m := range map[string]Matcher{
+		stageBlocklist: b.blocklist,
+		stageBlacklist: b.blacklist,
+		stageWhitelist: b.whitelist,
+	} {
+		if rc, ok := m.(ruleCounter); ok {
+			counts[name] = uint64(rc.Len())
+		}
+	}
+	if b.ranges != nil {
+		counts[stageRange] = uint64(b.ranges.Len())
+	}
+	if b.overrides != nil {
+		counts[stageHosts] = uint64(b.overrides.Len())
+	}
+	return counts
+}
+
+// ActiveSchedules returns the names of the active schedules, the ones
+// of the client groups as group/schedule
+func (b *Blocker) ActiveSchedules() []string {
+	now := b.now()
+	active := policyAt(b.schedules, now).active
+	for _, g := range b.groups {
+		for _, name := range policyAt(g.Schedules, now).active {
+			active = append(active, g.Name+"/"+name)
+		}
+	}
+	return active
+}
+
+// Allow allows a host (without port) until restart
+func (b *Blocker) Allow(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.allowed[host] = true
+}
+
+// Allowed returns the hosts allowed at runtime
+func (b *Blocker) Allowed() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	hosts := []string{}
+	for host := range b.allowed {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
 // ServeHTTP implements the http.Handler interface
 func (b *Blocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	b.proxy.ServeHTTP(w, r)
 }
 
-func (b *Blocker) handleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+// stripPort removes the port from a host if it has one
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// Stages of the decision about a host.
+const (
+	stagePort      = "port"
+	stageDisabled  = "disabled"
+	stageAllowed   = "allowed"
+	stageSchedule  = "schedule"
+	stageTemporary = "temporary"
+	stageBudget    = "budget"
+	stageWhitelist = "whitelist"
+	stageFocus     = "focus"
+	stageBlocklist = "blocklist"
+	stageHosts     = "hosts"
+	stageRange     = "range"
+	stageIP        = "ip"
+	stageBlacklist = "blacklist"
+	stageDefault   = "default"
+)
+
+// Decision is the outcome of the rules for a host.
+type Decision struct {
+	Host    string `json:"host"`
+	Blocked bool   `json:"blocked"`
+	// Stage is the stage of the rules that made the decision
+	Stage string `json:"stage"`
+	// Rule is the matching rule if known
+	Rule string `json:"rule,omitempty"`
+	// Source is the blocklist source of the matching rule if known
+	Source string `json:"source,omitempty"`
+	// Overrides is the stage that would have blocked a whitelisted host
+	Overrides string `json:"overrides,omitempty"`
+	// Group is the client group the decision was made for if any
+	Group string `json:"group,omitempty"`
+	// CNAME is the CNAME target of the host that matched the rule if any
+	CNAME string `json:"cname,omitempty"`
+}
+
+// Decide decides if a host should be blocked for the clients outside
+// the client groups.
+func (b *Blocker) Decide(host string) Decision {
+	return b.DecideFor(host, client{})
+}
+
+// DecideFor decides if a host should be blocked for a client. The DNS
+// lookups of the decision are made without holding the lock.
+func (b *Blocker) DecideFor(host string, c client) Decision {
+	l := &hostLookups{}
+	for {
+		d := b.decideLocked(host, c, l)
+		if l.pending == nil {
+			return d
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+		l.pending(ctx)
+		l.pending = nil
+		cancel()
+	}
+}
+
+// decideLocked decides a host with the lookups made so far.
+func (b *Blocker) decideLocked(host string, c client, l *hostLookups) Decision {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
 	if !b.enabled {
-		//log.Printf("Host accepted (proxy disabled): %s\n", host)
-		return goproxy.OkConnect, host
+		return Decision{Host: host, Stage: stageDisabled}
 	}
-	if b.whitelist != nil && b.whitelist.Match(host) {
-		//log.Printf("Host accepted (whitelist): %s\n", host)
-		return goproxy.OkConnect, host
+	now := b.now()
+	p := policyAt(b.schedules, now)
+	g := matchGroup(b.groups, c)
+	if g != nil {
+		p = g.policyAt(now)
 	}
+	d := b.decidePolicy(host, now, p, l)
+	if g != nil {
+		d.Group = g.Name
+	}
+	return d
+}
+
+// decidePolicy decides a host under the policy of a client. The decision
+// is not final while a lookup is pending.
+func (b *Blocker) decidePolicy(host string, now time.Time, p policy, l *hostLookups) Decision {
+	if p.blockerOff != "" {
+		return Decision{Host: host, Stage: stageSchedule, Rule: p.blockerOff}
+	}
+	if b.allowed[stripPort(host)] {
+		return Decision{Host: host, Stage: stageAllowed, Rule: stripPort(host)}
+	}
+	if b.temporary != nil {
+		if r, ok := b.temporary.match(host, now); ok {
+			return Decision{Host: host, Blocked: r.Action == tempBlock, Stage: stageTemporary, Rule: r.Host}
+		}
+	}
+	if b.budgets != nil {
+		if spent, ok := b.budgets.spent(host); ok {
+			return Decision{Host: host, Blocked: true, Stage: stageBudget, Rule: spent.Rule}
+		}
+	}
+	if b.whitelist != nil {
+		if rule, source, ok := matchPolicy(b.whitelist, host, p); ok {
+			return Decision{Host: host, Stage: stageWhitelist, Rule: rule, Source: source, Overrides: b.blockingStage(host, p)}
+		}
+	}
+	if b.focus {
+		if b.focuslist != nil {
+			if rule, source, ok := matchRule(b.focuslist, host); ok {
+				return Decision{Host: host, Stage: stageFocus, Rule: rule, Source: source}
+			}
+		}
+		return Decision{Host: host, Blocked: true, Stage: stageFocus}
+	}
+	if b.blocklist != nil {
+		if rule, source, ok := matchRule(b.blocklist, host); ok {
+			return Decision{Host: host, Blocked: true, Stage: stageBlocklist, Rule: rule, Source: source}
+		}
+	}
+	if b.overrides != nil {
+		if rule, ok := b.overrides.block(host); ok {
+			return Decision{Host: host, Blocked: true, Stage: stageHosts, Rule: rule}
+		}
+	}
+	if stage, rule, ok := b.matchAddress(host, l); ok {
+		return Decision{Host: host, Blocked: true, Stage: stage, Rule: rule}
+	}
+	if b.blacklist != nil {
+		if rule, source, ok := matchPolicy(b.blacklist, host, p); ok {
+			return Decision{Host: host, Blocked: true, Stage: stageBlacklist, Rule: rule, Source: source}
+		}
+	}
+	if d, ok := b.matchCNAME(host, p, l); ok {
+		return d
+	}
+	return Decision{Host: host, Stage: stageDefault}
+}
+
+// blockingStage returns the stage of the rules that block a host or "".
+func (b *Blocker) blockingStage(host string, p policy) string {
 	if b.blocklist != nil && b.blocklist.Match(host) {
-		//log.Printf("Host rejected (blocklist): %s\n", host)
+		return stageBlocklist
+	}
+	if b.overrides != nil {
+		if _, ok := b.overrides.block(host); ok {
+			return stageHosts
+		}
+	}
+	// the whitelisted host names are not resolved
+	if stage, _, ok := b.matchAddress(host, nil); ok {
+		return stage
+	}
+	if b.blacklist != nil {
+		if _, _, ok := matchPolicy(b.blacklist, host, p); ok {
+			return stageBlacklist
+		}
+	}
+	return ""
+}
+
+// matchPolicy matches the rule sets enabled under a policy.
+func matchPolicy(m Matcher, text string, p policy) (string, string, bool) {
+	if rs, ok := m.(*ruleSetMatcher); ok {
+		return rs.matchPolicy(text, p)
+	}
+	return matchRule(m, text)
+}
+
+func (b *Blocker) handleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	var req *http.Request
+	if ctx != nil {
+		req = ctx.Req
+	}
+	c, ok := b.authorize(req)
+	if !ok {
+		if req != nil {
+			ctx.Resp = authRequired(req)
+		}
 		return goproxy.RejectConnect, host
 	}
-	if b.blacklist != nil && b.blacklist.Match(host) {
-		//log.Printf("Host rejected (blacklist): %s\n", host)
+	decision := b.decide(host, c, true)
+	if decision.Blocked {
+		//log.Printf("Host rejected (%s): %s\n", decision.Stage, host)
+		if req != nil {
+			ctx.Resp = blockResponse(req, decision)
+		}
 		return goproxy.RejectConnect, host
 	}
-	//log.Printf("Host accepted: %s\n", host)
+	//log.Printf("Host accepted (%s): %s\n", decision.Stage, host)
 	return goproxy.OkConnect, host
 }
+
+// handleRequest decides the plain HTTP requests and answers the blocked
+// ones with the block page.
+func (b *Blocker) handleRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	c, ok := b.authorize(req)
+	if !ok {
+		return req, authRequired(req)
+	}
+	if isAccessRequest(req) {
+		return req, b.serveProxiedAccess(req, c)
+	}
+	decision := b.decide(req.URL.Host, c, false)
+	if decision.Blocked {
+		return req, blockResponse(req, decision)
+	}
+	return req, nil
+}
+
+// authorize returns the client of a proxy request and whether its proxy
+// credentials are valid. The username is only trusted if checked.
+func (b *Blocker) authorize(req *http.Request) (client, bool) {
+	c := requestClient(req)
+	if b.auth == nil {
+		return c, true
+	}
+	if req == nil {
+		return c, false
+	}
+	user, ok := b.auth.check(req)
+	if !ok {
+		reason := "no credentials"
+		if user != "" {
+			reason = "invalid credentials for " + user
+		}
+		b.rejects.log("Client", reason, c.Address)
+		return c, false
+	}
+	c.User = user
+	return c, true
+}
+
+// decide decides a host for a client and publishes the decision. The
+// port of a tunnel is checked first while blocking is enabled.
+func (b *Blocker) decide(host string, c client, tunnel bool) Decision {
+	start := time.Now()
+	var decision Decision
+	if rule, ok := b.allowedPort(host, tunnel); !ok {
+		decision = Decision{Host: host, Blocked: true, Stage: stagePort, Rule: rule.String()}
+		b.rejects.log("Tunnel", "port not in "+rule.String(), host+" by "+c.Address)
+	} else {
+		decision = b.DecideFor(host, c)
+	}
+	if b.events != nil {
+		b.events.publish(event{
+			query:   newQuery(start, c.Address, decision),
+			Elapsed: time.Since(start),
+		})
+	}
+	return decision
+}
+
+// allowedPort checks the port of a tunnel against the port policy.
+func (b *Blocker) allowedPort(host string, tunnel bool) (portRule, bool) {
+	if !tunnel || b.ports == nil || !b.Enabled() {
+		return portRule{}, true
+	}
+	return b.ports.allowed(host)
+}
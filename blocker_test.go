@@ -1,7 +1,17 @@
 package main
 
 import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"gopkg.in/elazarl/goproxy.v1"
 )
@@ -18,7 +28,7 @@ func TestNewBlocker(t *testing.T) {
 
 type blocklistMatcher struct{}
 
-func (m *blocklistMatcher) Load(rules []string) {}
+func (m *blocklistMatcher) Load(rules []string) error { return nil }
 func (m *blocklistMatcher) Match(host string) bool {
 	if host == "blocklist.com" {
 		return true
@@ -28,7 +38,7 @@ func (m *blocklistMatcher) Match(host string) bool {
 
 type blacklistMatcher struct{}
 
-func (m *blacklistMatcher) Load(rules []string) {}
+func (m *blacklistMatcher) Load(rules []string) error { return nil }
 func (m *blacklistMatcher) Match(host string) bool {
 	if host == "blacklist.com" {
 		return true
@@ -38,7 +48,7 @@ func (m *blacklistMatcher) Match(host string) bool {
 
 type whitelistMatcher struct{}
 
-func (m *whitelistMatcher) Load(rules []string) {}
+func (m *whitelistMatcher) Load(rules []string) error { return nil }
 func (m *whitelistMatcher) Match(host string) bool {
 	if host == "whitelist.com" {
 		return true
@@ -123,3 +133,478 @@ func TestBlockerHandler(t *testing.T) {
 		}
 	}
 }
+
+func TestBlockerAllow(t *testing.T) {
+	blocker := NewBlocker(WithBlockerEnabled(true))
+	blocker.blacklist = &blacklistMatcher{}
+
+	blocker.Allow("blacklist.com")
+
+	resp, _ := blocker.handleConnect("blacklist.com", nil)
+	if resp != goproxy.OkConnect {
+		t.Errorf("response should be %v; got: %v", goproxy.OkConnect, resp)
+	}
+}
+
+func TestBlockerDecisionSource(t *testing.T) {
+	blocklist := &hashMatcher{}
+	blocklist.LoadSources([]blocklistSource{{URL: "https://asdf.aa", Hosts: []string{"blocklist.com"}}})
+	blocker := NewBlocker(WithBlockerEnabled(true))
+	blocker.blocklist = blocklist
+
+	decision := blocker.Decide("blocklist.com:443")
+	if !decision.Blocked || decision.Stage != stageBlocklist || decision.Source != "https://asdf.aa" {
+		t.Errorf("decision should be blocked by https://asdf.aa; got: %+v", decision)
+	}
+}
+
+func TestBlockerDecisionOverrides(t *testing.T) {
+	blocker := NewBlocker(WithBlockerEnabled(true))
+	whitelist := &regexpMatcher{}
+	whitelist.Load([]string{`^a\.com$`, `^b\.com$`})
+	blacklist := &regexpMatcher{}
+	blacklist.Load([]string{`^a\.com$`})
+	blocker.SetWhitelist(whitelist)
+	blocker.SetBlacklist(blacklist)
+
+	d := blocker.Decide("a.com")
+	if d.Blocked || d.Rule != `^a\.com$` || d.Overrides != stageBlacklist {
+		t.Errorf("a.com should be whitelisted overriding the blacklist; got: %+v", d)
+	}
+	d = blocker.Decide("b.com")
+	if d.Blocked || d.Overrides != "" {
+		t.Errorf("b.com should be whitelisted overriding nothing; got: %+v", d)
+	}
+}
+
+func TestBlockerTemporary(t *testing.T) {
+	temporary := newTempRules("")
+	defer temporary.Close()
+	blocker := NewBlocker(WithBlockerEnabled(true), WithBlockerTemporary(temporary))
+	whitelist := &listMatcher{}
+	whitelist.Load([]string{"ads.example.com"})
+	blacklist := &listMatcher{}
+	blacklist.Load([]string{"shop.com"})
+	blocker.SetWhitelist(whitelist)
+	blocker.SetBlacklist(blacklist)
+
+	expires := time.Now().Add(time.Hour)
+	temporary.add(tempRule{Host: "shop.com", Action: tempAllow, Expires: expires})
+	temporary.add(tempRule{Host: "example.com", Action: tempBlock, Expires: expires})
+
+	tt := []struct {
+		host    string
+		blocked bool
+	}{
+		{"shop.com:443", false},
+		{"pay.shop.com:443", false},
+		// temporary rules come before the whitelist
+		{"ads.example.com:443", true},
+	}
+	for _, tc := range tt {
+		d := blocker.Decide(tc.host)
+		if d.Blocked != tc.blocked || d.Stage != stageTemporary {
+			t.Errorf("%v should be blocked: %v by the temporary rules; got: %+v", tc.host, tc.blocked, d)
+		}
+	}
+}
+
+func TestBlockerSchedules(t *testing.T) {
+	off := false
+	schedules, err := parseSchedules([]schedule{
+		{Name: "work", Days: []string{"mon", "tue", "wed", "thu", "fri"}, From: "09:00", To: "17:00", Enable: []string{"social"}},
+		{Name: "weekend", Days: []string{"sun"}, Blocker: &off},
+	}, []ruleSet{{Name: "social"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	disabled := false
+	storage := &Storage{
+		ruleSets:  []ruleSet{{Name: "social", Enabled: &disabled, Block: []string{"*.social.com"}}},
+		scheduled: scheduledRuleSets(schedules),
+	}
+	blacklist, err := storage.GetBlacklist()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2021-03-05 is a Friday
+	now := time.Date(2021, 3, 5, 10, 0, 0, 0, time.UTC)
+	blocker := NewBlocker(WithBlockerEnabled(true), WithBlockerSchedules(schedules), WithBlockerClock(func() time.Time { return now }))
+	blocker.SetBlacklist(blacklist)
+
+	tt := []struct {
+		now     time.Time
+		blocked bool
+		stage   string
+	}{
+		{time.Date(2021, 3, 5, 10, 0, 0, 0, time.UTC), true, stageBlacklist},
+		{time.Date(2021, 3, 5, 18, 0, 0, 0, time.UTC), false, stageDefault},
+		{time.Date(2021, 3, 6, 10, 0, 0, 0, time.UTC), false, stageDefault},
+		{time.Date(2021, 3, 7, 10, 0, 0, 0, time.UTC), false, stageSchedule},
+	}
+	for _, tc := range tt {
+		now = tc.now
+		d := blocker.Decide("www.social.com:443")
+		if d.Blocked != tc.blocked || d.Stage != tc.stage {
+			t.Errorf("at %v should be blocked: %v by %v; got: %+v", tc.now, tc.blocked, tc.stage, d)
+		}
+	}
+	now = time.Date(2021, 3, 5, 10, 0, 0, 0, time.UTC)
+	if active := blocker.ActiveSchedules(); len(active) != 1 || active[0] != "work" {
+		t.Errorf("active schedules should be [work]; got: %v", active)
+	}
+}
+
+func TestBlockerFocus(t *testing.T) {
+	temporary := newTempRules("")
+	defer temporary.Close()
+	blocker := NewBlocker(WithBlockerEnabled(true), WithBlockerFocus(true), WithBlockerTemporary(temporary))
+	whitelist := &listMatcher{}
+	whitelist.Load([]string{"intranet.com"})
+	focuslist := &listMatcher{}
+	focuslist.Load([]string{"*.docs.com"})
+	blocker.SetWhitelist(whitelist)
+	blocker.SetFocuslist(focuslist)
+	temporary.add(tempRule{Host: "shop.com", Action: tempAllow, Expires: time.Now().Add(time.Hour)})
+
+	tt := []struct {
+		host    string
+		blocked bool
+		stage   string
+	}{
+		{"intranet.com:443", false, stageWhitelist},
+		{"api.docs.com:443", false, stageFocus},
+		{"shop.com:443", false, stageTemporary},
+		{"news.com:443", true, stageFocus},
+	}
+	for _, tc := range tt {
+		d := blocker.Decide(tc.host)
+		if d.Blocked != tc.blocked || d.Stage != tc.stage {
+			t.Errorf("%v should be blocked: %v by %v; got: %+v", tc.host, tc.blocked, tc.stage, d)
+		}
+	}
+
+	blocker.SetFocus(false)
+	if d := blocker.Decide("news.com:443"); d.Blocked {
+		t.Errorf("news.com should be allowed without focus mode; got: %+v", d)
+	}
+}
+
+func TestBlockerBlockPage(t *testing.T) {
+	blocker := NewBlocker(WithBlockerEnabled(true))
+	blocker.blacklist = &blacklistMatcher{}
+	proxy := httptest.NewServer(blocker)
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	resp, err := client.Get("http://blacklist.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(string(body), "blacklist.com is blocked") {
+		t.Errorf("plain HTTP request should get the block page; got: %v %s", resp.StatusCode, body)
+	}
+}
+
+func TestBlockerBudgets(t *testing.T) {
+	start := time.Date(2021, 3, 5, 20, 0, 0, 0, time.Local)
+	budgets, setNow := newTestBudgets(t, "", start)
+	blocker := NewBlocker(WithBlockerEnabled(true), WithBlockerBudgets(budgets))
+
+	conn := budgets.track("www.youtube.com:443", testConn())
+	defer conn.Close()
+	if d := blocker.Decide("m.youtube.com:443"); d.Blocked {
+		t.Errorf("host should be allowed within the budget; got: %+v", d)
+	}
+	setNow(start.Add(30 * time.Minute))
+	d := blocker.Decide("m.youtube.com:443")
+	if !d.Blocked || d.Stage != stageBudget || d.Rule != "*.youtube.com" {
+		t.Errorf("host should be blocked by the spent budget; got: %+v", d)
+	}
+}
+
+func TestBlockerClientGroups(t *testing.T) {
+	sets := []ruleSet{{Name: "social", Block: []string{"*.social.com"}}}
+	groups, err := parseClientGroups([]clientGroup{
+		{Name: "office", Addresses: []string{"10.0.0.0/8"}, Disable: []string{"social"}},
+	}, sets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := &Storage{ruleSets: sets, scheduled: clientRuleSets(groups)}
+	blacklist, err := storage.GetBlacklist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocker := NewBlocker(WithBlockerEnabled(true), WithBlockerGroups(groups))
+	blocker.SetBlacklist(blacklist)
+
+	tt := []struct {
+		client  client
+		blocked bool
+		group   string
+	}{
+		{client{Address: "192.168.1.20"}, true, ""},
+		{client{Address: "10.1.2.3"}, false, "office"},
+		{client{}, true, ""},
+	}
+	for _, tc := range tt {
+		d := blocker.DecideFor("www.social.com:443", tc.client)
+		if d.Blocked != tc.blocked || d.Group != tc.group {
+			t.Errorf("%+v should be blocked: %v in group %q; got: %+v", tc.client, tc.blocked, tc.group, d)
+		}
+	}
+}
+
+func TestBlockerProxyAuth(t *testing.T) {
+	hash, _ := hashPassword("secret")
+	auth, err := newProxyAuth([]proxyUser{{Name: "alice", Password: hash}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, _ := parseClientGroups([]clientGroup{{Name: "office", Users: []string{"alice"}}}, nil)
+	bus := newEventBus()
+	events, cancel := bus.subscribe(10)
+	defer cancel()
+	blocker := NewBlocker(WithBlockerEnabled(true), WithBlockerAuth(auth), WithBlockerGroups(groups), WithBlockerEvents(bus))
+	blocker.blacklist = &blacklistMatcher{}
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Errorf("proxy credentials should not be forwarded")
+		}
+	}))
+	defer target.Close()
+	proxy := httptest.NewServer(blocker)
+	defer proxy.Close()
+
+	tt := []struct {
+		user   *url.Userinfo
+		status int
+	}{
+		{nil, http.StatusProxyAuthRequired},
+		{url.UserPassword("alice", "wrong"), http.StatusProxyAuthRequired},
+		{url.UserPassword("alice", "secret"), http.StatusOK},
+	}
+	for _, tc := range tt {
+		proxyURL, _ := url.Parse(proxy.URL)
+		proxyURL.User = tc.user
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		resp, err := client.Get(target.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("status with %v should be %v; got: %v", tc.user, tc.status, resp.StatusCode)
+		}
+	}
+	select {
+	case e := <-events:
+		if e.Group != "office" {
+			t.Errorf("authenticated user should be in group office; got: %+v", e.query)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("decision should be published")
+	}
+}
+
+func TestBlockerPorts(t *testing.T) {
+	ports, err := newPortPolicy(defaultPorts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocker := NewBlocker(WithBlockerEnabled(true), WithBlockerPorts(ports))
+
+	tt := []struct {
+		host   string
+		action *goproxy.ConnectAction
+	}{
+		{"example.com:443", goproxy.OkConnect},
+		{"example.com:8443", goproxy.OkConnect},
+		{"smtp.example.com:25", goproxy.RejectConnect},
+	}
+	for _, tc := range tt {
+		req, _ := http.NewRequest(http.MethodConnect, "http://"+tc.host, nil)
+		ctx := &goproxy.ProxyCtx{Req: req}
+		if action, _ := blocker.handleConnect(tc.host, ctx); action != tc.action {
+			t.Errorf("%v should be %v; got: %v", tc.host, tc.action, action)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodConnect, "http://smtp.example.com:25", nil)
+	ctx := &goproxy.ProxyCtx{Req: req}
+	blocker.handleConnect("smtp.example.com:25", ctx)
+	body, _ := ioutil.ReadAll(ctx.Resp.Body)
+	if want := "Blocked by Lycurgus (port): smtp.example.com:25 is not in the allowed ports (443, 8443, 5228)\n"; string(body) != want {
+		t.Errorf("response should be %q; got: %q", want, body)
+	}
+	// plain HTTP requests are not restricted
+	if _, resp := blocker.handleRequest(httptest.NewRequest(http.MethodGet, "http://example.com:8080/", nil), nil); resp != nil {
+		t.Errorf("plain HTTP request should not be blocked by port; got: %v", resp.StatusCode)
+	}
+}
+
+func TestBlockerPortsDisabled(t *testing.T) {
+	ports, err := newPortPolicy(defaultPorts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocker := NewBlocker(WithBlockerEnabled(false), WithBlockerPorts(ports))
+	connect := func(host string) *goproxy.ConnectAction {
+		req, _ := http.NewRequest(http.MethodConnect, "http://"+host, nil)
+		action, _ := blocker.handleConnect(host, &goproxy.ProxyCtx{Req: req})
+		return action
+	}
+	if action := connect("ssh.example.com:22"); action != goproxy.OkConnect {
+		t.Errorf("any port should be allowed while blocking is disabled; got: %v", action)
+	}
+	blocker.SetEnabled(true)
+	if action := connect("ssh.example.com:22"); action != goproxy.RejectConnect {
+		t.Errorf("port should be checked while blocking is enabled; got: %v", action)
+	}
+
+	// no ports turn the policy off
+	ports, err = newPortPolicy([]int{}, []portRule{{Rule: "git.example.com", Ports: []int{22}}})
+	if err != nil || ports != nil {
+		t.Fatalf("policy without ports should be nil; got: %v %v", ports, err)
+	}
+	blocker = NewBlocker(WithBlockerEnabled(true), WithBlockerPorts(ports))
+	if action := connect("ssh.example.com:22"); action != goproxy.OkConnect {
+		t.Errorf("any port should be allowed without port policy; got: %v", action)
+	}
+}
+
+func TestBlockerRebinding(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	_, port, _ := net.SplitHostPort(target.Listener.Addr().String())
+	lookup := func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+	}
+	guard, err := newRebindGuard(nil, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocker := NewBlocker(WithBlockerEnabled(true), WithBlockerRebinding(guard))
+	blocker.blacklist = &blacklistMatcher{}
+	proxy := httptest.NewServer(blocker)
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	tt := []struct {
+		host   string
+		status int
+	}{
+		{"rebind.example.com", http.StatusInternalServerError},
+		// internal names are dialed as is
+		{"localhost", http.StatusOK},
+	}
+	for _, tc := range tt {
+		resp, err := client.Get("http://" + net.JoinHostPort(tc.host, port) + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("status of %v should be %v; got: %v", tc.host, tc.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestBlockerUncloak(t *testing.T) {
+	server, _ := startDNSServer(t, map[string][]dnsRecord{
+		"metrics.shop.com": {{Type: dnsTypeCNAME, TTL: 300, Target: "shop.tracker.com"}},
+		"stats.news.com":   {{Type: dnsTypeCNAME, TTL: 300, Target: "news.analytics.net"}},
+		"www.shop.com":     {{Type: dnsTypeCNAME, TTL: 300, Target: "shop.cdn.net"}},
+	})
+	blocklist := &hashMatcher{}
+	blocklist.LoadSources([]blocklistSource{{URL: "https://asdf.aa", Hosts: []string{"shop.tracker.com"}}})
+	blacklist := &regexpMatcher{}
+	blacklist.Load([]string{`analytics\.net$`})
+	blocker := NewBlocker(WithBlockerEnabled(true), WithBlockerUncloak(newUncloaker(plainDNS{server: server})))
+	blocker.blocklist = blocklist
+	blocker.SetBlacklist(blacklist)
+
+	tt := []struct {
+		host    string
+		blocked bool
+		stage   string
+		cname   string
+	}{
+		{"metrics.shop.com:443", true, stageBlocklist, "shop.tracker.com"},
+		{"stats.news.com:443", true, stageBlacklist, "news.analytics.net"},
+		{"www.shop.com:443", false, stageDefault, ""},
+		{"other.com:443", false, stageDefault, ""},
+	}
+	for _, tc := range tt {
+		d := blocker.Decide(tc.host)
+		if d.Blocked != tc.blocked || d.Stage != tc.stage || d.CNAME != tc.cname {
+			t.Errorf("decision of %v should be %v by %v via %q; got: %+v", tc.host, tc.blocked, tc.stage, tc.cname, d)
+		}
+	}
+	if d := blocker.Decide("metrics.shop.com:443"); d.Source != "https://asdf.aa" {
+		t.Errorf("source should be https://asdf.aa; got: %+v", d)
+	}
+}
+
+func TestBlockerResolver(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	_, port, _ := net.SplitHostPort(target.Listener.Addr().String())
+	server, _ := startDNSServer(t, map[string][]dnsRecord{
+		"staging.example.com": {{Type: dnsTypeA, TTL: 60, IP: net.ParseIP("127.0.0.1")}},
+	})
+	blocker := NewBlocker(WithBlockerEnabled(true), WithBlockerResolver(newResolver(plainDNS{server: server})))
+	blocker.blacklist = &blacklistMatcher{}
+	proxy := httptest.NewServer(blocker)
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	tt := []struct {
+		host   string
+		status int
+	}{
+		{"staging.example.com", http.StatusOK},
+		{"missing.example.com", http.StatusInternalServerError},
+	}
+	for _, tc := range tt {
+		resp, err := client.Get("http://" + net.JoinHostPort(tc.host, port) + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("status of %v should be %v; got: %v", tc.host, tc.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestEnvProxies(t *testing.T) {
+	env := map[string]string{
+		"HTTP_PROXY":  "proxy.lan:3128",
+		"http_proxy":  "",
+		"HTTPS_PROXY": "https://secure.lan",
+		"https_proxy": "",
+	}
+	for name, value := range env {
+		old, ok := os.LookupEnv(name)
+		os.Setenv(name, value)
+		defer func(name, old string, ok bool) {
+			if ok {
+				os.Setenv(name, old)
+			} else {
+				os.Unsetenv(name)
+			}
+		}(name, old, ok)
+	}
+	want := map[string]bool{"proxy.lan:3128": true, "secure.lan:443": true}
+	if got := envProxies(); !reflect.DeepEqual(got, want) {
+		t.Errorf("proxies should be %v; got: %v", want, got)
+	}
+}
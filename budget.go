@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// budgetRetention is how long the daily usage of the budgets is kept.
+const budgetRetention = 30 * 24 * time.Hour
+
+// budget limits the daily time of the tunnels to the hosts of a rule.
+type budget struct {
+	Rule  string        `yaml:"rule"`
+	Limit time.Duration `yaml:"limit"`
+}
+
+func (b budget) String() string {
+	return fmt.Sprintf("%s %v", b.Rule, b.Limit)
+}
+
+// budgetStatus is the usage of a budget today.
+type budgetStatus struct {
+	Rule string `json:"rule"`
+	// Limit, Used and Remaining are in seconds
+	Limit     int64 `json:"limit"`
+	Used      int64 `json:"used"`
+	Remaining int64 `json:"remaining"`
+}
+
+func (s budgetStatus) String() string {
+	return fmt.Sprintf("%s %v of %v left", s.Rule, time.Duration(s.Remaining)*time.Second, time.Duration(s.Limit)*time.Second)
+}
+
+// budgets track how long the tunnels to the hosts of each budget are
+// open and persist the usage by day. Parallel tunnels of a budget count
+// once, so the usage is the time any of them is open.
+type budgets struct {
+	mu       sync.Mutex
+	path     string
+	budgets  []budget
+	matchers []*listMatcher
+	// open is the number of open tunnels of each budget and since is
+	// the time the usage of the open tunnels was last added
+	open  []int
+	since []time.Time
+	// usage maps the days (2006-01-02) to the usage by budget rule
+	usage map[string]map[string]time.Duration
+	// spentDay is the last day each budget was reported spent
+	spentDay []string
+	// now returns the current local time
+	now func() time.Time
+
+	stop func()
+}
+
+// newBudgets creates the budgets persisted in path. Empty path keeps
+// the usage in memory.
+func newBudgets(configs []budget, path string) (*budgets, error) {
+	b := &budgets{
+		path:     path,
+		budgets:  configs,
+		open:     make([]int, len(configs)),
+		since:    make([]time.Time, len(configs)),
+		spentDay: make([]string, len(configs)),
+		usage:    make(map[string]map[string]time.Duration),
+		now:      time.Now,
+	}
+	for _, c := range configs {
+		if c.Limit <= 0 {
+			return nil, fmt.Errorf("budget %s: limit must be positive", c.Rule)
+		}
+		m := &listMatcher{}
+		if err := m.Load([]string{c.Rule}); err != nil {
+			return nil, fmt.Errorf("budget %s: %v", c.Rule, err)
+		}
+		b.matchers = append(b.matchers, m)
+	}
+	return b, nil
+}
+
+func dayKey(t time.Time) string {
+	return t.Format("2006-01-02")
+}
+
+// match returns the index of the first budget of a host or -1.
+func (b *budgets) match(host string) int {
+	for i, m := range b.matchers {
+		if m.Match(host) {
+			return i
+		}
+	}
+	return -1
+}
+
+// spent returns the budget of a host if it is used up today.
+func (b *budgets) spent(host string) (budget, bool) {
+	i := b.match(host)
+	if i < 0 {
+		return budget{}, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if b.used(i, now) < b.budgets[i].Limit {
+		return budget{}, false
+	}
+	if day := dayKey(now); b.spentDay[i] != day {
+		b.spentDay[i] = day
+		log.Println("Budget spent: ", b.budgets[i])
+	}
+	return b.budgets[i], true
+}
+
+// used returns the usage of a budget on the day of now.
+func (b *budgets) used(i int, now time.Time) time.Duration {
+	used := b.usage[dayKey(now)][b.budgets[i].Rule]
+	if b.open[i] > 0 {
+		since := b.since[i]
+		if start := dayStart(now); since.Before(start) {
+			since = start
+		}
+		used += now.Sub(since)
+	}
+	return used
+}
+
+// flush adds the usage of the open tunnels of a budget until now,
+// split by day.
+func (b *budgets) flush(i int, now time.Time) {
+	rule := b.budgets[i].Rule
+	for since := b.since[i]; since.Before(now); {
+		end := dayStart(since).AddDate(0, 0, 1)
+		if end.After(now) {
+			end = now
+		}
+		day := dayKey(since)
+		if b.usage[day] == nil {
+			b.usage[day] = make(map[string]time.Duration)
+		}
+		b.usage[day][rule] += end.Sub(since)
+		since = end
+	}
+	b.since[i] = now
+}
+
+// track counts the time a tunnel to a host is open in its budget.
+func (b *budgets) track(host string, conn net.Conn) net.Conn {
+	i := b.match(host)
+	if i < 0 {
+		return conn
+	}
+	b.mu.Lock()
+	now := b.now()
+	if b.open[i] > 0 {
+		b.flush(i, now)
+	} else {
+		b.since[i] = now
+	}
+	b.open[i]++
+	b.mu.Unlock()
+
+	return &budgetConn{Conn: conn, onClose: func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.flush(i, b.now())
+		b.open[i]--
+	}}
+}
+
+// list returns the usage of the budgets today.
+func (b *budgets) list() []budgetStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	statuses := []budgetStatus{}
+	for i, c := range b.budgets {
+		used := b.used(i, now)
+		remaining := c.Limit - used
+		if remaining < 0 {
+			remaining = 0
+		}
+		statuses = append(statuses, budgetStatus{
+			Rule:      c.Rule,
+			Limit:     int64(c.Limit / time.Second),
+			Used:      int64(used / time.Second),
+			Remaining: int64(remaining / time.Second),
+		})
+	}
+	return statuses
+}
+
+// budgetConn calls onClose once when the connection is closed.
+type budgetConn struct {
+	net.Conn
+	onClose   func()
+	closeOnce sync.Once
+}
+
+func (c *budgetConn) Close() error {
+	c.closeOnce.Do(c.onClose)
+	return c.Conn.Close()
+}
+
+type budgetsState struct {
+	// Days maps the days to the usage in seconds by budget rule
+	Days map[string]map[string]int64 `json:"days"`
+}
+
+// prune drops the usage older than budgetRetention.
+func (b *budgets) prune(now time.Time) {
+	oldest := dayKey(now.Add(-budgetRetention))
+	for day := range b.usage {
+		if day < oldest {
+			delete(b.usage, day)
+		}
+	}
+}
+
+// load reads the persisted usage.
+func (b *budgets) load() error {
+	if b.path == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(b.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var state budgetsState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for day, rules := range state.Days {
+		b.usage[day] = make(map[string]time.Duration)
+		for rule, seconds := range rules {
+			b.usage[day][rule] = time.Duration(seconds) * time.Second
+		}
+	}
+	b.prune(b.now())
+	return nil
+}
+
+// save persists the usage, including the open tunnels.
+func (b *budgets) save() error {
+	if b.path == "" {
+		return nil
+	}
+	b.mu.Lock()
+	now := b.now()
+	for i := range b.budgets {
+		if b.open[i] > 0 {
+			b.flush(i, now)
+		}
+	}
+	b.prune(now)
+	state := budgetsState{Days: make(map[string]map[string]int64)}
+	for day, rules := range b.usage {
+		state.Days[day] = make(map[string]int64)
+		for rule, used := range rules {
+			state.Days[day][rule] = int64(used / time.Second)
+		}
+	}
+	content, err := json.MarshalIndent(state, "", "  ")
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := createDir(filepath.Dir(b.path)); err != nil {
+		return err
+	}
+	return writeFileAtomic(b.path, content)
+}
+
+// autosave persists the usage periodically until Close.
+func (b *budgets) autosave(interval time.Duration) {
+	b.stop = saveEvery(interval, "budgets", b.save)
+}
+
+// Close stops saving periodically and persists the usage.
+func (b *budgets) Close() error {
+	if b.stop != nil {
+		b.stop()
+		b.stop = nil
+	}
+	return b.save()
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewBudgets(t *testing.T) {
+	tt := []struct {
+		budget budget
+		valid  bool
+	}{
+		{budget{Rule: "*.youtube.com", Limit: 30 * time.Minute}, true},
+		{budget{Rule: "*.youtube.com"}, false},
+		{budget{Rule: "/(/", Limit: time.Minute}, false},
+	}
+	for _, tc := range tt {
+		_, err := newBudgets([]budget{tc.budget}, "")
+		if (err == nil) != tc.valid {
+			t.Errorf("budget %v should be valid: %v; got: %v", tc.budget, tc.valid, err)
+		}
+	}
+}
+
+// newTestBudgets returns budgets with a clock set by the returned function.
+func newTestBudgets(t *testing.T, path string, now time.Time) (*budgets, func(time.Time)) {
+	b, err := newBudgets([]budget{{Rule: "*.youtube.com", Limit: 30 * time.Minute}}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.now = func() time.Time { return now }
+	return b, func(t time.Time) { now = t }
+}
+
+func testConn() net.Conn {
+	conn, _ := net.Pipe()
+	return conn
+}
+
+func TestBudgetsTracking(t *testing.T) {
+	start := time.Date(2021, 3, 5, 20, 0, 0, 0, time.Local)
+	b, setNow := newTestBudgets(t, "", start)
+
+	if conn := testConn(); b.track("example.com:443", conn) != conn {
+		t.Errorf("tunnels without budget should not be tracked")
+	}
+
+	// parallel tunnels count once
+	first := b.track("www.youtube.com:443", testConn())
+	setNow(start.Add(10 * time.Minute))
+	second := b.track("m.youtube.com:443", testConn())
+	setNow(start.Add(20 * time.Minute))
+	first.Close()
+	first.Close()
+	setNow(start.Add(25 * time.Minute))
+	second.Close()
+	setNow(start.Add(time.Hour))
+
+	status := b.list()
+	if len(status) != 1 || status[0].Used != 25*60 || status[0].Remaining != 5*60 {
+		t.Errorf("usage should be 25m with 5m left; got: %+v", status)
+	}
+	if _, ok := b.spent("www.youtube.com:443"); ok {
+		t.Errorf("budget should not be spent yet")
+	}
+
+	conn := b.track("www.youtube.com:443", testConn())
+	setNow(start.Add(time.Hour + 5*time.Minute))
+	if spent, ok := b.spent("www.youtube.com:443"); !ok || spent.Rule != "*.youtube.com" {
+		t.Errorf("budget should be spent by the open tunnel; got: %v %v", spent, ok)
+	}
+
+	// the usage of a tunnel open at midnight is split by day
+	setNow(time.Date(2021, 3, 6, 0, 10, 0, 0, time.Local))
+	if _, ok := b.spent("www.youtube.com:443"); ok {
+		t.Errorf("budget should be reset on the next day")
+	}
+	conn.Close()
+	if used := b.usage["2021-03-06"]["*.youtube.com"]; used != 10*time.Minute {
+		t.Errorf("usage of the next day should be 10m; got: %v", used)
+	}
+	if used := b.usage["2021-03-05"]["*.youtube.com"]; used != 3*time.Hour+25*time.Minute {
+		t.Errorf("usage of the first day should be 3h25m; got: %v", used)
+	}
+}
+
+func TestBudgetsPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lycurgus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "budgets.json")
+
+	now := time.Date(2021, 3, 5, 20, 0, 0, 0, time.Local)
+	b, setNow := newTestBudgets(t, path, now)
+	conn := b.track("www.youtube.com:443", testConn())
+	setNow(now.Add(12 * time.Minute))
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	loaded, _ := newTestBudgets(t, path, now.Add(time.Hour))
+	if err := loaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	if status := loaded.list(); status[0].Used != 12*60 {
+		t.Errorf("loaded usage should be 12m; got: %+v", status)
+	}
+
+	old, _ := newTestBudgets(t, path, now.Add(budgetRetention+48*time.Hour))
+	if err := old.load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(old.usage) != 0 {
+		t.Errorf("usage older than the retention should be dropped; got: %v", old.usage)
+	}
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const defaultCommand = "run"
+
+// command is a subcommand of the application.
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(config *Config, args []string) error
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"run", "run", "run the blocker (default)", runCommand},
+		{"update", "update", "refresh the blocklist cache and exit", updateCommand},
+		{"lists", "lists", "show the blocklist sources with status, host count and age", listsCommand},
+		{"export", "export [hosts|dnsmasq|unbound|domains] [file]", "write the merged blocklist rules", exportCommand},
+		{"config", "config", "print the effective config and where each value came from", configCommand},
+		{"ctl", "ctl status|enable|disable|reload|pause <duration>|pause restart|focus on|focus off|allow <host> [duration]|block <host> <duration>|remove <host>", "control a running instance", ctlCommand},
+		{"log", "log [client=|decision=|since=|limit=<value>...] [search]", "search the query log of a running instance", logCommand},
+		{"tail", "tail [client=|decision=<value>...] [search]", "watch the decisions of a running instance as they happen", tailCommand},
+		{"stats", "stats [hourly|daily] [since=|top=|format=<value>...]", "show the request statistics (format: table, csv or json)", statsCommand},
+		{"rules", "rules [hits|dead [days]|redundant]", "show the rule hit counters, the rules without hits for days (default 30) or the redundant whitelist rules", rulesCommand},
+		{"hash", "hash", "hash a password read from stdin for the proxy users", hashCommand},
+		{"help", "help", "show this help", helpCommand},
+	}
+}
+
+// splitCommand extracts the subcommand from the command line arguments.
+// The returned arguments can be parsed as flags of the subcommand.
+func splitCommand(args []string) (string, []string) {
+	if len(args) < 2 || strings.HasPrefix(args[1], "-") {
+		return defaultCommand, args
+	}
+	rest := append([]string{args[0] + " " + args[1]}, args[2:]...)
+	return args[1], rest
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s [command] [flags] [arguments]\n\nCommands:\n", appName)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", cmd.usage, cmd.summary)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nRun '%s <command> -h' to list the flags.\n", appName)
+}
+
+func helpCommand(config *Config, args []string) error {
+	printUsage(os.Stdout)
+	return nil
+}
+
+func newStorage(config *Config) *Storage {
+	return &Storage{
+		blocklistPath:  config.BlocklistPath,
+		blacklistPath:  config.BlacklistPath,
+		whitelistPath:  config.WhitelistPath,
+		focuslistPath:  config.FocuslistPath,
+		rangesPath:     config.RangesPath,
+		hostsPath:      config.HostsPath,
+		updateInterval: config.UpdateInterval,
+		allowRules:     config.Allow,
+		blockRules:     config.Block,
+		hosts:          config.Hosts,
+		ruleSets:       config.RuleSets,
+		scheduled:      controlledRuleSets(config),
+	}
+}
+
+// controlledRuleSets returns the names of the rule sets turned on or off
+// by the schedules or the client groups.
+func controlledRuleSets(config *Config) map[string]bool {
+	names := scheduledRuleSets(config.Schedules)
+	for name := range clientRuleSets(config.Clients) {
+		names[name] = true
+	}
+	return names
+}
+
+func updateCommand(config *Config, args []string) error {
+	storage := newStorage(config)
+	rules, err := storage.GetBlocklistRules(false)
+	if err != nil {
+		return err
+	}
+	sources, err := storage.GetSources()
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, source := range sources {
+		if source.Error != "" {
+			failed++
+		}
+	}
+	fmt.Printf("Blocklist updated: %d hosts from %d sources (%d failed)\n",
+		len(rules), len(sources)-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d blocklist sources failed", failed, len(sources))
+	}
+	return nil
+}
+
+func listsCommand(config *Config, args []string) error {
+	sources, err := newStorage(config).GetSources()
+	if err != nil {
+		return err
+	}
+	return writeSources(os.Stdout, sources, time.Now())
+}
+
+// writeSources writes the blocklist sources as a table.
+func writeSources(w io.Writer, sources []sourceStatus, now time.Time) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tHOSTS\tAGE\tSOURCE")
+	for _, source := range sources {
+		status := "ok"
+		if source.LastAttempt.IsZero() {
+			status = "never fetched"
+		} else if source.Error != "" {
+			status = "error: " + source.Error
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", status, source.Hosts, formatAge(source.LastUpdate, now), source.URL)
+	}
+	return tw.Flush()
+}
+
+// formatAge returns the time elapsed since t rounded to minutes.
+func formatAge(t, now time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return now.Sub(t).Round(time.Minute).String()
+}
+
+// exportFormats are the line formats of the supported export formats.
+var exportFormats = map[string]string{
+	"hosts":   "0.0.0.0 %s\n",
+	"dnsmasq": "address=/%s/0.0.0.0\n",
+	"unbound": "local-zone: \"%s\" always_nxdomain\n",
+	"domains": "%s\n",
+}
+
+func exportCommand(config *Config, args []string) error {
+	format := "hosts"
+	if len(args) > 0 {
+		format = args[0]
+	}
+	if _, ok := exportFormats[format]; !ok {
+		return fmt.Errorf("unknown export format: %s", format)
+	}
+
+	storage := newStorage(config)
+	rules, err := storage.GetBlocklistRules(true)
+	if err != nil {
+		return err
+	}
+	if rules == nil {
+		return errors.New("cannot read blocklists")
+	}
+	whitelist, err := storage.GetWhitelist()
+	if errs, ok := err.(ruleErrors); ok {
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, "Skipping", e)
+		}
+	} else if err != nil {
+		return err
+	}
+
+	w := os.Stdout
+	if len(args) > 1 {
+		file, err := os.Create(args[1])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	return writeExport(w, format, rules, whitelist)
+}
+
+// writeExport writes the deduplicated and sorted rules in the given format
+// skipping the hosts matched by the whitelist.
+func writeExport(w io.Writer, format string, rules []string, whitelist Matcher) error {
+	seen := make(map[string]bool)
+	hosts := []string{}
+	for _, rule := range rules {
+		if seen[rule] {
+			continue
+		}
+		seen[rule] = true
+		if whitelist != nil && whitelist.Match(rule) {
+			continue
+		}
+		hosts = append(hosts, rule)
+	}
+	sort.Strings(hosts)
+
+	for _, host := range hosts {
+		if _, err := fmt.Fprintf(w, exportFormats[format], host); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func configCommand(config *Config, args []string) error {
+	status := "found"
+	if _, err := os.Stat(configFile()); err != nil {
+		status = "not found"
+	}
+	fmt.Printf("Config file: %s (%s)\n\n", configFile(), status)
+	return config.Describe(os.Stdout)
+}
+
+func hashCommand(config *Config, args []string) error {
+	return writeHash(os.Stdin, os.Stdout)
+}
+
+// writeHash writes the hash of the password on the first line of r.
+func writeHash(r io.Reader, w io.Writer) error {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return errors.New("missing password")
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, hash)
+	return err
+}
+
+func ctlCommand(config *Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New("missing control command, see 'help'")
+	}
+	if config.ControlAddress == "" {
+		return errors.New("control socket is disabled")
+	}
+	client := newControlClient(config.ControlAddress)
+
+	var err error
+	switch args[0] {
+	case "status":
+		status, err := client.Status()
+		if err != nil {
+			return err
+		}
+		return writeStatus(os.Stdout, status, time.Now())
+	case "enable", "disable", "reload":
+		err = client.Post("/"+args[0], nil)
+	case "pause":
+		if len(args) < 2 {
+			return errors.New("missing pause duration")
+		}
+		err = client.Post("/pause", url.Values{"duration": {args[1]}})
+	case "focus":
+		if len(args) < 2 || (args[1] != "on" && args[1] != "off") {
+			return errors.New("focus should be on or off")
+		}
+		err = client.Post("/focus", url.Values{"enabled": {strconv.FormatBool(args[1] == "on")}})
+	case "allow":
+		if len(args) < 2 {
+			return errors.New("missing host to allow")
+		}
+		params := url.Values{"host": {args[1]}}
+		if len(args) > 2 {
+			params.Set("duration", args[2])
+		}
+		err = client.Post("/allow", params)
+	case "block":
+		if len(args) < 3 {
+			return errors.New("missing host or duration to block")
+		}
+		err = client.Post("/block", url.Values{"host": {args[1]}, "duration": {args[2]}})
+	case "remove":
+		if len(args) < 2 {
+			return errors.New("missing host to remove")
+		}
+		err = client.Post("/remove", url.Values{"host": {args[1]}})
+	default:
+		return fmt.Errorf("unknown control command: %s", args[0])
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println("OK")
+	return nil
+}
+
+// writeStatus writes the runtime state of a running instance.
+func writeStatus(w io.Writer, status *Status, now time.Time) error {
+	state := "disabled"
+	if status.Enabled {
+		state = "enabled"
+	} else if status.PausedUntil != nil {
+		state = fmt.Sprintf("paused (%s left)", status.PausedUntil.Sub(now).Round(time.Second))
+	} else if status.Paused {
+		state = "paused until restart"
+	}
+	allowed := "-"
+	if len(status.Allowed) > 0 {
+		allowed = strings.Join(status.Allowed, ", ")
+	}
+	if _, err := fmt.Fprintf(w, "Blocking: %s\nAllowed:  %s\n", state, allowed); err != nil {
+		return err
+	}
+	if status.Focus {
+		if _, err := fmt.Fprintln(w, "Focus:    on"); err != nil {
+			return err
+		}
+	}
+	for _, r := range status.AccessRequests {
+		if _, err := fmt.Fprintf(w, "Request:  %s\n", r); err != nil {
+			return err
+		}
+	}
+	for _, b := range status.Budgets {
+		if _, err := fmt.Fprintf(w, "Budget:   %s\n", b); err != nil {
+			return err
+		}
+	}
+	if len(status.Schedules) > 0 {
+		if _, err := fmt.Fprintf(w, "Schedules: %s\n", strings.Join(status.Schedules, ", ")); err != nil {
+			return err
+		}
+	}
+	for _, r := range status.Temporary {
+		left := r.Expires.Sub(now).Round(time.Second)
+		if _, err := fmt.Fprintf(w, "Temporary: %s %s (%s left)\n", r.Action, r.Host, left); err != nil {
+			return err
+		}
+	}
+	for _, e := range status.InvalidRules {
+		if _, err := fmt.Fprintf(w, "Invalid:  %s\n", e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryParams are the filter parameters of the log command.
+var queryParams = map[string]bool{"client": true, "decision": true, "since": true, "limit": true}
+
+// parseParams reads the key=value arguments of the known keys.
+// It returns the remaining arguments.
+func parseParams(args []string, keys map[string]bool) (url.Values, []string) {
+	params := url.Values{}
+	rest := []string{}
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) == 2 && keys[parts[0]] {
+			params.Set(parts[0], parts[1])
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	return params, rest
+}
+
+// parseLogArgs reads the filter parameters of the log command. Arguments
+// that are not key=value pairs of a filter parameter are searched for.
+func parseLogArgs(args []string) url.Values {
+	params, search := parseParams(args, queryParams)
+	if len(search) > 0 {
+		params.Set("search", strings.Join(search, " "))
+	}
+	return params
+}
+
+func logCommand(config *Config, args []string) error {
+	if config.ControlAddress == "" {
+		return errors.New("control socket is disabled")
+	}
+	queries, err := newControlClient(config.ControlAddress).Queries(parseLogArgs(args))
+	if err != nil {
+		return err
+	}
+	return writeQueries(os.Stdout, queries)
+}
+
+func tailCommand(config *Config, args []string) error {
+	if config.ControlAddress == "" {
+		return errors.New("control socket is disabled")
+	}
+	return newControlClient(config.ControlAddress).Events(parseLogArgs(args), func(q query) error {
+		_, err := fmt.Println(formatQuery(q))
+		return err
+	})
+}
+
+// writeQueries writes queries as a table.
+func writeQueries(w io.Writer, queries []query) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tCLIENT\tDECISION\tSTAGE\tHOST\tRULE\tSOURCE")
+	for _, q := range queries {
+		fmt.Fprintln(tw, strings.Join(queryFields(q), "\t"))
+	}
+	return tw.Flush()
+}
+
+// formatQuery formats a query as a single line.
+func formatQuery(q query) string {
+	return strings.Join(queryFields(q), " ")
+}
+
+func queryFields(q query) []string {
+	host := q.Host
+	if q.Port != "" {
+		host = net.JoinHostPort(q.Host, q.Port)
+	}
+	return []string{q.Time.Format("2006-01-02 15:04:05"), orDash(q.Client), decisionLabel(q.Blocked),
+		q.Stage, host, orDash(q.Rule), orDash(q.Source)}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// statsParams are the parameters of the stats command.
+var statsParams = map[string]bool{"since": true, "top": true, "format": true}
+
+func statsCommand(config *Config, args []string) error {
+	params, rest := parseParams(args, statsParams)
+	if len(rest) > 0 {
+		params.Set("period", rest[0])
+	}
+	format := params.Get("format")
+	if format == "table" {
+		params.Del("format")
+	}
+	req, err := parseStatsRequest(params, time.Now())
+	if err != nil {
+		return err
+	}
+
+	// a running instance saves its statistics every minute
+	s := newStats(statsFile())
+	if err := s.load(); err != nil {
+		return err
+	}
+	report, err := s.report(req.Period, req.Since, req.Top)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "csv":
+		return writeStatsCSV(os.Stdout, report)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	return writeStatsReport(os.Stdout, report)
+}
+
+// writeStatsReport writes a statistics report as tables.
+func writeStatsReport(w io.Writer, r statsReport) error {
+	layout := "2006-01-02"
+	if r.Period == periodHourly {
+		layout = "2006-01-02 15:04"
+	}
+	fmt.Fprintf(w, "Since %s: %d allowed, %d blocked\n\n", r.Since.Format(layout), r.Allowed, r.Blocked)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "START\tALLOWED\tBLOCKED")
+	for _, b := range r.Buckets {
+		fmt.Fprintf(tw, "%s\t%d\t%d\n", b.Start.Format(layout), b.Allowed, b.Blocked)
+	}
+	fmt.Fprintln(tw, "\nTOP BLOCKED\tREQUESTS")
+	for _, h := range r.TopBlocked {
+		fmt.Fprintf(tw, "%s\t%d\n", h.Host, h.Count)
+	}
+	fmt.Fprintln(tw, "\nTOP ALLOWED\tREQUESTS")
+	for _, h := range r.TopAllowed {
+		fmt.Fprintf(tw, "%s\t%d\n", h.Host, h.Count)
+	}
+	fmt.Fprintln(tw, "\nSOURCE\tBLOCKED")
+	for _, source := range r.Sources {
+		fmt.Fprintf(tw, "%s\t%d\n", source.Source, source.Count)
+	}
+	return tw.Flush()
+}
+
+func rulesCommand(config *Config, args []string) error {
+	report := "hits"
+	if len(args) > 0 {
+		report = args[0]
+	}
+
+	// a running instance saves its rule hits every minute
+	storage := newStorage(config)
+	hits := newRuleHits(ruleHitsFile())
+	if err := hits.load(); err != nil {
+		return err
+	}
+	now := time.Now()
+
+	var usage []ruleUsage
+	var err error
+	switch report {
+	case "hits":
+		usage, err = listUsage(storage, hits, ruleLists, now)
+	case "dead":
+		days := defaultDeadRuleDays
+		if len(args) > 1 {
+			if days, err = strconv.Atoi(args[1]); err != nil || days < 0 {
+				return fmt.Errorf("invalid days: %s", args[1])
+			}
+		}
+		usage, err = listUsage(storage, hits, ruleLists, now)
+		usage = deadRules(usage, time.Duration(days)*24*time.Hour, now)
+	case "redundant":
+		usage, err = redundantWhitelist(storage, hits, now)
+	default:
+		return fmt.Errorf("unknown rules report: %s", report)
+	}
+	if err != nil {
+		return err
+	}
+	return writeRuleUsage(os.Stdout, usage, now)
+}
+
+// writeRuleUsage writes the usage of rules as a table.
+func writeRuleUsage(w io.Writer, usage []ruleUsage, now time.Time) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "LIST\tHITS\tLAST HIT\tRULE")
+	for _, u := range usage {
+		lastHit := "never"
+		if !u.LastHit.IsZero() {
+			lastHit = formatAge(u.LastHit, now) + " ago"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", u.List, u.Hits, lastHit, u.Rule)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tt := []struct {
+		args        []string
+		expectedCmd string
+		expected    []string
+	}{
+		{[]string{"lycurgus"}, "run", []string{"lycurgus"}},
+		{[]string{"lycurgus", "--gui=false"}, "run", []string{"lycurgus", "--gui=false"}},
+		{[]string{"lycurgus", "update"}, "update", []string{"lycurgus update"}},
+		{[]string{"lycurgus", "export", "--blocklist=b", "dnsmasq"}, "export", []string{"lycurgus export", "--blocklist=b", "dnsmasq"}},
+	}
+
+	for _, tc := range tt {
+		cmd, args := splitCommand(tc.args)
+		if cmd != tc.expectedCmd {
+			t.Errorf("command should be %v; got: %v", tc.expectedCmd, cmd)
+		}
+		if strings.Join(args, ",") != strings.Join(tc.expected, ",") {
+			t.Errorf("args should be %v; got: %v", tc.expected, args)
+		}
+	}
+}
+
+func TestFindCommand(t *testing.T) {
+	for _, name := range []string{"run", "update", "lists", "export", "config"} {
+		if findCommand(name) == nil {
+			t.Errorf("command %v should exist", name)
+		}
+	}
+	if findCommand("nothing") != nil {
+		t.Errorf("command nothing should not exist")
+	}
+}
+
+func TestWriteExport(t *testing.T) {
+	rules := []string{"b.com", "a.com", "b.com", "whitelist.com"}
+
+	tt := []struct {
+		format   string
+		expected string
+	}{
+		{"hosts", "0.0.0.0 a.com\n0.0.0.0 b.com\n"},
+		{"dnsmasq", "address=/a.com/0.0.0.0\naddress=/b.com/0.0.0.0\n"},
+		{"unbound", "local-zone: \"a.com\" always_nxdomain\nlocal-zone: \"b.com\" always_nxdomain\n"},
+		{"domains", "a.com\nb.com\n"},
+	}
+
+	for _, tc := range tt {
+		buf := &bytes.Buffer{}
+		if err := writeExport(buf, tc.format, rules, &whitelistMatcher{}); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tc.expected {
+			t.Errorf("%v export should be: %q; got: %q", tc.format, tc.expected, buf.String())
+		}
+	}
+}
+
+func TestWriteSources(t *testing.T) {
+	now := time.Date(2020, 12, 10, 12, 0, 0, 0, time.UTC)
+	sources := []sourceStatus{
+		{URL: "https://ok.aa", Hosts: 10, LastUpdate: now.Add(-time.Hour), LastAttempt: now.Add(-time.Hour)},
+		{URL: "https://err.aa", Hosts: 5, LastUpdate: now.Add(-2 * time.Hour), LastAttempt: now.Add(-time.Hour), Error: "timeout"},
+		{URL: "https://new.aa"},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := writeSources(buf, sources, now); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("output should have 4 lines; got: %v", len(lines))
+	}
+	expected := [][]string{
+		{"ok", "10", "1h0m0s", "https://ok.aa"},
+		{"error: timeout", "5", "2h0m0s", "https://err.aa"},
+		{"never fetched", "0", "-", "https://new.aa"},
+	}
+	for i, fields := range expected {
+		for _, field := range fields {
+			if !strings.Contains(lines[i+1], field) {
+				t.Errorf("line %q should contain %q", lines[i+1], field)
+			}
+		}
+	}
+}
+
+func TestParseLogArgs(t *testing.T) {
+	tt := []struct {
+		args     []string
+		expected url.Values
+	}{
+		{nil, url.Values{}},
+		{[]string{"example"}, url.Values{"search": {"example"}}},
+		{[]string{"decision=blocked", "since=1h", "a=b"}, url.Values{"decision": {"blocked"}, "since": {"1h"}, "search": {"a=b"}}},
+	}
+
+	for _, tc := range tt {
+		if params := parseLogArgs(tc.args); !reflect.DeepEqual(params, tc.expected) {
+			t.Errorf("params should be %v; got: %v", tc.expected, params)
+		}
+	}
+}
+
+func TestWriteQueries(t *testing.T) {
+	queries := []query{
+		{Time: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), Client: "127.0.0.1", Host: "a.com", Port: "443",
+			Blocked: true, Stage: stageBlocklist, Rule: "a.com", Source: "https://list"},
+	}
+	buf := &bytes.Buffer{}
+	if err := writeQueries(buf, queries); err != nil {
+		t.Fatal(err)
+	}
+	expected := "TIME                 CLIENT     DECISION  STAGE      HOST       RULE   SOURCE\n" +
+		"2020-01-02 03:04:05  127.0.0.1  blocked   blocklist  a.com:443  a.com  https://list\n"
+	if buf.String() != expected {
+		t.Errorf("output should be %q; got: %q", expected, buf.String())
+	}
+}
+
+func TestWriteHash(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := writeHash(strings.NewReader("secret\n"), buf); err != nil {
+		t.Fatal(err)
+	}
+	if hash := strings.TrimSpace(buf.String()); !checkPassword(hash, "secret") {
+		t.Errorf("hash should match secret; got: %v", hash)
+	}
+	if err := writeHash(strings.NewReader("\n"), buf); err == nil {
+		t.Errorf("empty password should be an error")
+	}
+}
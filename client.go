@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// client identifies the client of a proxy request.
+type client struct {
+	// Address is the IP address of the client
+	Address string
+	// User is the verified proxy-auth username of the client if any
+	User string
+}
+
+// requestClient returns the client of a proxy request. The username of
+// the request is not set since anyone can send one; it is only set once
+// its password is verified.
+func requestClient(req *http.Request) client {
+	if req == nil {
+		return client{}
+	}
+	return client{Address: stripPort(req.RemoteAddr)}
+}
+
+// proxyCredentials returns the Basic credentials of the
+// Proxy-Authorization header of a request.
+func proxyCredentials(req *http.Request) (string, string, bool) {
+	const prefix = "Basic "
+	auth := req.Header.Get("Proxy-Authorization")
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	credentials := string(decoded)
+	i := strings.IndexByte(credentials, ':')
+	if i < 0 {
+		return "", "", false
+	}
+	return credentials[:i], credentials[i+1:], true
+}
+
+// clientGroup applies its own rule sets and schedules to the clients
+// with matching addresses or proxy-auth usernames.
+type clientGroup struct {
+	Name string `yaml:"name"`
+	// Addresses are the IP addresses and CIDR ranges of the clients
+	Addresses []string `yaml:"addresses,omitempty"`
+	// Users are the proxy-auth usernames of the clients
+	Users []string `yaml:"users,omitempty"`
+	// Enable and Disable are the rule sets turned on and off
+	Enable  []string `yaml:"enable,omitempty"`
+	Disable []string `yaml:"disable,omitempty"`
+	// Schedules apply to the clients instead of the top-level schedules
+	Schedules []schedule `yaml:"schedules,omitempty"`
+
+	networks []*net.IPNet
+}
+
+func (g clientGroup) String() string {
+	return g.Name
+}
+
+// parseClientGroups checks the client groups and the rule sets they name
+// and returns them ready to be matched.
+func parseClientGroups(groups []clientGroup, sets []ruleSet) ([]clientGroup, error) {
+	names := make(map[string]bool)
+	for _, set := range sets {
+		names[set.Name] = true
+	}
+	parsed := []clientGroup{}
+	seen := make(map[string]bool)
+	for _, g := range groups {
+		if g.Name == "" {
+			return nil, errors.New("client group without name")
+		}
+		if seen[g.Name] {
+			return nil, fmt.Errorf("duplicate client group name: %s", g.Name)
+		}
+		seen[g.Name] = true
+		if len(g.Addresses) == 0 && len(g.Users) == 0 {
+			return nil, fmt.Errorf("client group %s: no addresses or users", g.Name)
+		}
+		g.networks = nil
+		for _, address := range g.Addresses {
+			network, err := parseNetwork(address)
+			if err != nil {
+				return nil, fmt.Errorf("client group %s: %v", g.Name, err)
+			}
+			g.networks = append(g.networks, network)
+		}
+		for _, name := range append(append([]string{}, g.Enable...), g.Disable...) {
+			if !names[name] {
+				return nil, fmt.Errorf("client group %s: unknown rule set: %s", g.Name, name)
+			}
+		}
+		schedules, err := parseSchedules(g.Schedules, sets)
+		if err != nil {
+			return nil, fmt.Errorf("client group %s: %v", g.Name, err)
+		}
+		g.Schedules = schedules
+		parsed = append(parsed, g)
+	}
+	return parsed, nil
+}
+
+// parseNetwork parses an IP address or a CIDR range.
+func parseNetwork(value string) (*net.IPNet, error) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "/") {
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range: %s", value)
+		}
+		return network, nil
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address: %s", value)
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// matches reports whether a client belongs to the group.
+func (g clientGroup) matches(c client) bool {
+	if c.User != "" {
+		for _, user := range g.Users {
+			if user == c.User {
+				return true
+			}
+		}
+	}
+	if ip := net.ParseIP(c.Address); ip != nil {
+		for _, network := range g.networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchGroup returns the first group of a client or nil.
+func matchGroup(groups []clientGroup, c client) *clientGroup {
+	for i := range groups {
+		if groups[i].matches(c) {
+			return &groups[i]
+		}
+	}
+	return nil
+}
+
+// policyAt returns the policy of the group at t. The schedules of the
+// group override the rule sets it turns on and off.
+func (g clientGroup) policyAt(t time.Time) policy {
+	p := policyAt(g.Schedules, t)
+	for _, names := range []struct {
+		sets    []string
+		enabled bool
+	}{{g.Enable, true}, {g.Disable, false}} {
+		for _, name := range names.sets {
+			if _, ok := p.ruleSets[name]; ok {
+				continue
+			}
+			if p.ruleSets == nil {
+				p.ruleSets = make(map[string]bool)
+			}
+			p.ruleSets[name] = names.enabled
+		}
+	}
+	return p
+}
+
+// clientRuleSets returns the names of the rule sets the client groups
+// and their schedules turn on or off.
+func clientRuleSets(groups []clientGroup) map[string]bool {
+	names := make(map[string]bool)
+	for _, g := range groups {
+		for _, name := range append(append([]string{}, g.Enable...), g.Disable...) {
+			names[name] = true
+		}
+		for name := range scheduledRuleSets(g.Schedules) {
+			names[name] = true
+		}
+	}
+	return names
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseClientGroups(t *testing.T) {
+	sets := []ruleSet{{Name: "social"}}
+	tt := []struct {
+		name   string
+		groups []clientGroup
+		err    bool
+	}{
+		{"valid", []clientGroup{{Name: "kids", Addresses: []string{"192.168.1.20", "10.0.0.0/8", "fd00::/8"}, Enable: []string{"social"}}}, false},
+		{"users only", []clientGroup{{Name: "office", Users: []string{"alice"}}}, false},
+		{"no name", []clientGroup{{Addresses: []string{"10.0.0.1"}}}, true},
+		{"duplicate", []clientGroup{{Name: "a", Users: []string{"x"}}, {Name: "a", Users: []string{"y"}}}, true},
+		{"no clients", []clientGroup{{Name: "empty"}}, true},
+		{"invalid address", []clientGroup{{Name: "a", Addresses: []string{"10.0.0"}}}, true},
+		{"invalid cidr", []clientGroup{{Name: "a", Addresses: []string{"10.0.0.0/33"}}}, true},
+		{"unknown rule set", []clientGroup{{Name: "a", Users: []string{"x"}, Disable: []string{"video"}}}, true},
+		{"invalid schedule", []clientGroup{{Name: "a", Users: []string{"x"}, Schedules: []schedule{{Name: "s", From: "25:00"}}}}, true},
+	}
+	for _, tc := range tt {
+		_, err := parseClientGroups(tc.groups, sets)
+		if (err != nil) != tc.err {
+			t.Errorf("%v error should be %v; got: %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func TestMatchGroup(t *testing.T) {
+	groups, err := parseClientGroups([]clientGroup{
+		{Name: "kids", Addresses: []string{"192.168.1.20", "192.168.1.32/28"}},
+		{Name: "office", Addresses: []string{"10.0.0.0/8", "fd00::/8"}, Users: []string{"alice"}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		client client
+		group  string
+	}{
+		{client{Address: "192.168.1.20"}, "kids"},
+		{client{Address: "192.168.1.40"}, "kids"},
+		{client{Address: "192.168.1.21"}, ""},
+		{client{Address: "10.1.2.3"}, "office"},
+		{client{Address: "fd00::1"}, "office"},
+		{client{Address: "127.0.0.1", User: "alice"}, "office"},
+		{client{Address: "127.0.0.1", User: "bob"}, ""},
+		{client{}, ""},
+	}
+	for _, tc := range tt {
+		group := ""
+		if g := matchGroup(groups, tc.client); g != nil {
+			group = g.Name
+		}
+		if group != tc.group {
+			t.Errorf("group of %+v should be %q; got: %q", tc.client, tc.group, group)
+		}
+	}
+}
+
+func TestClientGroupPolicy(t *testing.T) {
+	sets := []ruleSet{{Name: "social"}, {Name: "video"}}
+	groups, err := parseClientGroups([]clientGroup{{
+		Name:      "kids",
+		Users:     []string{"kid"},
+		Enable:    []string{"social", "video"},
+		Schedules: []schedule{{Name: "evening", From: "20:00", To: "22:00", Disable: []string{"video"}}},
+	}}, sets)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := groups[0].policyAt(time.Date(2021, 3, 5, 10, 0, 0, 0, time.UTC))
+	if !p.ruleSetEnabled("social", false) || !p.ruleSetEnabled("video", false) {
+		t.Errorf("social and video should be enabled; got: %v", p.ruleSets)
+	}
+	p = groups[0].policyAt(time.Date(2021, 3, 5, 21, 0, 0, 0, time.UTC))
+	if !p.ruleSetEnabled("social", false) || p.ruleSetEnabled("video", true) {
+		t.Errorf("the schedule should disable video; got: %v", p.ruleSets)
+	}
+	if names := clientRuleSets(groups); !names["social"] || !names["video"] {
+		t.Errorf("client rule sets should be social and video; got: %v", names)
+	}
+}
+
+func TestRequestClient(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+	req.RemoteAddr = "192.168.1.20:51234"
+	req.Header.Set("Proxy-Authorization", "Basic YWxpY2U6c2VjcmV0") // alice:secret
+
+	// the unverified username is not trusted
+	c := requestClient(req)
+	if c.Address != "192.168.1.20" || c.User != "" {
+		t.Errorf("client should be 192.168.1.20 without user; got: %+v", c)
+	}
+	if user, password, ok := proxyCredentials(req); !ok || user != "alice" || password != "secret" {
+		t.Errorf("credentials should be alice:secret; got: %v:%v", user, password)
+	}
+
+	for _, header := range []string{"", "Bearer token", "Basic !!!", "Basic YWxpY2U="} {
+		req.Header.Set("Proxy-Authorization", header)
+		if _, _, ok := proxyCredentials(req); ok {
+			t.Errorf("credentials of %q should be invalid", header)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TTL bounds of the cached CNAME chains, the empty chains are cached for
+// cnameNegativeTTL and the failed lookups for cnameFailureTTL.
+const (
+	cnameMinTTL      = 30 * time.Second
+	cnameMaxTTL      = time.Hour
+	cnameNegativeTTL = 5 * time.Minute
+	cnameFailureTTL  = 30 * time.Second
+	cnameMaxChain    = 8
+	cnameCacheSize   = 10000
+)
+
+// cnameLookup returns the CNAME targets of a name in order and how long
+// they are valid.
+type cnameLookup func(ctx context.Context, name string) ([]string, time.Duration, error)
+
+// cnameEntry is a cached CNAME chain.
+type cnameEntry struct {
+	targets []string
+	expires time.Time
+}
+
+// uncloaker resolves the CNAME chains of the host names, so the trackers
+// disguised as first-party subdomains can be matched by their targets.
+type uncloaker struct {
+	lookup cnameLookup
+
+	mu    sync.Mutex
+	cache map[string]cnameEntry
+	// now returns the current time
+	now func() time.Time
+}
+
+// newUncloaker creates an uncloaker following the CNAME chains in the
+// answers of a DNS transport.
+func newUncloaker(t dnsTransport) *uncloaker {
+	return &uncloaker{
+		lookup: func(ctx context.Context, name string) ([]string, time.Duration, error) {
+			resp, err := queryDNS(ctx, t, name, dnsTypeA)
+			if err != nil {
+				return nil, 0, err
+			}
+			targets, ttl := cnameChain(name, resp.Answers)
+			return targets, ttl, nil
+		},
+		cache: make(map[string]cnameEntry),
+		now:   time.Now,
+	}
+}
+
+// newSystemUncloaker creates an uncloaker asking the system resolver,
+// which only gives the last target of a chain and no TTL.
+func newSystemUncloaker(r *net.Resolver) *uncloaker {
+	return &uncloaker{
+		lookup: func(ctx context.Context, name string) ([]string, time.Duration, error) {
+			cname, err := r.LookupCNAME(ctx, name)
+			if err != nil {
+				if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+					return []string{}, cnameNegativeTTL, nil
+				}
+				return nil, 0, err
+			}
+			target := strings.ToLower(strings.TrimSuffix(cname, "."))
+			if target == name {
+				return []string{}, cnameNegativeTTL, nil
+			}
+			return []string{target}, cnameNegativeTTL, nil
+		},
+		cache: make(map[string]cnameEntry),
+		now:   time.Now,
+	}
+}
+
+// chain returns the CNAME targets of a host name in order. Lookup errors
+// give an empty chain, which is cached for cnameFailureTTL.
+func (u *uncloaker) chain(ctx context.Context, host string) []string {
+	name := strings.ToLower(strings.TrimSuffix(stripPort(host), "."))
+	if net.ParseIP(name) != nil || !strings.Contains(name, ".") {
+		return nil
+	}
+	u.mu.Lock()
+	entry, ok := u.cache[name]
+	u.mu.Unlock()
+	now := u.now()
+	if ok && now.Before(entry.expires) {
+		return entry.targets
+	}
+
+	targets, ttl, err := u.lookup(ctx, name)
+	if err != nil {
+		targets, ttl = nil, cnameFailureTTL
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.cache) >= cnameCacheSize {
+		u.prune(now)
+	}
+	u.cache[name] = cnameEntry{targets: targets, expires: now.Add(ttl)}
+	return targets
+}
+
+// cnameChain follows the CNAME records of the answers from a name and
+// returns the targets with the lowest TTL of the chain.
+func cnameChain(name string, answers []dnsRecord) ([]string, time.Duration) {
+	targets := []string{}
+	ttl := cnameMaxTTL
+	for len(targets) < cnameMaxChain {
+		found := false
+		for _, r := range answers {
+			if r.Type == dnsTypeCNAME && r.Name == name {
+				targets = append(targets, r.Target)
+				if d := time.Duration(r.TTL) * time.Second; d < ttl {
+					ttl = d
+				}
+				name = r.Target
+				found = true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	if len(targets) == 0 {
+		return targets, cnameNegativeTTL
+	}
+	if ttl < cnameMinTTL {
+		ttl = cnameMinTTL
+	}
+	return targets, ttl
+}
+
+// prune drops the expired entries, or all of them if none expired.
+func (u *uncloaker) prune(now time.Time) {
+	for name, entry := range u.cache {
+		if !now.Before(entry.expires) {
+			delete(u.cache, name)
+		}
+	}
+	if len(u.cache) >= cnameCacheSize {
+		u.cache = make(map[string]cnameEntry)
+	}
+}
+
+// matchCNAME matches the CNAME targets of a host against the blocklist
+// and the blacklist. It returns the decision with the matching target.
+func (b *Blocker) matchCNAME(host string, p policy, l *hostLookups) (Decision, bool) {
+	if b.uncloak == nil {
+		return Decision{}, false
+	}
+	// the overridden hosts are not resolved
+	if b.overrides != nil {
+		if _, ok := b.overrides.address(host); ok {
+			return Decision{}, false
+		}
+	}
+	if !l.uncloaked {
+		u := b.uncloak
+		l.wait(func(ctx context.Context) {
+			l.cnames = u.chain(ctx, host)
+			l.uncloaked = true
+		})
+		return Decision{}, false
+	}
+	for _, target := range l.cnames {
+		if b.blocklist != nil {
+			if rule, source, ok := matchRule(b.blocklist, target); ok {
+				return Decision{Host: host, Blocked: true, Stage: stageBlocklist, Rule: rule, Source: source, CNAME: target}, true
+			}
+		}
+		if b.blacklist != nil {
+			if rule, source, ok := matchPolicy(b.blacklist, target, p); ok {
+				return Decision{Host: host, Blocked: true, Stage: stageBlacklist, Rule: rule, Source: source, CNAME: target}, true
+			}
+		}
+	}
+	return Decision{}, false
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCNAMEChain(t *testing.T) {
+	tt := []struct {
+		name    string
+		answers []dnsRecord
+		targets []string
+		ttl     time.Duration
+	}{
+		{"none", nil, []string{}, cnameNegativeTTL},
+		{"address only", []dnsRecord{{Name: "a.com", Type: dnsTypeA, TTL: 60}}, []string{}, cnameNegativeTTL},
+		{"chain", []dnsRecord{
+			{Name: "b.com", Type: dnsTypeCNAME, TTL: 120, Target: "c.com"},
+			{Name: "a.com", Type: dnsTypeCNAME, TTL: 600, Target: "b.com"},
+		}, []string{"b.com", "c.com"}, 120 * time.Second},
+		{"short ttl", []dnsRecord{{Name: "a.com", Type: dnsTypeCNAME, TTL: 1, Target: "b.com"}}, []string{"b.com"}, cnameMinTTL},
+		{"long ttl", []dnsRecord{{Name: "a.com", Type: dnsTypeCNAME, TTL: 86400, Target: "b.com"}}, []string{"b.com"}, cnameMaxTTL},
+		{"loop", []dnsRecord{
+			{Name: "a.com", Type: dnsTypeCNAME, TTL: 60, Target: "b.com"},
+			{Name: "b.com", Type: dnsTypeCNAME, TTL: 60, Target: "a.com"},
+		}, []string{"b.com", "a.com", "b.com", "a.com", "b.com", "a.com", "b.com", "a.com"}, 60 * time.Second},
+	}
+	for _, tc := range tt {
+		targets, ttl := cnameChain("a.com", tc.answers)
+		if !reflect.DeepEqual(targets, tc.targets) {
+			t.Errorf("%v targets should be %v; got: %v", tc.name, tc.targets, targets)
+		}
+		if ttl != tc.ttl {
+			t.Errorf("%v TTL should be %v; got: %v", tc.name, tc.ttl, ttl)
+		}
+	}
+}
+
+func TestUncloakerCache(t *testing.T) {
+	server, queries := startDNSServer(t, map[string][]dnsRecord{
+		"metrics.shop.com": {
+			{Type: dnsTypeCNAME, TTL: 300, Target: "shop.tracker.com"},
+			{Name: "shop.tracker.com", Type: dnsTypeA, TTL: 60, IP: net.ParseIP("203.0.113.7")},
+		},
+	})
+	u := newUncloaker(plainDNS{server: server})
+	now := time.Date(2021, 3, 5, 10, 0, 0, 0, time.UTC)
+	u.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if targets := u.chain(ctx, "Metrics.Shop.com:443"); !reflect.DeepEqual(targets, []string{"shop.tracker.com"}) {
+			t.Errorf("targets should be shop.tracker.com; got: %v", targets)
+		}
+	}
+	if n := queries(); n != 1 {
+		t.Errorf("queries should be 1 while cached; got: %v", n)
+	}
+	now = now.Add(301 * time.Second)
+	u.chain(ctx, "metrics.shop.com")
+	if n := queries(); n != 2 {
+		t.Errorf("queries should be 2 after the TTL; got: %v", n)
+	}
+
+	for _, host := range []string{"203.0.113.7", "localhost"} {
+		if targets := u.chain(ctx, host); targets != nil {
+			t.Errorf("targets of %v should be nil; got: %v", host, targets)
+		}
+	}
+	if n := queries(); n != 2 {
+		t.Errorf("IP addresses and single labels should not be queried; got: %v queries", n)
+	}
+}
+
+// failingDNS is a DNS transport counting the queries it fails.
+type failingDNS struct {
+	queries *int
+}
+
+func (f failingDNS) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	*f.queries++
+	return nil, errors.New("timeout")
+}
+
+func TestUncloakerFailures(t *testing.T) {
+	queries := 0
+	u := newUncloaker(failingDNS{&queries})
+	now := time.Date(2021, 3, 5, 10, 0, 0, 0, time.UTC)
+	u.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if targets := u.chain(ctx, "metrics.shop.com"); len(targets) != 0 {
+			t.Errorf("failed lookup should give no targets; got: %v", targets)
+		}
+	}
+	if queries != 1 {
+		t.Errorf("failed lookups should be cached; got: %v queries", queries)
+	}
+	now = now.Add(cnameFailureTTL)
+	u.chain(ctx, "metrics.shop.com")
+	if queries != 2 {
+		t.Errorf("failed lookups should be retried after %v; got: %v queries", cnameFailureTTL, queries)
+	}
+}
+
+func TestSystemUncloaker(t *testing.T) {
+	server, _ := startDNSServer(t, map[string][]dnsRecord{
+		"metrics.shop.com": {
+			{Type: dnsTypeCNAME, TTL: 300, Target: "shop.tracker.com"},
+			{Name: "shop.tracker.com", Type: dnsTypeA, TTL: 60, IP: net.ParseIP("203.0.113.7")},
+		},
+		"www.shop.com": {
+			{Type: dnsTypeA, TTL: 60, IP: net.ParseIP("203.0.113.8")},
+		},
+	})
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return net.Dial("udp", server)
+		},
+	}
+	u := newSystemUncloaker(r)
+	ctx := context.Background()
+	if targets := u.chain(ctx, "metrics.shop.com:443"); !reflect.DeepEqual(targets, []string{"shop.tracker.com"}) {
+		t.Errorf("targets should be shop.tracker.com; got: %v", targets)
+	}
+	if targets := u.chain(ctx, "www.shop.com:443"); len(targets) != 0 {
+		t.Errorf("host without CNAME should have no targets; got: %v", targets)
+	}
+}
@@ -3,9 +3,13 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/ProtonMail/go-appdir"
@@ -13,44 +17,148 @@ import (
 )
 
 var (
-	defaultBlockerAddress   = ":5678"
-	defaultBlockerEnabled   = true
-	defaultAutostartEnabled = true
-	defaultGUIEnabled       = true
-	defaultLogEnabled       = true
-	defaultProxyAddress     = ""
-	defaultBlocklistPath    = filepath.Join(configDir(), "blocklist")
-	defaultBlacklistPath    = filepath.Join(configDir(), "blacklist")
-	defaultWhitelistPath    = filepath.Join(configDir(), "whitelist")
-	defaultLogPath          = logFile()
-	defaultUpdateInterval   = 24 * time.Hour
+	defaultBlockerAddress    = ":5678"
+	defaultBlockerEnabled    = true
+	defaultAutostartEnabled  = true
+	defaultGUIEnabled        = true
+	defaultLogEnabled        = true
+	defaultProxyAddress      = ""
+	defaultBlocklistPath     = filepath.Join(configDir(), "blocklist")
+	defaultBlacklistPath     = filepath.Join(configDir(), "blacklist")
+	defaultWhitelistPath     = filepath.Join(configDir(), "whitelist")
+	defaultFocuslistPath     = filepath.Join(configDir(), "focuslist")
+	defaultFocusEnabled      = false
+	defaultLogPath           = logFile()
+	defaultUpdateInterval    = 24 * time.Hour
+	defaultControlAddress    = filepath.Join(cacheDir(), "lycurgus.sock")
+	defaultAdminAddress      = "127.0.0.1:5679"
+	defaultAdminToken        = ""
+	defaultQueryLogSize      = 1000
+	defaultQueryLogPath      = ""
+	defaultQueryLogRetention = 7 * 24 * time.Hour
+	defaultInvalidRules      = invalidRulesSkip
+	defaultACL               = []string{"loopback"}
+	defaultMaxClientConns    = 100
+	defaultPorts             = []int{443, 8443, 5228}
+	defaultRangesPath        = filepath.Join(configDir(), "blockranges")
+	defaultResolveRanges     = false
+	defaultBlockIPs          = false
+	defaultRebinding         = false
+	defaultUncloak           = false
+	defaultHostsPath         = filepath.Join(configDir(), "hosts")
+)
+
+// Sources of a config value as reported by the config command.
+const (
+	sourceDefault = "default"
+	sourceFile    = "file"
+	sourceFlag    = "flag"
 )
 
 // Config holds the settings for the application
 type Config struct {
-	BlockerAddress   string
-	BlocklistPath    string
-	BlacklistPath    string
-	WhitelistPath    string
-	AutostartEnabled bool
-	GUIEnabled       bool
-	LogEnabled       bool
-	LogPath          string
-	ProxyAddress     string
-	UpdateInterval   time.Duration
+	BlockerAddress    string
+	BlocklistPath     string
+	BlacklistPath     string
+	WhitelistPath     string
+	AutostartEnabled  bool
+	GUIEnabled        bool
+	LogEnabled        bool
+	LogPath           string
+	ProxyAddress      string
+	UpdateInterval    time.Duration
+	ControlAddress    string
+	AdminAddress      string
+	AdminToken        string
+	QueryLogSize      int
+	QueryLogPath      string
+	QueryLogRetention time.Duration
+	InvalidRules      string
+	Allow             []string
+	Block             []string
+	RuleSets          []ruleSet
+	Schedules         []schedule
+	FocuslistPath     string
+	FocusEnabled      bool
+	Budgets           []budget
+	Clients           []clientGroup
+	ACL               []string
+	Users             []proxyUser
+	MaxClientConns    int
+	Ports             []int
+	PortRules         []portRule
+	RangesPath        string
+	ResolveRanges     bool
+	BlockIPs          bool
+	AllowIPs          []string
+	Rebinding         bool
+	RebindAllow       []string
+	Uncloak           bool
+	Resolvers         []string
+	HostsPath         string
+	Hosts             hostEntries
+
+	// sources maps Config field names to the source of their value
+	sources map[string]string
 }
 
 type fileConfig struct {
-	BlockerAddress   *string        `yaml:"address,omitempty"`
-	BlocklistPath    *string        `yaml:"blocklist,omitempty"`
-	BlacklistPath    *string        `yaml:"blacklist,omitempty"`
-	WhitelistPath    *string        `yaml:"whitelist,omitempty"`
-	AutostartEnabled *bool          `yaml:"autostart,omitempty"`
-	GUIEnabled       *bool          `yaml:"gui,omitempty"`
-	LogEnabled       *bool          `yaml:"log,omitempty"`
-	LogPath          *string        `yaml:"logfile,omitempty"`
-	ProxyAddress     *string        `yaml:"proxy,omitempty"`
-	UpdateInterval   *time.Duration `ỳaml:"updateInterval,omitempty"`
+	BlockerAddress    *string        `yaml:"address,omitempty"`
+	BlocklistPath     *string        `yaml:"blocklist,omitempty"`
+	BlacklistPath     *string        `yaml:"blacklist,omitempty"`
+	WhitelistPath     *string        `yaml:"whitelist,omitempty"`
+	AutostartEnabled  *bool          `yaml:"autostart,omitempty"`
+	GUIEnabled        *bool          `yaml:"gui,omitempty"`
+	LogEnabled        *bool          `yaml:"log,omitempty"`
+	LogPath           *string        `yaml:"logfile,omitempty"`
+	ProxyAddress      *string        `yaml:"proxy,omitempty"`
+	UpdateInterval    *time.Duration `yaml:"update,omitempty"`
+	ControlAddress    *string        `yaml:"control,omitempty"`
+	AdminAddress      *string        `yaml:"admin,omitempty"`
+	AdminToken        *string        `yaml:"admintoken,omitempty"`
+	QueryLogSize      *int           `yaml:"querylogsize,omitempty"`
+	QueryLogPath      *string        `yaml:"querylog,omitempty"`
+	QueryLogRetention *time.Duration `yaml:"querylogretention,omitempty"`
+	InvalidRules      *string        `yaml:"invalidrules,omitempty"`
+	Allow             *[]string      `yaml:"allow,omitempty"`
+	Block             *[]string      `yaml:"block,omitempty"`
+	RuleSets          *[]ruleSet     `yaml:"rulesets,omitempty"`
+	Schedules         *[]schedule    `yaml:"schedules,omitempty"`
+	FocuslistPath     *string        `yaml:"focuslist,omitempty"`
+	FocusEnabled      *bool          `yaml:"focus,omitempty"`
+	Budgets           *[]budget      `yaml:"budgets,omitempty"`
+	Clients           *[]clientGroup `yaml:"clients,omitempty"`
+	ACL               *[]string      `yaml:"acl,omitempty"`
+	Users             *[]proxyUser   `yaml:"users,omitempty"`
+	MaxClientConns    *int           `yaml:"maxconns,omitempty"`
+	Ports             *[]int         `yaml:"ports,omitempty"`
+	PortRules         *[]portRule    `yaml:"portrules,omitempty"`
+	RangesPath        *string        `yaml:"blockranges,omitempty"`
+	ResolveRanges     *bool          `yaml:"resolveranges,omitempty"`
+	BlockIPs          *bool          `yaml:"blockips,omitempty"`
+	AllowIPs          *[]string      `yaml:"allowips,omitempty"`
+	Rebinding         *bool          `yaml:"rebinding,omitempty"`
+	RebindAllow       *[]string      `yaml:"rebindallow,omitempty"`
+	Uncloak           *bool          `yaml:"uncloak,omitempty"`
+	Resolvers         *[]string      `yaml:"resolvers,omitempty"`
+	HostsPath         *string        `yaml:"hostsfile,omitempty"`
+	Hosts             *hostEntries   `yaml:"hosts,omitempty"`
+
+	// LegacyUpdate and LegacyUpdateLower are the earlier keys of update
+	LegacyUpdate      *time.Duration `yaml:"updateInterval,omitempty"`
+	LegacyUpdateLower *time.Duration `yaml:"updateinterval,omitempty"`
+}
+
+// keys returns the names of the fields that are set in the config file.
+func (fc *fileConfig) keys() map[string]bool {
+	keys := make(map[string]bool)
+	v := reflect.ValueOf(fc).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if !v.Field(i).IsNil() {
+			keys[v.Type().Field(i).Name] = true
+		}
+	}
+	return keys
 }
 
 func (fc *fileConfig) toConfig() *Config {
@@ -85,6 +193,96 @@ func (fc *fileConfig) toConfig() *Config {
 	if fc.UpdateInterval != nil {
 		c.UpdateInterval = *fc.UpdateInterval
 	}
+	if fc.ControlAddress != nil {
+		c.ControlAddress = *fc.ControlAddress
+	}
+	if fc.AdminAddress != nil {
+		c.AdminAddress = *fc.AdminAddress
+	}
+	if fc.AdminToken != nil {
+		c.AdminToken = *fc.AdminToken
+	}
+	if fc.QueryLogSize != nil {
+		c.QueryLogSize = *fc.QueryLogSize
+	}
+	if fc.QueryLogPath != nil {
+		c.QueryLogPath = *fc.QueryLogPath
+	}
+	if fc.QueryLogRetention != nil {
+		c.QueryLogRetention = *fc.QueryLogRetention
+	}
+	if fc.InvalidRules != nil {
+		c.InvalidRules = *fc.InvalidRules
+	}
+	if fc.Allow != nil {
+		c.Allow = *fc.Allow
+	}
+	if fc.Block != nil {
+		c.Block = *fc.Block
+	}
+	if fc.RuleSets != nil {
+		c.RuleSets = *fc.RuleSets
+	}
+	if fc.Schedules != nil {
+		c.Schedules = *fc.Schedules
+	}
+	if fc.FocuslistPath != nil {
+		c.FocuslistPath = *fc.FocuslistPath
+	}
+	if fc.FocusEnabled != nil {
+		c.FocusEnabled = *fc.FocusEnabled
+	}
+	if fc.Budgets != nil {
+		c.Budgets = *fc.Budgets
+	}
+	if fc.Clients != nil {
+		c.Clients = *fc.Clients
+	}
+	if fc.ACL != nil {
+		c.ACL = *fc.ACL
+	}
+	if fc.Users != nil {
+		c.Users = *fc.Users
+	}
+	if fc.MaxClientConns != nil {
+		c.MaxClientConns = *fc.MaxClientConns
+	}
+	if fc.Ports != nil {
+		c.Ports = *fc.Ports
+	}
+	if fc.PortRules != nil {
+		c.PortRules = *fc.PortRules
+	}
+	if fc.RangesPath != nil {
+		c.RangesPath = *fc.RangesPath
+	}
+	if fc.ResolveRanges != nil {
+		c.ResolveRanges = *fc.ResolveRanges
+	}
+	if fc.BlockIPs != nil {
+		c.BlockIPs = *fc.BlockIPs
+	}
+	if fc.AllowIPs != nil {
+		c.AllowIPs = *fc.AllowIPs
+	}
+	if fc.Rebinding != nil {
+		c.Rebinding = *fc.Rebinding
+	}
+	if fc.RebindAllow != nil {
+		c.RebindAllow = *fc.RebindAllow
+	}
+	if fc.Uncloak != nil {
+		c.Uncloak = *fc.Uncloak
+	}
+	if fc.Resolvers != nil {
+		c.Resolvers = *fc.Resolvers
+	}
+	if fc.HostsPath != nil {
+		c.HostsPath = *fc.HostsPath
+	}
+	if fc.Hosts != nil {
+		c.Hosts = *fc.Hosts
+	}
 	return c
 }
 
@@ -100,8 +298,84 @@ func (c *Config) String() string {
   LogPath:          %v,
   ProxyAddress:     %v,
   UpdateInterval:   %v,
+  ControlAddress:   %v,
+  AdminAddress:     %v,
+  QueryLogSize:     %v,
+  QueryLogPath:     %v,
+  QueryLogRetention: %v,
+  InvalidRules:     %v,
+  Allow:            %v,
+  Block:            %v,
+  RuleSets:         %v,
+  Schedules:        %v,
+  FocuslistPath:    %v,
+  FocusEnabled:     %v,
+  Budgets:          %v,
+  Clients:          %v,
+  ACL:              %v,
+  Users:            %v,
+  MaxClientConns:   %v,
+  Ports:            %v,
+  PortRules:        %v,
+  RangesPath:       %v,
+  ResolveRanges:    %v,
+  BlockIPs:         %v,
+  AllowIPs:         %v,
+  Rebinding:        %v,
+  RebindAllow:      %v,
+  Uncloak:          %v,
+  Resolvers:        %v,
+  HostsPath:        %v,
+  Hosts:            %v,
 }`, c.BlockerAddress, c.BlocklistPath, c.BlacklistPath, c.WhitelistPath,
-		c.AutostartEnabled, c.GUIEnabled, c.LogEnabled, c.LogPath, c.ProxyAddress, c.UpdateInterval)
+		c.AutostartEnabled, c.GUIEnabled, c.LogEnabled, c.LogPath, c.ProxyAddress, c.UpdateInterval,
+		c.ControlAddress, c.AdminAddress, c.QueryLogSize, c.QueryLogPath, c.QueryLogRetention, c.InvalidRules,
+		c.Allow, c.Block, c.RuleSets, c.Schedules,
+		c.FocuslistPath, c.FocusEnabled, c.Budgets, c.Clients,
+		c.ACL, c.Users, c.MaxClientConns, c.Ports, c.PortRules,
+		c.RangesPath, c.ResolveRanges, c.BlockIPs, c.AllowIPs, c.Rebinding, c.RebindAllow,
+		c.Uncloak, c.Resolvers, c.HostsPath, c.Hosts)
+}
+
+// setSource records where the value of a Config field came from.
+func (c *Config) setSource(field, source string) {
+	if c.sources == nil {
+		c.sources = make(map[string]string)
+	}
+	c.sources[field] = source
+}
+
+// Source returns where the value of a Config field came from.
+func (c *Config) Source(field string) string {
+	if source, ok := c.sources[field]; ok {
+		return source
+	}
+	return sourceDefault
+}
+
+// secretFields are the Config fields whose value is not shown.
+var secretFields = map[string]bool{
+	"AdminToken": true,
+}
+
+// Describe writes every setting with its value and source to w.
+func (c *Config) Describe(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SETTING\tVALUE\tSOURCE")
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.PkgPath != "" {
+			// unexported
+			continue
+		}
+		value := v.Field(i).Interface()
+		if secretFields[field.Name] && !v.Field(i).IsZero() {
+			value = "<redacted>"
+		}
+		fmt.Fprintf(tw, "%s\t%v\t%s\n", field.Name, value, c.Source(field.Name))
+	}
+	return tw.Flush()
 }
 
 func defaultConfig(config *fileConfig) {
@@ -135,6 +409,60 @@ func defaultConfig(config *fileConfig) {
 	if config.UpdateInterval == nil {
 		config.UpdateInterval = &defaultUpdateInterval
 	}
+	if config.ControlAddress == nil {
+		config.ControlAddress = &defaultControlAddress
+	}
+	if config.AdminAddress == nil {
+		config.AdminAddress = &defaultAdminAddress
+	}
+	if config.AdminToken == nil {
+		config.AdminToken = &defaultAdminToken
+	}
+	if config.QueryLogSize == nil {
+		config.QueryLogSize = &defaultQueryLogSize
+	}
+	if config.QueryLogPath == nil {
+		config.QueryLogPath = &defaultQueryLogPath
+	}
+	if config.QueryLogRetention == nil {
+		config.QueryLogRetention = &defaultQueryLogRetention
+	}
+	if config.InvalidRules == nil {
+		config.InvalidRules = &defaultInvalidRules
+	}
+	if config.FocuslistPath == nil {
+		config.FocuslistPath = &defaultFocuslistPath
+	}
+	if config.FocusEnabled == nil {
+		config.FocusEnabled = &defaultFocusEnabled
+	}
+	if config.ACL == nil {
+		config.ACL = &defaultACL
+	}
+	if config.MaxClientConns == nil {
+		config.MaxClientConns = &defaultMaxClientConns
+	}
+	if config.Ports == nil {
+		config.Ports = &defaultPorts
+	}
+	if config.RangesPath == nil {
+		config.RangesPath = &defaultRangesPath
+	}
+	if config.ResolveRanges == nil {
+		config.ResolveRanges = &defaultResolveRanges
+	}
+	if config.BlockIPs == nil {
+		config.BlockIPs = &defaultBlockIPs
+	}
+	if config.Rebinding == nil {
+		config.Rebinding = &defaultRebinding
+	}
+	if config.Uncloak == nil {
+		config.Uncloak = &defaultUncloak
+	}
+	if config.HostsPath == nil {
+		config.HostsPath = &defaultHostsPath
+	}
 }
 
 // parseFile parses a yaml config.
@@ -145,6 +473,13 @@ func parseFile(c *fileConfig, filePath string) {
 
 func parseFileContent(c *fileConfig, content []byte) {
 	yaml.Unmarshal(content, c)
+	if c.UpdateInterval == nil {
+		if c.LegacyUpdate != nil {
+			c.UpdateInterval = c.LegacyUpdate
+		} else {
+			c.UpdateInterval = c.LegacyUpdateLower
+		}
+	}
 }
 
 func isFlagPassed(flags *flag.FlagSet, name string) bool {
@@ -158,8 +493,8 @@ func isFlagPassed(flags *flag.FlagSet, name string) bool {
 }
 
 // parseFlags parses the flags and sets the values for keys in the config
-// that are passed in the flags.
-func parseFlags(config *Config, args []string) {
+// that are passed in the flags. It returns the remaining non-flag arguments.
+func parseFlags(config *Config, args []string) []string {
 	flags := flag.NewFlagSet(args[0], flag.ExitOnError)
 	blockerAddress := flags.String("address", "", "address to run blocker")
 	blocklistPath := flags.String("blocklist", "", "path to blocklist file")
@@ -171,53 +506,176 @@ func parseFlags(config *Config, args []string) {
 	logFile := flags.String("logfile", "", "path to log file")
 	proxyAddress := flags.String("proxy", "", "upstream proxy address")
 	updateInterval := flags.Duration("update", 0, "update interval")
+	controlAddress := flags.String("control", "", "path to control socket (empty disables it)")
+	adminAddress := flags.String("admin", "", "address to run admin API (empty disables it)")
+	queryLogSize := flags.Int("querylogsize", 0, "number of recent queries kept in memory")
+	queryLogPath := flags.String("querylog", "", "path to persisted query log (empty keeps it in memory)")
+	queryLogRetention := flags.Duration("querylogretention", 0, "retention of the persisted query log")
+	invalidRules := flags.String("invalidrules", "", "handling of invalid whitelist and blacklist rules (skip or keep)")
+	focuslistPath := flags.String("focuslist", "", "path to focus list file")
+	focusEnabled := flags.Bool("focus", false, "start in focus mode")
+	acl := flags.String("acl", "", "comma separated clients allowed to use the proxy (IP addresses, CIDR ranges, loopback or lan)")
+	maxClientConns := flags.Int("maxconns", 0, "open connections per client (0 is unlimited)")
+	rangesPath := flags.String("blockranges", "", "path to file of blocked address ranges")
+	resolveRanges := flags.Bool("resolveranges", false, "block the host names resolving into the blocked ranges")
+	blockIPs := flags.Bool("blockips", false, "block the IP-literal hosts outside allowips")
+	rebinding := flags.Bool("rebinding", false, "refuse the public host names resolving to internal addresses")
+	uncloak := flags.Bool("uncloak", false, "match the CNAME targets of the hosts against the blocklist and blacklist")
+	hostsPath := flags.String("hostsfile", "", "path to hosts file of host overrides")
+	resolvers := flags.String("resolvers", "", "comma separated DNS servers of the proxy (addresses, tls://host or https:// URLs)")
+	var ports []int
+	flags.Func("ports", "comma separated destination ports allowed for tunnels", func(value string) error {
+		var err error
+		ports, err = parsePorts(value)
+		return err
+	})
 
 	flags.Parse(args[1:])
 
 	if isFlagPassed(flags, "address") {
 		config.BlockerAddress = *blockerAddress
+		config.setSource("BlockerAddress", sourceFlag)
 	}
 	if isFlagPassed(flags, "blocklist") {
 		config.BlocklistPath = *blocklistPath
+		config.setSource("BlocklistPath", sourceFlag)
 	}
-	if isFlagPassed(flags, "blocklist") {
+	if isFlagPassed(flags, "blacklist") {
 		config.BlacklistPath = *blacklistPath
+		config.setSource("BlacklistPath", sourceFlag)
 	}
 	if isFlagPassed(flags, "whitelist") {
 		config.WhitelistPath = *whitelistPath
+		config.setSource("WhitelistPath", sourceFlag)
 	}
 	if isFlagPassed(flags, "autostart") {
 		config.AutostartEnabled = *autostartEnabled
+		config.setSource("AutostartEnabled", sourceFlag)
 	}
 	if isFlagPassed(flags, "gui") {
 		config.GUIEnabled = *guiEnabled
+		config.setSource("GUIEnabled", sourceFlag)
 	}
 	if isFlagPassed(flags, "log") {
 		config.LogEnabled = *logEnabled
+		config.setSource("LogEnabled", sourceFlag)
 	}
 	if isFlagPassed(flags, "logfile") {
 		config.LogPath = *logFile
+		config.setSource("LogPath", sourceFlag)
 	}
 	if isFlagPassed(flags, "proxy") {
 		config.ProxyAddress = *proxyAddress
+		config.setSource("ProxyAddress", sourceFlag)
 	}
 	if isFlagPassed(flags, "update") {
 		config.UpdateInterval = *updateInterval
+		config.setSource("UpdateInterval", sourceFlag)
+	}
+	if isFlagPassed(flags, "control") {
+		config.ControlAddress = *controlAddress
+		config.setSource("ControlAddress", sourceFlag)
+	}
+	if isFlagPassed(flags, "admin") {
+		config.AdminAddress = *adminAddress
+		config.setSource("AdminAddress", sourceFlag)
+	}
+	if isFlagPassed(flags, "querylogsize") {
+		config.QueryLogSize = *queryLogSize
+		config.setSource("QueryLogSize", sourceFlag)
+	}
+	if isFlagPassed(flags, "querylog") {
+		config.QueryLogPath = *queryLogPath
+		config.setSource("QueryLogPath", sourceFlag)
+	}
+	if isFlagPassed(flags, "querylogretention") {
+		config.QueryLogRetention = *queryLogRetention
+		config.setSource("QueryLogRetention", sourceFlag)
+	}
+	if isFlagPassed(flags, "invalidrules") {
+		config.InvalidRules = *invalidRules
+		config.setSource("InvalidRules", sourceFlag)
+	}
+	if isFlagPassed(flags, "focuslist") {
+		config.FocuslistPath = *focuslistPath
+		config.setSource("FocuslistPath", sourceFlag)
+	}
+	if isFlagPassed(flags, "focus") {
+		config.FocusEnabled = *focusEnabled
+		config.setSource("FocusEnabled", sourceFlag)
+	}
+	if isFlagPassed(flags, "acl") {
+		config.ACL = splitList(*acl)
+		config.setSource("ACL", sourceFlag)
+	}
+	if isFlagPassed(flags, "maxconns") {
+		config.MaxClientConns = *maxClientConns
+		config.setSource("MaxClientConns", sourceFlag)
+	}
+	if isFlagPassed(flags, "ports") {
+		config.Ports = ports
+		config.setSource("Ports", sourceFlag)
+	}
+	if isFlagPassed(flags, "blockranges") {
+		config.RangesPath = *rangesPath
+		config.setSource("RangesPath", sourceFlag)
+	}
+	if isFlagPassed(flags, "resolveranges") {
+		config.ResolveRanges = *resolveRanges
+		config.setSource("ResolveRanges", sourceFlag)
 	}
+	if isFlagPassed(flags, "blockips") {
+		config.BlockIPs = *blockIPs
+		config.setSource("BlockIPs", sourceFlag)
+	}
+	if isFlagPassed(flags, "rebinding") {
+		config.Rebinding = *rebinding
+		config.setSource("Rebinding", sourceFlag)
+	}
+	if isFlagPassed(flags, "uncloak") {
+		config.Uncloak = *uncloak
+		config.setSource("Uncloak", sourceFlag)
+	}
+	if isFlagPassed(flags, "hostsfile") {
+		config.HostsPath = *hostsPath
+		config.setSource("HostsPath", sourceFlag)
+	}
+	if isFlagPassed(flags, "resolvers") {
+		config.Resolvers = splitList(*resolvers)
+		config.setSource("Resolvers", sourceFlag)
+	}
+	return flags.Args()
+}
+
+// splitList splits a comma separated list and drops the empty items.
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
-func parseConfig(args []string) *Config {
+// parseConfig builds the config from the config file and the flags.
+// It returns the remaining non-flag arguments.
+func parseConfig(args []string) (*Config, []string) {
 	return parseConfigFile(args, configFile())
 }
 
-func parseConfigFile(args []string, configPath string) *Config {
+func parseConfigFile(args []string, configPath string) (*Config, []string) {
 	fc := &fileConfig{}
 	parseFile(fc, configPath)
+	fileKeys := fc.keys()
 	defaultConfig(fc)
 
 	c := fc.toConfig()
-	parseFlags(c, args)
-	return c
+	for key := range fileKeys {
+		c.setSource(key, sourceFile)
+	}
+	args = parseFlags(c, args)
+	return c, args
 }
 
 func isDirExists(dir string) bool {
@@ -241,6 +699,15 @@ func createDir(dir string) error {
 	return nil
 }
 
+// createPrivateDir creates a directory accessible only by the user if
+// it does not exist.
+func createPrivateDir(dir string) error {
+	if isDirExists(dir) {
+		return nil
+	}
+	return os.MkdirAll(dir, 0700)
+}
+
 func configDir() string {
 	dirs := appdir.New(appName)
 	return dirs.UserConfig()
@@ -269,3 +736,27 @@ func cacheDir() string {
 func blocklistCacheDir() string {
 	return filepath.Join(cacheDir(), "blocklist")
 }
+
+func adminTokenFile() string {
+	return filepath.Join(configDir(), "admintoken")
+}
+
+func sourceStatusFile() string {
+	return filepath.Join(cacheDir(), "sources.json")
+}
+
+func statsFile() string {
+	return filepath.Join(cacheDir(), "stats.json")
+}
+
+func ruleHitsFile() string {
+	return filepath.Join(cacheDir(), "rulehits.json")
+}
+
+func temporaryFile() string {
+	return filepath.Join(cacheDir(), "temporary.json")
+}
+
+func budgetsFile() string {
+	return filepath.Join(cacheDir(), "budgets.json")
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestParseFile(t *testing.T) {
@@ -91,6 +92,96 @@ log: false`),
 	}
 }
 
+func TestParseRuleSets(t *testing.T) {
+	c := &fileConfig{}
+	parseFileContent(c, []byte(`allow:
+  - intranet.example.com
+block:
+  - "*.tiktok.com"
+rulesets:
+  - name: team
+    blacklist: /srv/team/blacklist
+  - name: personal
+    enabled: false
+    block: [news.com]`))
+
+	config := c.toConfig()
+	if len(config.Allow) != 1 || config.Allow[0] != "intranet.example.com" {
+		t.Errorf("Allow should be [intranet.example.com]; got: %v", config.Allow)
+	}
+	if len(config.Block) != 1 || config.Block[0] != "*.tiktok.com" {
+		t.Errorf("Block should be [*.tiktok.com]; got: %v", config.Block)
+	}
+	if len(config.RuleSets) != 2 {
+		t.Fatalf("RuleSets should be 2; got: %v", config.RuleSets)
+	}
+	team, personal := config.RuleSets[0], config.RuleSets[1]
+	if team.Name != "team" || team.Blacklist != "/srv/team/blacklist" || !team.enabled() {
+		t.Errorf("team rule set is wrong; got: %+v", team)
+	}
+	if personal.enabled() || len(personal.Block) != 1 {
+		t.Errorf("personal rule set is wrong; got: %+v", personal)
+	}
+}
+
+func TestParseScheduleConfig(t *testing.T) {
+	c := &fileConfig{}
+	parseFileContent(c, []byte(`schedules:
+  - name: work
+    days: [mon, tue, wed, thu, fri]
+    from: "09:00"
+    to: "17:00"
+    enable: [social, video]
+  - name: weekend
+    days: [sat, sun]
+    blocker: false`))
+
+	config := c.toConfig()
+	if len(config.Schedules) != 2 {
+		t.Fatalf("Schedules should be 2; got: %v", config.Schedules)
+	}
+	work, weekend := config.Schedules[0], config.Schedules[1]
+	if work.Name != "work" || len(work.Days) != 5 || work.From != "09:00" || work.To != "17:00" || len(work.Enable) != 2 {
+		t.Errorf("work schedule is wrong; got: %+v", work)
+	}
+	if weekend.Blocker == nil || *weekend.Blocker {
+		t.Errorf("weekend schedule should turn the blocker off; got: %+v", weekend)
+	}
+}
+
+func TestParseBudgets(t *testing.T) {
+	c := &fileConfig{}
+	parseFileContent(c, []byte(`budgets:
+  - rule: "*.youtube.com"
+    limit: 30m`))
+
+	config := c.toConfig()
+	if len(config.Budgets) != 1 || config.Budgets[0].Rule != "*.youtube.com" || config.Budgets[0].Limit != 30*time.Minute {
+		t.Errorf("Budgets should be [*.youtube.com 30m]; got: %v", config.Budgets)
+	}
+}
+
+func TestParseClientsConfig(t *testing.T) {
+	c := &fileConfig{}
+	parseFileContent(c, []byte(`clients:
+  - name: kids
+    addresses: [192.168.1.20, 192.168.1.32/28]
+    enable: [social]
+    schedules:
+      - name: homework
+        from: "15:00"
+        to: "18:00"`))
+
+	config := c.toConfig()
+	if len(config.Clients) != 1 {
+		t.Fatalf("Clients should be 1; got: %v", config.Clients)
+	}
+	kids := config.Clients[0]
+	if kids.Name != "kids" || len(kids.Addresses) != 2 || len(kids.Enable) != 1 || len(kids.Schedules) != 1 || kids.Schedules[0].From != "15:00" {
+		t.Errorf("kids group is wrong; got: %+v", kids)
+	}
+}
+
 func TestDefaultConfig(t *testing.T) {
 	t5555 := ":5555"
 
@@ -195,3 +286,52 @@ func TestParseFlags(t *testing.T) {
 		t.Errorf("ProxyAddress should be %v; got: %v", tc.expected.ProxyAddress, c.ProxyAddress)
 	}
 }
+
+func TestConfigSources(t *testing.T) {
+	path := filepath.Join("testdata", "config.yml")
+	args := []string{"lycurgus", "--gui=false", "--blacklist=blacklist", "export", "hosts"}
+
+	c, rest := parseConfigFile(args, path)
+
+	if len(rest) != 2 || rest[0] != "export" || rest[1] != "hosts" {
+		t.Errorf("remaining args should be [export hosts]; got: %v", rest)
+	}
+	if c.BlacklistPath != "blacklist" {
+		t.Errorf("BlacklistPath should be %v; got: %v", "blacklist", c.BlacklistPath)
+	}
+
+	tt := []struct {
+		field, expected string
+	}{
+		{"BlockerAddress", sourceFile},
+		{"AutostartEnabled", sourceFile},
+		{"GUIEnabled", sourceFlag},
+		{"BlacklistPath", sourceFlag},
+		{"WhitelistPath", sourceDefault},
+		{"UpdateInterval", sourceDefault},
+	}
+	for _, tc := range tt {
+		if source := c.Source(tc.field); source != tc.expected {
+			t.Errorf("%v source should be %v; got: %v", tc.field, tc.expected, source)
+		}
+	}
+}
+
+func TestParseUpdateKeys(t *testing.T) {
+	tt := []struct {
+		content  string
+		expected time.Duration
+	}{
+		{"update: 1h", time.Hour},
+		{"updateInterval: 2h", 2 * time.Hour},
+		{"updateinterval: 3h", 3 * time.Hour},
+		{"update: 1h\nupdateInterval: 2h", time.Hour},
+	}
+	for _, tc := range tt {
+		c := &fileConfig{}
+		parseFileContent(c, []byte(tc.content))
+		if c.UpdateInterval == nil || *c.UpdateInterval != tc.expected {
+			t.Errorf("update interval of %q should be %v; got: %v", tc.content, tc.expected, c.UpdateInterval)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pauseUntilRestart is the pause duration that pauses blocking until restart.
+const pauseUntilRestart = "restart"
+
+// RunControl serves the control endpoint on a Unix domain socket.
+func (app *App) RunControl() error {
+	listener, err := listenControl(app.controlAddress)
+	if err != nil {
+		return err
+	}
+	return http.Serve(listener, newControlHandler(app))
+}
+
+// listenControl listens on a Unix domain socket accessible only by the user.
+func listenControl(path string) (net.Listener, error) {
+	if err := createPrivateDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("control socket is in use: %s", path)
+	}
+	// remove a socket left behind by an unclean shutdown
+	os.Remove(path)
+
+	return listenUnix(path)
+}
+
+// newControlHandler returns the handler of the control endpoint.
+func newControlHandler(app *App) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(app.Status())
+	})
+	mux.HandleFunc("/queries", func(w http.ResponseWriter, r *http.Request) {
+		f, err := parseQueryFilter(r.URL.Query(), time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		queries, err := app.Queries(f)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(queries)
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		f, err := parseQueryFilter(r.URL.Query(), time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		serveEvents(w, r, app.events, f)
+	})
+	mux.HandleFunc("/enable", controlAction(func(r *http.Request) error {
+		app.SetEnabled(true)
+		return nil
+	}))
+	mux.HandleFunc("/disable", controlAction(func(r *http.Request) error {
+		app.SetEnabled(false)
+		return nil
+	}))
+	mux.HandleFunc("/focus", controlAction(func(r *http.Request) error {
+		focus, err := strconv.ParseBool(r.FormValue("enabled"))
+		if err != nil {
+			return err
+		}
+		app.SetFocus(focus)
+		return nil
+	}))
+	mux.HandleFunc("/pause", controlAction(func(r *http.Request) error {
+		if r.FormValue("duration") == pauseUntilRestart {
+			app.Pause(0)
+			return nil
+		}
+		d, err := time.ParseDuration(r.FormValue("duration"))
+		if err != nil {
+			return err
+		}
+		if d <= 0 {
+			return errors.New("duration must be positive")
+		}
+		app.Pause(d)
+		return nil
+	}))
+	mux.HandleFunc("/reload", controlAction(func(r *http.Request) error {
+		return app.Reload()
+	}))
+	mux.HandleFunc("/allow", controlAction(func(r *http.Request) error {
+		host := stripPort(strings.TrimSpace(r.FormValue("host")))
+		if host == "" {
+			return errors.New("host is required")
+		}
+		if duration := r.FormValue("duration"); duration != "" {
+			return addTemporary(app, tempAllow, host, duration)
+		}
+		app.Allow(host)
+		return nil
+	}))
+	mux.HandleFunc("/block", controlAction(func(r *http.Request) error {
+		return addTemporary(app, tempBlock, r.FormValue("host"), r.FormValue("duration"))
+	}))
+	mux.HandleFunc("/remove", controlAction(func(r *http.Request) error {
+		return app.RemoveTemporary(strings.ToLower(stripPort(strings.TrimSpace(r.FormValue("host")))))
+	}))
+	return mux
+}
+
+// addTemporary adds a temporary rule of a host for a duration.
+func addTemporary(app *App, action, host, duration string) error {
+	r, err := parseTempRule(action, host, duration, time.Now())
+	if err != nil {
+		return err
+	}
+	return app.AddTemporary(r)
+}
+
+// controlAction wraps a state transition into a POST only handler.
+func controlAction(action func(r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := action(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// controlClient talks to the control endpoint of a running instance.
+type controlClient struct {
+	client *http.Client
+}
+
+func newControlClient(path string) *controlClient {
+	return &controlClient{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", path)
+				},
+			},
+			Timeout: time.Minute,
+		},
+	}
+}
+
+// do sends a request to the control endpoint and returns the response body.
+func (c *controlClient) do(method, path string, params url.Values) ([]byte, error) {
+	req, err := http.NewRequest(method, "http://"+appName+path, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach a running %s: %v", appName, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, errors.New(strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+func (c *controlClient) Status() (*Status, error) {
+	body, err := c.do(http.MethodGet, "/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	status := &Status{}
+	if err := json.Unmarshal(body, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Queries returns the queries of the query log matching the filter parameters.
+func (c *controlClient) Queries(params url.Values) ([]query, error) {
+	body, err := c.do(http.MethodGet, "/queries?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	queries := []query{}
+	if err := json.Unmarshal(body, &queries); err != nil {
+		return nil, err
+	}
+	return queries, nil
+}
+
+// Events calls fn with the decisions of the running instance matching
+// the filter parameters as they happen until fn returns an error.
+func (c *controlClient) Events(params url.Values, fn func(q query) error) error {
+	// the stream is open until it is interrupted
+	client := *c.client
+	client.Timeout = 0
+	resp, err := client.Get("http://" + appName + "/events?" + params.Encode())
+	if err != nil {
+		return fmt.Errorf("cannot reach a running %s: %v", appName, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return errors.New(strings.TrimSpace(string(body)))
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data := strings.TrimPrefix(scanner.Text(), "data: ")
+		if data == scanner.Text() {
+			continue
+		}
+		var q query
+		if err := json.Unmarshal([]byte(data), &q); err != nil {
+			return err
+		}
+		if err := fn(q); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func (c *controlClient) Post(path string, params url.Values) error {
+	_, err := c.do(http.MethodPost, path, params)
+	return err
+}
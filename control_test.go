@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func newTestControl(t *testing.T) (*App, *controlClient, func()) {
+	dir, err := ioutil.TempDir("", "lycurgus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "lycurgus.sock")
+
+	temporary := newTempRules("")
+	budgets, _ := newBudgets(nil, "")
+	app := &App{
+		events:    newEventBus(),
+		temporary: temporary,
+		budgets:   budgets,
+		access:    newAccessRequests(),
+		blocker:   NewBlocker(WithBlockerEnabled(true), WithBlockerTemporary(temporary)),
+	}
+	listener, err := listenControl(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(listener, newControlHandler(app))
+
+	return app, newControlClient(path), func() {
+		listener.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestControlEnable(t *testing.T) {
+	app, client, done := newTestControl(t)
+	defer done()
+
+	if err := client.Post("/disable", nil); err != nil {
+		t.Fatal(err)
+	}
+	if app.blocker.Enabled() {
+		t.Errorf("blocker should be disabled")
+	}
+	if err := client.Post("/enable", nil); err != nil {
+		t.Fatal(err)
+	}
+	if !app.blocker.Enabled() {
+		t.Errorf("blocker should be enabled")
+	}
+}
+
+func TestControlPause(t *testing.T) {
+	app, client, done := newTestControl(t)
+	defer done()
+
+	if err := client.Post("/pause", url.Values{"duration": {"nothing"}}); err == nil {
+		t.Errorf("invalid duration should return an error")
+	}
+	if err := client.Post("/pause", url.Values{"duration": {"50ms"}}); err != nil {
+		t.Fatal(err)
+	}
+	status, err := client.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Enabled || !status.Paused || status.PausedUntil == nil {
+		t.Errorf("blocker should be paused; got: %+v", status)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if !app.blocker.Enabled() {
+		t.Errorf("blocker should be enabled after the pause")
+	}
+	if status := app.Status(); status.Paused || status.PausedUntil != nil {
+		t.Errorf("pause should be cleared; got: %+v", status)
+	}
+}
+
+func TestPauseStaleTimer(t *testing.T) {
+	app, _, done := newTestControl(t)
+	defer done()
+
+	app.Pause(time.Millisecond)
+	// the timer fires while a new pause holds the lock
+	app.mu.Lock()
+	time.Sleep(50 * time.Millisecond)
+	app.pause(time.Hour)
+	app.mu.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+	if status := app.Status(); status.Enabled || !status.Paused {
+		t.Errorf("stale timer should not end the new pause; got: %+v", status)
+	}
+	app.SetEnabled(false)
+	if status := app.Status(); status.Enabled || status.Paused {
+		t.Errorf("disabling should cancel the pause; got: %+v", status)
+	}
+}
+
+func TestControlPauseUntilRestart(t *testing.T) {
+	app, client, done := newTestControl(t)
+	defer done()
+
+	if err := client.Post("/pause", url.Values{"duration": {"restart"}}); err != nil {
+		t.Fatal(err)
+	}
+	status, err := client.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Enabled || !status.Paused || status.PausedUntil != nil {
+		t.Errorf("blocker should be paused until restart; got: %+v", status)
+	}
+
+	if err := client.Post("/enable", nil); err != nil {
+		t.Fatal(err)
+	}
+	if status := app.Status(); !status.Enabled || status.Paused {
+		t.Errorf("enable should resume blocking; got: %+v", status)
+	}
+}
+
+func TestControlFocus(t *testing.T) {
+	app, client, done := newTestControl(t)
+	defer done()
+
+	if err := client.Post("/focus", url.Values{"enabled": {"maybe"}}); err == nil {
+		t.Errorf("invalid focus value should return an error")
+	}
+	if err := client.Post("/focus", url.Values{"enabled": {"true"}}); err != nil {
+		t.Fatal(err)
+	}
+	if status := app.Status(); !status.Focus {
+		t.Errorf("focus mode should be on; got: %+v", status)
+	}
+	if err := client.Post("/focus", url.Values{"enabled": {"false"}}); err != nil {
+		t.Fatal(err)
+	}
+	if app.blocker.Focus() {
+		t.Errorf("focus mode should be off")
+	}
+}
+
+func TestControlAllow(t *testing.T) {
+	_, client, done := newTestControl(t)
+	defer done()
+
+	if err := client.Post("/allow", nil); err == nil {
+		t.Errorf("missing host should return an error")
+	}
+	if err := client.Post("/allow", url.Values{"host": {"example.com:443"}}); err != nil {
+		t.Fatal(err)
+	}
+	status, err := client.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Allowed) != 1 || status.Allowed[0] != "example.com" {
+		t.Errorf("allowed should be [example.com]; got: %v", status.Allowed)
+	}
+}
+
+func TestControlMethod(t *testing.T) {
+	_, client, done := newTestControl(t)
+	defer done()
+
+	if _, err := client.do(http.MethodGet, "/enable", nil); err == nil {
+		t.Errorf("GET should not be allowed for actions")
+	}
+}
+
+func TestControlEvents(t *testing.T) {
+	app, client, done := newTestControl(t)
+	defer done()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+				app.events.publish(event{query: query{Host: "a.com"}})
+				app.events.publish(event{query: query{Host: "b.com", Blocked: true}})
+			}
+		}
+	}()
+
+	errStop := errors.New("stop")
+	var received query
+	err := client.Events(url.Values{"decision": {"blocked"}}, func(q query) error {
+		received = q
+		return errStop
+	})
+	if err != errStop {
+		t.Fatal(err)
+	}
+	if received.Host != "b.com" {
+		t.Errorf("event should be b.com; got: %v", received.Host)
+	}
+}
+
+func TestControlTemporary(t *testing.T) {
+	app, client, done := newTestControl(t)
+	defer done()
+
+	if err := client.Post("/block", url.Values{"host": {"example.com"}}); err == nil {
+		t.Errorf("missing duration should return an error")
+	}
+	if err := client.Post("/allow", url.Values{"host": {"shop.com:443"}, "duration": {"10m"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Post("/block", url.Values{"host": {"example.com"}, "duration": {"1h"}}); err != nil {
+		t.Fatal(err)
+	}
+	status, err := client.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Temporary) != 2 || status.Temporary[0].Host != "shop.com" || status.Temporary[1].Action != tempBlock {
+		t.Errorf("temporary should be [allow shop.com, block example.com]; got: %v", status.Temporary)
+	}
+	if d := app.blocker.Decide("example.com:443"); !d.Blocked {
+		t.Errorf("example.com should be blocked; got: %+v", d)
+	}
+	if err := client.Post("/remove", url.Values{"host": {"example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Post("/remove", url.Values{"host": {"example.com"}}); err == nil {
+		t.Errorf("removing a missing rule should return an error")
+	}
+}
+
+func TestListenControlMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes do not apply on windows")
+	}
+	dir, err := ioutil.TempDir("", "lycurgus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "control", "lycurgus.sock")
+
+	listener, err := listenControl(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	for file, mode := range map[string]os.FileMode{path: 0600, filepath.Dir(path): 0700} {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != mode {
+			t.Errorf("mode of %v should be %v; got: %v", file, mode, info.Mode().Perm())
+		}
+	}
+	listener.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket should be removed on close; got: %v", err)
+	}
+
+	// an existing directory open to others gets a private socket too
+	path = filepath.Join(dir, "lycurgus.sock")
+	os.Chmod(dir, 0755)
+	listener, err = listenControl(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("mode of %v should be 0600; got: %v %v", path, info, err)
+	}
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("socket should accept connections at its path: %v", err)
+	}
+	conn.Close()
+	if files, _ := ioutil.ReadDir(dir); len(files) != 2 {
+		t.Errorf("no temporary directory should be left; got %d files", len(files))
+	}
+}
@@ -0,0 +1,11 @@
+//+build windows
+
+package main
+
+import "net"
+
+// listenUnix listens on a Unix domain socket, which inherits the access
+// of its directory on Windows.
+func listenUnix(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
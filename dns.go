@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DNS record types and class.
+const (
+	dnsTypeA     = 1
+	dnsTypeCNAME = 5
+	dnsTypeAAAA  = 28
+	dnsClassIN   = 1
+)
+
+// DNS response codes.
+const (
+	dnsRCodeSuccess   = 0
+	dnsRCodeNameError = 3
+)
+
+// dnsTimeout is how long a DNS server is waited for.
+const dnsTimeout = 2 * time.Second
+
+// dnsMessageType is the media type of the DNS over HTTPS messages.
+const dnsMessageType = "application/dns-message"
+
+var (
+	errDNSFormat    = errors.New("invalid DNS message")
+	errDNSMismatch  = errors.New("DNS response does not match the query")
+	errDNSTruncated = errors.New("truncated DNS response")
+)
+
+// dnsRecord is a resource record of a DNS answer. Target is set for the
+// CNAME records and IP for the address records.
+type dnsRecord struct {
+	Name   string
+	Type   uint16
+	TTL    uint32
+	Target string
+	IP     net.IP
+}
+
+// dnsResponse is the answer section and the response code of a response.
+type dnsResponse struct {
+	RCode     int
+	Truncated bool
+	Answers   []dnsRecord
+}
+
+// buildDNSQuery returns a recursive query of a name.
+func buildDNSQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	// recursion desired
+	binary.BigEndian.PutUint16(msg[2:], 0x0100)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	msg, err := appendDNSName(msg, name)
+	if err != nil {
+		return nil, err
+	}
+	msg = append(msg, byte(qtype>>8), byte(qtype), 0, dnsClassIN)
+	return msg, nil
+}
+
+func appendDNSName(msg []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > 253 {
+		return nil, fmt.Errorf("invalid DNS name: %s", name)
+	}
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid DNS name: %s", name)
+			}
+			msg = append(msg, byte(len(label)))
+			msg = append(msg, label...)
+		}
+	}
+	return append(msg, 0), nil
+}
+
+// parseDNSResponse parses the response to the query with id of name.
+func parseDNSResponse(msg []byte, id uint16, name string) (dnsResponse, error) {
+	var resp dnsResponse
+	if len(msg) < 12 {
+		return resp, errDNSFormat
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if binary.BigEndian.Uint16(msg[0:]) != id || flags&0x8000 == 0 {
+		return resp, errDNSMismatch
+	}
+	resp.RCode = int(flags & 0x000f)
+	resp.Truncated = flags&0x0200 != 0
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		qname, next, err := readDNSName(msg, off)
+		if err != nil {
+			return resp, err
+		}
+		if !strings.EqualFold(qname, strings.TrimSuffix(name, ".")) {
+			return resp, errDNSMismatch
+		}
+		off = next + 4
+	}
+	for i := 0; i < ancount; i++ {
+		rname, next, err := readDNSName(msg, off)
+		if err != nil {
+			return resp, err
+		}
+		off = next
+		if off+10 > len(msg) {
+			return resp, errDNSFormat
+		}
+		r := dnsRecord{
+			Name: rname,
+			Type: binary.BigEndian.Uint16(msg[off:]),
+			TTL:  binary.BigEndian.Uint32(msg[off+4:]),
+		}
+		class := binary.BigEndian.Uint16(msg[off+2:])
+		length := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+length > len(msg) {
+			return resp, errDNSFormat
+		}
+		data := msg[off : off+length]
+		if class == dnsClassIN {
+			switch {
+			case r.Type == dnsTypeCNAME:
+				if r.Target, _, err = readDNSName(msg, off); err != nil {
+					return resp, err
+				}
+				resp.Answers = append(resp.Answers, r)
+			case r.Type == dnsTypeA && length == net.IPv4len,
+				r.Type == dnsTypeAAAA && length == net.IPv6len:
+				r.IP = append(net.IP{}, data...)
+				resp.Answers = append(resp.Answers, r)
+			}
+		}
+		off += length
+	}
+	return resp, nil
+}
+
+// readDNSName reads a possibly compressed name at off and returns it
+// with the offset after it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	labels := []string{}
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSFormat
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")), next, nil
+		case length&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 10 {
+				return "", 0, errDNSFormat
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		case length&0xc0 != 0:
+			return "", 0, errDNSFormat
+		default:
+			if off+1+length > len(msg) {
+				return "", 0, errDNSFormat
+			}
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
+
+// dnsTransport sends a DNS query to a server and returns the response.
+type dnsTransport interface {
+	exchange(ctx context.Context, query []byte) ([]byte, error)
+}
+
+// plainDNS sends the queries over UDP and retries the truncated ones
+// over TCP.
+type plainDNS struct {
+	server string
+}
+
+func (t plainDNS) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	resp, err := t.exchangeOver(ctx, "udp", query)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) > 2 && resp[2]&0x02 != 0 {
+		return t.exchangeOver(ctx, "tcp", query)
+	}
+	return resp, nil
+}
+
+func (t plainDNS) exchangeOver(ctx context.Context, network string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, t.server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(dnsTimeout)
+	}
+	conn.SetDeadline(deadline)
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		// the responses with another ID, late answers to an earlier query
+		// or spoofed ones, are dropped until the deadline
+		resp := make([]byte, 4096)
+		for {
+			n, err := conn.Read(resp)
+			if err != nil {
+				return nil, err
+			}
+			if n >= 12 && resp[0] == query[0] && resp[1] == query[1] && resp[2]&0x80 != 0 {
+				return resp[:n], nil
+			}
+		}
+	}
+	return exchangeStream(conn, query)
+}
+
+// exchangeStream exchanges a query over a stream connection with the
+// two byte length prefix of DNS over TCP.
+func exchangeStream(conn io.ReadWriter, query []byte) ([]byte, error) {
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// queryDNS sends a query of a name over a transport and parses the
+// response.
+func queryDNS(ctx context.Context, t dnsTransport, name string, qtype uint16) (dnsResponse, error) {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return dnsResponse{}, err
+	}
+	id := binary.BigEndian.Uint16(b[:])
+	query, err := buildDNSQuery(id, name, qtype)
+	if err != nil {
+		return dnsResponse{}, err
+	}
+	msg, err := t.exchange(ctx, query)
+	if err != nil {
+		return dnsResponse{}, err
+	}
+	resp, err := parseDNSResponse(msg, id, name)
+	if err != nil {
+		return resp, err
+	}
+	if resp.Truncated {
+		return resp, errDNSTruncated
+	}
+	return resp, nil
+}
+
+// tlsDNS sends the queries over DNS over TLS (RFC 7858).
+type tlsDNS struct {
+	server string
+	config *tls.Config
+}
+
+func (t tlsDNS) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	d := &tls.Dialer{Config: t.config}
+	conn, err := d.DialContext(ctx, "tcp", t.server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(dnsTimeout)
+	}
+	conn.SetDeadline(deadline)
+	return exchangeStream(conn, query)
+}
+
+// httpsDNS sends the queries over DNS over HTTPS (RFC 8484).
+type httpsDNS struct {
+	url    string
+	client *http.Client
+}
+
+func (t httpsDNS) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dnsTimeout)
+		defer cancel()
+	}
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS server %s: %s", t.url, resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+}
+
+// dnsServers tries the servers in order until one responds.
+type dnsServers []dnsTransport
+
+func (servers dnsServers) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var err error
+	for _, t := range servers {
+		var resp []byte
+		if resp, err = t.exchange(ctx, query); err == nil {
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
+// newDNSTransport returns the transport of the DNS servers, which are
+// addresses of plain DNS servers (port 53 by default), tls://host[:port]
+// of DNS over TLS servers (port 853 by default) or https:// URLs of DNS
+// over HTTPS servers. Without servers it returns the system DNS server.
+func newDNSTransport(servers []string, proxy string) (dnsTransport, error) {
+	if len(servers) == 0 {
+		server := systemDNSServer()
+		if server == "" {
+			return nil, errors.New("no DNS server found, set the resolvers")
+		}
+		servers = []string{server}
+	}
+	transports := dnsServers{}
+	for _, server := range servers {
+		t, err := parseDNSServer(server, proxy)
+		if err != nil {
+			return nil, err
+		}
+		transports = append(transports, t)
+	}
+	if len(transports) == 1 {
+		return transports[0], nil
+	}
+	return transports, nil
+}
+
+// parseDNSServer returns the transport of a DNS server. The DNS over
+// HTTPS queries go through the upstream proxy if set.
+func parseDNSServer(server, proxy string) (dnsTransport, error) {
+	switch {
+	case strings.HasPrefix(server, "https://"):
+		u, err := url.Parse(server)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid DNS server URL: %s", server)
+		}
+		return httpsDNS{url: server, client: &http.Client{Transport: &http.Transport{
+			Proxy:             upstreamProxy(proxy),
+			ForceAttemptHTTP2: true,
+		}}}, nil
+	case strings.HasPrefix(server, "tls://"):
+		address, err := dnsServerAddress(strings.TrimPrefix(server, "tls://"), "853")
+		if err != nil {
+			return nil, err
+		}
+		host, _, _ := net.SplitHostPort(address)
+		return tlsDNS{server: address, config: &tls.Config{ServerName: host}}, nil
+	case strings.Contains(server, "://"):
+		return nil, fmt.Errorf("invalid DNS server address: %s", server)
+	}
+	address, err := dnsServerAddress(server, "53")
+	if err != nil {
+		return nil, err
+	}
+	return plainDNS{server: address}, nil
+}
+
+// upstreamProxy returns the proxy of the requests like the tunnels use it,
+// the upstream proxy address or else the proxy of the environment.
+func upstreamProxy(proxy string) func(*http.Request) (*url.URL, error) {
+	if proxy == "" {
+		return http.ProxyFromEnvironment
+	}
+	return http.ProxyURL(&url.URL{Scheme: "http", Host: proxy})
+}
+
+// dnsServerAddress adds the default port to a server address.
+func dnsServerAddress(server, port string) (string, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(strings.Trim(server, "[]"), port)
+	}
+	if host, _, err := net.SplitHostPort(server); err != nil || host == "" {
+		return "", fmt.Errorf("invalid DNS server address: %s", server)
+	}
+	return server, nil
+}
+
+// systemDNSServer returns the first name server of /etc/resolv.conf.
+func systemDNSServer() string {
+	content, err := ioutil.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(strings.SplitN(fields[1], "%", 2)[0], "53")
+		}
+	}
+	return ""
+}
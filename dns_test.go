@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// buildDNSResponse answers a query with records or NXDOMAIN without them.
+func buildDNSResponse(t *testing.T, query []byte, answers []dnsRecord) []byte {
+	name, next, err := readDNSName(query, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := uint16(0x8180)
+	if answers == nil {
+		flags |= dnsRCodeNameError
+	}
+	msg := make([]byte, 12)
+	copy(msg, query[:2])
+	binary.BigEndian.PutUint16(msg[2:], flags)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(answers)))
+	msg = append(msg, query[12:next+4]...)
+	for _, r := range answers {
+		if r.Name == "" {
+			r.Name = name
+		}
+		if msg, err = appendDNSName(msg, r.Name); err != nil {
+			t.Fatal(err)
+		}
+		var data []byte
+		switch r.Type {
+		case dnsTypeCNAME:
+			data, _ = appendDNSName(nil, r.Target)
+		case dnsTypeA:
+			data = r.IP.To4()
+		default:
+			data = r.IP.To16()
+		}
+		var header [10]byte
+		binary.BigEndian.PutUint16(header[0:], r.Type)
+		binary.BigEndian.PutUint16(header[2:], dnsClassIN)
+		binary.BigEndian.PutUint32(header[4:], r.TTL)
+		binary.BigEndian.PutUint16(header[8:], uint16(len(data)))
+		msg = append(append(msg, header[:]...), data...)
+	}
+	return msg
+}
+
+// startDNSServer starts a stand-in DNS server answering the names with
+// the records and returns its address and query counter.
+func startDNSServer(t *testing.T, records map[string][]dnsRecord) (string, func() int) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	queries := make(chan struct{}, 100)
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			queries <- struct{}{}
+			name, next, err := readDNSName(buf[:n], 12)
+			if err != nil || next+2 > n {
+				continue
+			}
+			qtype := binary.BigEndian.Uint16(buf[next:])
+			var answers []dnsRecord
+			if rs, ok := records[name]; ok {
+				answers = []dnsRecord{}
+				for _, r := range rs {
+					if r.Type == dnsTypeCNAME || r.Type == qtype {
+						answers = append(answers, r)
+					}
+				}
+			}
+			conn.WriteTo(buildDNSResponse(t, buf[:n], answers), addr)
+		}
+	}()
+	return conn.LocalAddr().String(), func() int { return len(queries) }
+}
+
+func TestParseDNSResponse(t *testing.T) {
+	query, err := buildDNSQuery(0x1234, "metrics.shop.com.", dnsTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := buildDNSResponse(t, query, []dnsRecord{
+		{Type: dnsTypeCNAME, TTL: 300, Target: "shop.tracker.com"},
+		{Name: "shop.tracker.com", Type: dnsTypeA, TTL: 60, IP: net.ParseIP("203.0.113.7")},
+	})
+
+	r, err := parseDNSResponse(resp, 0x1234, "metrics.shop.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answers) != 2 || r.Answers[0].Target != "shop.tracker.com" || !r.Answers[1].IP.Equal(net.ParseIP("203.0.113.7")) {
+		t.Errorf("answers should be the CNAME and the address; got: %+v", r.Answers)
+	}
+	if _, err := parseDNSResponse(resp, 0x4321, "metrics.shop.com"); err != errDNSMismatch {
+		t.Errorf("error of another id should be %v; got: %v", errDNSMismatch, err)
+	}
+	if _, err := parseDNSResponse(resp, 0x1234, "other.com"); err != errDNSMismatch {
+		t.Errorf("error of another name should be %v; got: %v", errDNSMismatch, err)
+	}
+	if _, err := parseDNSResponse(resp[:len(resp)-3], 0x1234, "metrics.shop.com"); err != errDNSFormat {
+		t.Errorf("error of a short message should be %v; got: %v", errDNSFormat, err)
+	}
+
+	// the answer name points to the question name
+	compressed := append([]byte{}, query...)
+	compressed[2] |= 0x80
+	compressed[7] = 1
+	compressed = append(compressed, 0xc0, 12, 0, dnsTypeCNAME, 0, dnsClassIN, 0, 0, 0, 60, 0, 6,
+		3, 'c', 'd', 'n', 0xc0, 12+8)
+	r, err = parseDNSResponse(compressed, 0x1234, "metrics.shop.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answers) != 1 || r.Answers[0].Name != "metrics.shop.com" || r.Answers[0].Target != "cdn.shop.com" {
+		t.Errorf("compressed answer should be metrics.shop.com CNAME cdn.shop.com; got: %+v", r.Answers)
+	}
+}
+
+func TestBuildDNSQuery(t *testing.T) {
+	for _, name := range []string{"a..com", string(make([]byte, 64)) + ".com"} {
+		if _, err := buildDNSQuery(1, name, dnsTypeA); err == nil {
+			t.Errorf("query of %q should fail", name)
+		}
+	}
+}
+
+func TestQueryDNS(t *testing.T) {
+	server, _ := startDNSServer(t, map[string][]dnsRecord{
+		"example.com": {{Type: dnsTypeA, TTL: 60, IP: net.ParseIP("203.0.113.1")}},
+	})
+	transport := plainDNS{server: server}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	r, err := queryDNS(ctx, transport, "example.com", dnsTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.RCode != dnsRCodeSuccess || len(r.Answers) != 1 {
+		t.Errorf("answers should be one address; got: %+v", r)
+	}
+	r, err = queryDNS(ctx, transport, "missing.example.com", dnsTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.RCode != dnsRCodeNameError || len(r.Answers) != 0 {
+		t.Errorf("response should be NXDOMAIN; got: %+v", r)
+	}
+}
+
+func TestEncryptedDNS(t *testing.T) {
+	records := map[string][]dnsRecord{
+		"example.com": {{Type: dnsTypeA, TTL: 60, IP: net.ParseIP("203.0.113.1")}},
+	}
+	answer := func(query []byte) []byte {
+		name, _, err := readDNSName(query, 12)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buildDNSResponse(t, query, records[name])
+	}
+
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dnsMessageType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		query, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", dnsMessageType)
+		w.Write(answer(query))
+	}))
+	defer doh.Close()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: doh.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				resp := answer(query)
+				binary.BigEndian.PutUint16(length[:], uint16(len(resp)))
+				conn.Write(append(length[:], resp...))
+			}()
+		}
+	}()
+
+	roots := doh.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	transports := map[string]dnsTransport{
+		"tls":   tlsDNS{server: listener.Addr().String(), config: &tls.Config{RootCAs: roots, ServerName: "example.com"}},
+		"https": httpsDNS{url: doh.URL + "/dns-query", client: doh.Client()},
+		// the first server fails
+		"servers": dnsServers{plainDNS{server: "127.0.0.1:1"}, httpsDNS{url: doh.URL + "/dns-query", client: doh.Client()}},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for name, transport := range transports {
+		r, err := queryDNS(ctx, transport, "example.com", dnsTypeA)
+		if err != nil {
+			t.Errorf("%v query should not fail; got: %v", name, err)
+			continue
+		}
+		if len(r.Answers) != 1 || !r.Answers[0].IP.Equal(net.ParseIP("203.0.113.1")) {
+			t.Errorf("%v answers should be 203.0.113.1; got: %+v", name, r.Answers)
+		}
+	}
+}
+
+func TestParseDNSServer(t *testing.T) {
+	tt := []struct {
+		server, expected string
+	}{
+		{"192.0.2.53", "192.0.2.53:53"},
+		{"192.0.2.53:5353", "192.0.2.53:5353"},
+		{"2001:db8::53", "[2001:db8::53]:53"},
+		{"[2001:db8::53]", "[2001:db8::53]:53"},
+		{"dns.example.com", "dns.example.com:53"},
+		{"tls://dns.example.com", "tls dns.example.com:853"},
+		{"tls://192.0.2.53:8853", "tls 192.0.2.53:8853"},
+		{"https://dns.example.com/dns-query", "https https://dns.example.com/dns-query"},
+		{"udp://192.0.2.53", ""},
+		{"https://", ""},
+		{"tls://", ""},
+	}
+	for _, tc := range tt {
+		transport, err := parseDNSServer(tc.server, "")
+		if tc.expected == "" {
+			if err == nil {
+				t.Errorf("server %v should fail", tc.server)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("server %v should not fail; got: %v", tc.server, err)
+			continue
+		}
+		server := ""
+		switch transport := transport.(type) {
+		case plainDNS:
+			server = transport.server
+		case tlsDNS:
+			server = "tls " + transport.server
+		case httpsDNS:
+			server = "https " + transport.url
+		}
+		if server != tc.expected {
+			t.Errorf("server of %v should be %v; got: %v", tc.server, tc.expected, server)
+		}
+	}
+
+	// the DNS over HTTPS queries go through the upstream proxy
+	transport, err := parseDNSServer("https://dns.example.com/dns-query", "127.0.0.1:3128")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodPost, "https://dns.example.com/dns-query", nil)
+	proxy, err := transport.(httpsDNS).client.Transport.(*http.Transport).Proxy(req)
+	if err != nil || proxy == nil || proxy.Host != "127.0.0.1:3128" {
+		t.Errorf("proxy should be 127.0.0.1:3128; got: %v %v", proxy, err)
+	}
+
+	transport, err = newDNSTransport([]string{"192.0.2.53", "tls://192.0.2.54"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if servers, ok := transport.(dnsServers); !ok || len(servers) != 2 {
+		t.Errorf("transport should be 2 servers; got: %#v", transport)
+	}
+}
+
+func TestPlainDNSMismatchedID(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 512)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		resp := buildDNSResponse(t, buf[:n], []dnsRecord{{Type: dnsTypeA, TTL: 60, IP: net.ParseIP("203.0.113.7")}})
+		// a reply to another query comes first
+		spoofed := append([]byte{}, resp...)
+		spoofed[0] ^= 0xff
+		conn.WriteTo(spoofed, addr)
+		conn.WriteTo(resp, addr)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resp, err := queryDNS(ctx, plainDNS{server: conn.LocalAddr().String()}, "a.example.com", dnsTypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answers) != 1 || !resp.Answers[0].IP.Equal(net.ParseIP("203.0.113.7")) {
+		t.Errorf("answer should be 203.0.113.7; got: %+v", resp.Answers)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultEventBuffer is the number of events a subscriber can fall behind
+// before events are dropped for it.
+const defaultEventBuffer = 100
+
+// eventKeepAlive is the interval of the comments keeping idle streams open.
+const eventKeepAlive = 15 * time.Second
+
+// event is a decision of the blocker published on the event bus.
+type event struct {
+	query
+	// Elapsed is the time taken to decide
+	Elapsed time.Duration `json:"-"`
+}
+
+// eventBus delivers the decisions of the blocker to its consumers.
+// Handlers are called synchronously and see every event, subscribers
+// receive the events on a buffered channel and miss them when they
+// fall behind.
+type eventBus struct {
+	mu          sync.RWMutex
+	handlers    []func(event)
+	subscribers map[chan event]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		subscribers: make(map[chan event]struct{}),
+	}
+}
+
+// handle registers a handler called for every event.
+func (b *eventBus) handle(h func(event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, h)
+}
+
+// subscribe returns a channel receiving the events and a function
+// that cancels the subscription.
+func (b *eventBus) subscribe(size int) (<-chan event, func()) {
+	ch := make(chan event, size)
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// publish delivers an event to the handlers and the subscribers.
+func (b *eventBus) publish(e event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, h := range b.handlers {
+		h(e)
+	}
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+			// drop the event for a slow subscriber
+		}
+	}
+}
+
+// serveEvents streams the events matching the filter as Server-Sent Events
+// until the client goes away.
+func serveEvents(w http.ResponseWriter, r *http.Request, bus *eventBus, f queryFilter) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	events, cancel := bus.subscribe(defaultEventBuffer)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e := <-events:
+			if !f.match(e.query) {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: decision\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventBus(t *testing.T) {
+	bus := newEventBus()
+	handled := []string{}
+	bus.handle(func(e event) {
+		handled = append(handled, e.Host)
+	})
+	events, cancel := bus.subscribe(1)
+
+	bus.publish(event{query: query{Host: "a.com"}})
+	// dropped for the subscriber
+	bus.publish(event{query: query{Host: "b.com"}})
+
+	if strings.Join(handled, ",") != "a.com,b.com" {
+		t.Errorf("handled events should be [a.com b.com]; got: %v", handled)
+	}
+	if e := <-events; e.Host != "a.com" {
+		t.Errorf("subscribed event should be a.com; got: %v", e.Host)
+	}
+
+	cancel()
+	cancel()
+	if _, ok := <-events; ok {
+		t.Errorf("events should be closed after cancel")
+	}
+	bus.publish(event{query: query{Host: "c.com"}})
+}
+
+func TestBlockerEvents(t *testing.T) {
+	bus := newEventBus()
+	var published event
+	bus.handle(func(e event) {
+		published = e
+	})
+	blocker := NewBlocker(WithBlockerEnabled(true), WithBlockerEvents(bus))
+	blocker.SetBlacklist(&blacklistMatcher{})
+
+	blocker.handleConnect("blacklist.com", nil)
+	if published.Host != "blacklist.com" || !published.Blocked || published.Stage != stageBlacklist {
+		t.Errorf("published event should be blocked blacklist.com; got: %+v", published.query)
+	}
+}
+
+func TestServeEvents(t *testing.T) {
+	bus := newEventBus()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveEvents(w, r, bus, queryFilter{Decision: "blocked"})
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("content type should be text/event-stream; got: %v", ct)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// the subscription starts after the response headers are sent
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+				bus.publish(event{query: query{Host: "allowed.com"}})
+				bus.publish(event{query: query{Host: "blocked.com", Blocked: true}})
+			}
+		}
+	}()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		if !strings.Contains(line, `"host":"blocked.com"`) {
+			t.Errorf("event should be blocked.com; got: %v", line)
+		}
+		break
+	}
+}
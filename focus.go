@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/elazarl/goproxy.v1"
+)
+
+// listFocuslist is the rule list allowed in focus mode.
+const listFocuslist = "focuslist"
+
+// maxAccessRequests is the number of pending access requests kept.
+const maxAccessRequests = 100
+
+// accessPath is the path of the access request page on the proxy address.
+const accessPath = "/access"
+
+// maxAccessReason is the length of the reason kept with an access request.
+const maxAccessReason = 200
+
+// accessRate is the number of access requests a client may send
+// in accessWindow.
+const (
+	accessRate   = 5
+	accessWindow = time.Minute
+)
+
+// accessRequest asks to allow a host blocked in focus mode.
+type accessRequest struct {
+	Host   string    `json:"host"`
+	Client string    `json:"client"`
+	Reason string    `json:"reason,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+func (r accessRequest) String() string {
+	if r.Reason == "" {
+		return fmt.Sprintf("%s by %s", r.Host, r.Client)
+	}
+	return fmt.Sprintf("%s by %s: %s", r.Host, r.Client, r.Reason)
+}
+
+// accessRequests holds the pending access requests by host.
+type accessRequests struct {
+	mu       sync.Mutex
+	requests map[string]accessRequest
+}
+
+func newAccessRequests() *accessRequests {
+	return &accessRequests{requests: make(map[string]accessRequest)}
+}
+
+// add adds or replaces the request of a host. It drops the oldest
+// request if there are too many.
+func (a *accessRequests) add(r accessRequest) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.requests[r.Host] = r
+	if len(a.requests) <= maxAccessRequests {
+		return
+	}
+	oldest := r
+	for _, req := range a.requests {
+		if req.Time.Before(oldest.Time) {
+			oldest = req
+		}
+	}
+	delete(a.requests, oldest.Host)
+}
+
+// remove removes the request of a host and reports whether it existed.
+func (a *accessRequests) remove(host string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.requests[host]
+	delete(a.requests, host)
+	return ok
+}
+
+// list returns the requests, the oldest first.
+func (a *accessRequests) list() []accessRequest {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	requests := []accessRequest{}
+	for _, r := range a.requests {
+		requests = append(requests, r)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].Time.Before(requests[j].Time)
+	})
+	return requests
+}
+
+// accessLimiter limits the access requests of each client.
+type accessLimiter struct {
+	mu    sync.Mutex
+	times map[string][]time.Time
+}
+
+func newAccessLimiter() *accessLimiter {
+	return &accessLimiter{times: make(map[string][]time.Time)}
+}
+
+// allow reports whether a client may send an access request now and
+// counts it if so.
+func (l *accessLimiter) allow(client string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	recent := []time.Time{}
+	for _, t := range l.times[client] {
+		if now.Sub(t) < accessWindow {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= accessRate {
+		l.times[client] = recent
+		return false
+	}
+	l.times[client] = append(recent, now)
+	// forget the clients without recent requests
+	if len(l.times) > maxAccessRequests {
+		for c, times := range l.times {
+			if now.Sub(times[len(times)-1]) >= accessWindow {
+				delete(l.times, c)
+			}
+		}
+	}
+	return true
+}
+
+// accessToken returns the token of the access form of a host for
+// a client, so only the access page can post the form.
+func (b *Blocker) accessToken(host, client string) string {
+	mac := hmac.New(sha256.New, b.accessKey)
+	mac.Write([]byte(host + "\n" + client))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sameOrigin reports whether a request comes from a page of the proxy
+// address itself, as far as its Origin header tells.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+var blockPage = template.Must(template.New("blocked").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>Blocked by Lycurgus</title></head>
+<body>
+  <h1>{{.Host}} is blocked</h1>
+  {{if .Focus}}<p>Lycurgus is in focus mode and only allows the whitelisted and focus list hosts.</p>{{else}}<p>Blocked by the {{.Stage}}{{with .Rule}} rule <code>{{.}}</code>{{end}}{{with .CNAME}} of its CNAME <code>{{.}}</code>{{end}}.</p>{{end}}
+  {{with .AccessURL}}<p><a href="{{.}}">Request access</a></p>{{end}}
+</body>
+</html>
+`))
+
+var accessPage = template.Must(template.New("access").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>Request access</title></head>
+<body>
+  {{if .Requested}}<h1>Access to {{.Host}} requested</h1>
+  <p>The request waits for approval. Reload the page once it is allowed.</p>
+  {{else}}<h1>Request access to {{.Host}}</h1>
+  <form method="post">
+    <input type="hidden" name="host" value="{{.Host}}">
+    <input type="hidden" name="token" value="{{.Token}}">
+    <label>Reason <input name="reason" maxlength="{{.MaxReason}}"></label>
+    <button type="submit">Request access</button>
+  </form>{{end}}
+</body>
+</html>
+`))
+
+// accessURL returns the URL of the access request page of a host on the
+// proxy address the request came in on.
+func accessURL(req *http.Request, host string) string {
+	if req == nil {
+		return ""
+	}
+	addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return ""
+	}
+	u := url.URL{
+		Scheme:   "http",
+		Host:     addr.String(),
+		Path:     accessPath,
+		RawQuery: url.Values{"host": {stripPort(host)}}.Encode(),
+	}
+	return u.String()
+}
+
+// blockResponse returns the response to a blocked request. Tunnels get
+// a plain text reason since browsers do not show it, so its access link
+// is only seen by other clients; plain HTTP requests get the block page.
+func blockResponse(req *http.Request, d Decision) *http.Response {
+	link := ""
+	if d.Stage == stageFocus {
+		link = accessURL(req, d.Host)
+	}
+	if req.Method == http.MethodConnect {
+		text := fmt.Sprintf("Blocked by Lycurgus (%s): %s\n", d.Stage, stripPort(d.Host))
+		if d.CNAME != "" {
+			text = fmt.Sprintf("Blocked by Lycurgus (%s): %s (CNAME %s)\n", d.Stage, stripPort(d.Host), d.CNAME)
+		}
+		if d.Stage == stagePort {
+			text = fmt.Sprintf("Blocked by Lycurgus (%s): %s is not in the allowed ports (%s)\n", d.Stage, d.Host, d.Rule)
+		}
+		if link != "" {
+			text += "Request access: " + link + "\n"
+		}
+		return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, text)
+	}
+	var page bytes.Buffer
+	err := blockPage.Execute(&page, struct {
+		Host, Stage, Rule, CNAME, AccessURL string
+		Focus                               bool
+	}{stripPort(d.Host), d.Stage, d.Rule, d.CNAME, link, d.Stage == stageFocus})
+	if err != nil {
+		log.Println("Error writing block page: ", err)
+	}
+	return goproxy.NewResponse(req, goproxy.ContentTypeHtml, http.StatusForbidden, page.String())
+}
+
+// serveAccess serves the access request page on the proxy address. With
+// proxy authentication on, the page asks for the same credentials unless
+// it is requested through the proxy. The form can only be posted from the
+// page and a few times a minute.
+func (b *Blocker) serveAccess(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != accessPath {
+		http.Error(w, "This is a proxy server. Does not respond to non-proxy requests.", http.StatusInternalServerError)
+		return
+	}
+	client := stripPort(r.RemoteAddr)
+	if b.auth != nil {
+		user, password, ok := r.BasicAuth()
+		if !ok || !b.auth.verify(user, password, client) {
+			b.rejects.log("Access", "invalid credentials", client)
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", proxyRealm))
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+	}
+	b.handleAccess(w, r, client)
+}
+
+// isAccessRequest reports whether a proxied request asks for the access
+// page of the listener that received it, as linked from the block page.
+func isAccessRequest(req *http.Request) bool {
+	addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && req.URL.Path == accessPath && strings.EqualFold(req.URL.Host, addr.String())
+}
+
+// serveProxiedAccess answers a proxied access page request, whose client was
+// already authorized as a proxy client.
+func (b *Blocker) serveProxiedAccess(req *http.Request, c client) *http.Response {
+	w := httptest.NewRecorder()
+	b.handleAccess(w, req, c.Address)
+	return w.Result()
+}
+
+// handleAccess shows the access request form of a host and records the
+// submitted requests of the client.
+func (b *Blocker) handleAccess(w http.ResponseWriter, r *http.Request, client string) {
+	host := strings.ToLower(stripPort(strings.TrimSpace(r.FormValue("host"))))
+	if !domainPattern.MatchString(host) {
+		http.Error(w, "invalid host", http.StatusBadRequest)
+		return
+	}
+	token := b.accessToken(host, client)
+	requested := false
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !sameOrigin(r) || !hmac.Equal([]byte(r.PostFormValue("token")), []byte(token)) {
+			http.Error(w, "invalid access request", http.StatusForbidden)
+			return
+		}
+		if !b.accessLimits.allow(client, time.Now()) {
+			http.Error(w, "too many access requests", http.StatusTooManyRequests)
+			return
+		}
+		reason := strings.TrimSpace(r.FormValue("reason"))
+		if len(reason) > maxAccessReason {
+			reason = reason[:maxAccessReason]
+		}
+		if b.requestAccess != nil {
+			b.requestAccess(accessRequest{
+				Host:   host,
+				Client: client,
+				Reason: reason,
+				Time:   time.Now(),
+			})
+		}
+		requested = true
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := accessPage.Execute(w, struct {
+		Host, Token string
+		Requested   bool
+		MaxReason   int
+	}{host, token, requested, maxAccessReason}); err != nil {
+		log.Println("Error writing access page: ", err)
+	}
+}
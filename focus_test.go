@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessRequests(t *testing.T) {
+	a := newAccessRequests()
+	now := time.Now()
+	a.add(accessRequest{Host: "news.com", Client: "10.0.0.2", Time: now.Add(time.Minute)})
+	a.add(accessRequest{Host: "docs.com", Client: "10.0.0.3", Time: now})
+
+	requests := a.list()
+	if len(requests) != 2 || requests[0].Host != "docs.com" {
+		t.Errorf("requests should be [docs.com news.com]; got: %v", requests)
+	}
+	if !a.remove("docs.com") || a.remove("docs.com") {
+		t.Errorf("remove should report the removed request once")
+	}
+	a.remove("news.com")
+
+	for i := 0; i < maxAccessRequests+1; i++ {
+		a.add(accessRequest{Host: strings.Repeat("a", i+1) + ".com", Time: now.Add(time.Duration(i) * time.Second)})
+	}
+	requests = a.list()
+	if len(requests) != maxAccessRequests {
+		t.Errorf("requests should be limited to %v; got: %v", maxAccessRequests, len(requests))
+	}
+	if requests[0].Host != "aa.com" {
+		t.Errorf("the oldest request should be dropped; got: %v", requests[0])
+	}
+}
+
+func TestBlockResponse(t *testing.T) {
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5678}
+	ctx := context.WithValue(context.Background(), http.LocalAddrContextKey, local)
+	link := "http://127.0.0.1:5678/access?host=news.com"
+
+	connect, _ := http.NewRequestWithContext(ctx, http.MethodConnect, "http://news.com:443", nil)
+	resp := blockResponse(connect, Decision{Host: "news.com:443", Blocked: true, Stage: stageFocus})
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(string(body), "Request access: "+link) {
+		t.Errorf("tunnel response should name the access page; got: %v %q", resp.StatusCode, body)
+	}
+
+	get, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://news.com/", nil)
+	resp = blockResponse(get, Decision{Host: "news.com", Blocked: true, Stage: stageFocus})
+	body, _ = ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(body), `href="`+link) {
+		t.Errorf("block page should link the access page; got: %s", body)
+	}
+
+	resp = blockResponse(get, Decision{Host: "news.com", Blocked: true, Stage: stageBlacklist, Rule: "news.com"})
+	body, _ = ioutil.ReadAll(resp.Body)
+	if strings.Contains(string(body), "Request access") || !strings.Contains(string(body), "blacklist") {
+		t.Errorf("block page should name the stage without access link; got: %s", body)
+	}
+}
+
+func TestServeAccess(t *testing.T) {
+	var requested []accessRequest
+	blocker := NewBlocker(WithBlockerAccess(func(r accessRequest) {
+		requested = append(requested, r)
+	}))
+	server := httptest.NewServer(blocker)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/access?host=News.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `value="news.com"`) {
+		t.Errorf("access page should have a form for news.com; got: %v %s", resp.StatusCode, body)
+	}
+
+	token := blocker.accessToken("news.com", "127.0.0.1")
+	if !strings.Contains(string(body), `value="`+token+`"`) {
+		t.Errorf("access page should have the form token; got: %s", body)
+	}
+
+	// the form is only accepted with the token of the page
+	resp, err = http.PostForm(server.URL+"/access", url.Values{"host": {"news.com"}, "reason": {"forged"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || len(requested) != 0 {
+		t.Errorf("access request without token should be forbidden; got: %v %+v", resp.StatusCode, requested)
+	}
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/access",
+		strings.NewReader(url.Values{"host": {"news.com"}, "token": {token}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", "http://evil.com")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || len(requested) != 0 {
+		t.Errorf("cross-origin access request should be forbidden; got: %v %+v", resp.StatusCode, requested)
+	}
+
+	resp, err = http.PostForm(server.URL+"/access", url.Values{"host": {"news.com"}, "reason": {"research"}, "token": {token}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(requested) != 1 || requested[0].Host != "news.com" || requested[0].Reason != "research" || requested[0].Client != "127.0.0.1" {
+		t.Errorf("access should be requested for news.com; got: %+v", requested)
+	}
+
+	// the requests of a client are limited
+	for i := 1; i < accessRate; i++ {
+		resp, _ = http.PostForm(server.URL+"/access", url.Values{"host": {"news.com"}, "token": {token}})
+		resp.Body.Close()
+	}
+	resp, err = http.PostForm(server.URL+"/access", url.Values{"host": {"news.com"}, "token": {token}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || len(requested) != accessRate {
+		t.Errorf("access requests over the limit should be refused; got: %v %d", resp.StatusCode, len(requested))
+	}
+
+	resp, err = http.Get(server.URL + "/access?host=a%20b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid host status should be %v; got: %v", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestServeAccessAuth(t *testing.T) {
+	hash, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := newProxyAuth([]proxyUser{{Name: "alice", Password: hash}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocker := NewBlocker(WithBlockerAuth(auth))
+	server := httptest.NewServer(blocker)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/access?host=news.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("access page should ask for credentials; got: %v", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/access?host=news.com", nil)
+	req.SetBasicAuth("alice", "secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("access page should be served with valid credentials; got: %v", resp.StatusCode)
+	}
+}
+
+func TestProxiedAccess(t *testing.T) {
+	var requested []accessRequest
+	blocker := NewBlocker(WithBlockerEnabled(true), WithBlockerFocus(true), WithBlockerAccess(func(r accessRequest) {
+		requested = append(requested, r)
+	}))
+	blocker.SetFocuslist(&blacklistMatcher{})
+	proxy := httptest.NewServer(blocker)
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	resp, err := client.Get("http://news.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	link := proxy.URL + "/access?host=news.com"
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(string(body), `href="`+link) {
+		t.Fatalf("block page should link the access page; got: %v %s", resp.StatusCode, body)
+	}
+
+	// the browser follows the link through the proxy, past focus mode
+	resp, err = client.Get(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `value="news.com"`) {
+		t.Fatalf("access page should be served through the proxy; got: %v %s", resp.StatusCode, body)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/access",
+		strings.NewReader(url.Values{"host": {"news.com"}, "token": {blocker.accessToken("news.com", "127.0.0.1")}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", proxy.URL)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(requested) != 1 || requested[0].Host != "news.com" {
+		t.Errorf("access should be requested through the proxy; got: %v %+v", resp.StatusCode, requested)
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/kszab0/lycurgus
 
-go 1.14
+go 1.16
 
 require (
 	github.com/BurntSushi/toml v0.3.1 // indirect
@@ -1,13 +1,34 @@
 package main
 
 import (
+	"fmt"
+	"sync"
+	"time"
+
 	"github.com/getlantern/systray"
 )
 
 // GUI is a tray ui for the application
 type GUI struct {
+	mu        sync.Mutex
 	enabled   bool
 	autostart bool
+	dashboard bool
+	// paused is set while blocking is paused until pausedUntil, or until
+	// restart if pausedUntil is zero
+	paused      bool
+	pausedUntil time.Time
+	// lastBlocked is the last blocked host
+	lastBlocked string
+	// invalidRules is the number of invalid rules in the rule lists
+	invalidRules int
+	// temporary is the number of temporary rules
+	temporary int
+	focus     bool
+	// accessRequests is the number of pending access requests
+	accessRequests int
+	// budgets returns the usage of the time budgets
+	budgets func() []budgetStatus
 
 	title   string
 	tooltip string
@@ -17,7 +38,13 @@ type GUI struct {
 	EnabledCh   chan bool
 	AutostartCh chan bool
 
-	UpdateCh chan struct{}
+	UpdateCh    chan struct{}
+	DashboardCh chan struct{}
+	// AllowCh receives the hosts to allow for guiAllowDuration
+	AllowCh chan string
+	// PauseCh receives the pause durations, zero pauses until restart
+	PauseCh chan time.Duration
+	FocusCh chan bool
 
 	QuitCh chan struct{}
 }
@@ -25,12 +52,39 @@ type GUI struct {
 type menu struct {
 	enabled         *systray.MenuItem
 	enabledAction   *systray.MenuItem
+	pause           *systray.MenuItem
+	focus           *systray.MenuItem
+	accessRequests  *systray.MenuItem
+	lastBlocked     *systray.MenuItem
+	allowBlocked    *systray.MenuItem
+	temporary       *systray.MenuItem
+	invalidRules    *systray.MenuItem
+	budgets         []*systray.MenuItem
 	autostart       *systray.MenuItem
 	autostartAction *systray.MenuItem
 	update          *systray.MenuItem
+	dashboard       *systray.MenuItem
 	quit            *systray.MenuItem
 }
 
+// guiAllowDuration is how long the tray allows the last blocked host.
+const guiAllowDuration = 10 * time.Minute
+
+// guiPauses are the pauses offered by the tray.
+var guiPauses = []struct {
+	title    string
+	duration time.Duration
+}{
+	{"For 5 minutes", 5 * time.Minute},
+	{"For 30 minutes", 30 * time.Minute},
+	{"For 1 hour", time.Hour},
+	{"Until restart", 0},
+}
+
+// guiRefresh is how often the tray updates the remaining pause and
+// budget time.
+const guiRefresh = 15 * time.Second
+
 // GUIOption is a functional option for configuring the GUI
 type GUIOption func(*GUI)
 
@@ -48,6 +102,20 @@ func WithGUIAutostart(enabled bool) GUIOption {
 	}
 }
 
+// WithGUIDashboard sets whether the GUI can open the dashboard
+func WithGUIDashboard(enabled bool) GUIOption {
+	return func(gui *GUI) {
+		gui.dashboard = enabled
+	}
+}
+
+// WithGUIBudgets sets the function returning the usage of the time budgets
+func WithGUIBudgets(budgets func() []budgetStatus) GUIOption {
+	return func(gui *GUI) {
+		gui.budgets = budgets
+	}
+}
+
 // NewGUI creates and initializes the GUI
 func NewGUI(opts ...GUIOption) (*GUI, error) {
 	gui := &GUI{
@@ -60,8 +128,12 @@ func NewGUI(opts ...GUIOption) (*GUI, error) {
 		menu:    &menu{},
 
 		EnabledCh:   make(chan bool),
+		PauseCh:     make(chan time.Duration),
+		FocusCh:     make(chan bool),
 		AutostartCh: make(chan bool),
 		UpdateCh:    make(chan struct{}),
+		DashboardCh: make(chan struct{}),
+		AllowCh:     make(chan string),
 		QuitCh:      make(chan struct{}),
 	}
 
@@ -90,7 +162,41 @@ func (gui *GUI) init() {
 	gui.menu.enabled = systray.AddMenuItem("Enabled", "")
 	gui.menu.enabled.Disable()
 	gui.menu.enabledAction = systray.AddMenuItem("Disable", "")
+	gui.menu.pause = systray.AddMenuItem("Pause Lycurgus", "Blocking resumes automatically")
+	for _, p := range guiPauses {
+		item := gui.menu.pause.AddSubMenuItem(p.title, "")
+		go func(d time.Duration) {
+			for range item.ClickedCh {
+				gui.PauseCh <- d
+			}
+		}(p.duration)
+	}
+	gui.menu.focus = systray.AddMenuItem("", "Block everything except the whitelist and the focus list")
+	gui.mu.Lock()
 	gui.setEnabled()
+	gui.setFocus()
+	gui.menu.lastBlocked = systray.AddMenuItem("", "")
+	gui.menu.lastBlocked.Disable()
+	gui.menu.allowBlocked = systray.AddMenuItem("", "Allow the last blocked host and its subdomains")
+	gui.setLastBlocked()
+	gui.menu.temporary = systray.AddMenuItem("", "See ctl status or the dashboard")
+	gui.menu.temporary.Disable()
+	gui.setTemporary()
+	gui.menu.accessRequests = systray.AddMenuItem("", "See ctl status or the dashboard")
+	gui.menu.accessRequests.Disable()
+	gui.setAccessRequests()
+	gui.menu.invalidRules = systray.AddMenuItem("", "Invalid rules are skipped, see the log or the dashboard")
+	gui.menu.invalidRules.Disable()
+	gui.setInvalidRules()
+	gui.mu.Unlock()
+	if gui.budgets != nil {
+		for range gui.budgets() {
+			item := systray.AddMenuItem("", "Time left today")
+			item.Disable()
+			gui.menu.budgets = append(gui.menu.budgets, item)
+		}
+		gui.setBudgets()
+	}
 	systray.AddSeparator()
 
 	gui.menu.autostart = systray.AddMenuItem("Autostart enabled", "")
@@ -100,6 +206,10 @@ func (gui *GUI) init() {
 	systray.AddSeparator()
 
 	gui.menu.update = systray.AddMenuItem("Update lists", "")
+	gui.menu.dashboard = systray.AddMenuItem("Open dashboard", "")
+	if !gui.dashboard {
+		gui.menu.dashboard.Hide()
+	}
 	systray.AddSeparator()
 
 	gui.menu.quit = systray.AddMenuItem("Quit", "")
@@ -115,29 +225,207 @@ func (gui *GUI) setAutostart() {
 	}
 }
 
+// SetEnabled updates the enabled state shown by the GUI
+func (gui *GUI) SetEnabled(enabled bool) {
+	gui.mu.Lock()
+	defer gui.mu.Unlock()
+	gui.enabled = enabled
+	if gui.menu.enabled != nil {
+		gui.setEnabled()
+	}
+}
+
+// SetPaused updates the pause shown by the GUI
+func (gui *GUI) SetPaused(paused bool, until time.Time) {
+	gui.mu.Lock()
+	defer gui.mu.Unlock()
+	gui.paused = paused
+	gui.pausedUntil = until
+	if gui.menu.enabled != nil {
+		gui.setEnabled()
+	}
+}
+
 func (gui *GUI) setEnabled() {
-	if gui.enabled {
+	switch {
+	case gui.enabled:
 		gui.menu.enabled.SetTitle("Lycurgus is Enabled")
 		gui.menu.enabledAction.SetTitle("Disable Lycurgus")
-	} else {
+		gui.menu.pause.Show()
+	case gui.paused && gui.pausedUntil.IsZero():
+		gui.menu.enabled.SetTitle("Lycurgus is Paused until restart")
+		gui.menu.enabledAction.SetTitle("Resume Lycurgus")
+		gui.menu.pause.Hide()
+	case gui.paused:
+		gui.menu.enabled.SetTitle("Lycurgus is Paused, " + formatRemaining(time.Until(gui.pausedUntil)) + " left")
+		gui.menu.enabledAction.SetTitle("Resume Lycurgus")
+		gui.menu.pause.Hide()
+	default:
 		gui.menu.enabled.SetTitle("Lycurgus is Disabled")
 		gui.menu.enabledAction.SetTitle("Enable Lycurgus")
+		gui.menu.pause.Hide()
+	}
+}
+
+// formatRemaining formats a remaining time in whole minutes rounded up.
+func formatRemaining(d time.Duration) string {
+	if d <= 0 {
+		return "0m"
+	}
+	minutes := int((d + time.Minute - 1) / time.Minute)
+	if minutes < 60 {
+		return fmt.Sprintf("%dm", minutes)
+	}
+	return fmt.Sprintf("%dh%02dm", minutes/60, minutes%60)
+}
+
+// SetLastBlocked updates the last blocked host shown by the GUI
+func (gui *GUI) SetLastBlocked(host string) {
+	gui.mu.Lock()
+	defer gui.mu.Unlock()
+	gui.lastBlocked = host
+	if gui.menu.lastBlocked != nil {
+		gui.setLastBlocked()
+	}
+}
+
+func (gui *GUI) setLastBlocked() {
+	if gui.lastBlocked == "" {
+		gui.menu.lastBlocked.SetTitle("Nothing blocked yet")
+		gui.menu.allowBlocked.Hide()
+	} else {
+		gui.menu.lastBlocked.SetTitle("Last blocked: " + gui.lastBlocked)
+		gui.menu.allowBlocked.SetTitle(fmt.Sprintf("Allow it for %v", guiAllowDuration))
+		gui.menu.allowBlocked.Show()
+	}
+}
+
+// SetTemporary updates the number of temporary rules shown by the GUI
+func (gui *GUI) SetTemporary(count int) {
+	gui.mu.Lock()
+	defer gui.mu.Unlock()
+	gui.temporary = count
+	if gui.menu.temporary != nil {
+		gui.setTemporary()
+	}
+}
+
+func (gui *GUI) setTemporary() {
+	if gui.temporary == 0 {
+		gui.menu.temporary.Hide()
+		return
+	}
+	gui.menu.temporary.SetTitle(fmt.Sprintf("%d temporary rules", gui.temporary))
+	gui.menu.temporary.Show()
+}
+
+// SetFocus updates the focus mode shown by the GUI
+func (gui *GUI) SetFocus(focus bool) {
+	gui.mu.Lock()
+	defer gui.mu.Unlock()
+	gui.focus = focus
+	if gui.menu.focus != nil {
+		gui.setFocus()
+	}
+}
+
+func (gui *GUI) setFocus() {
+	if gui.focus {
+		gui.menu.focus.SetTitle("Leave focus mode")
+	} else {
+		gui.menu.focus.SetTitle("Enter focus mode")
+	}
+}
+
+// SetAccessRequests updates the number of access requests shown by the GUI
+func (gui *GUI) SetAccessRequests(count int) {
+	gui.mu.Lock()
+	defer gui.mu.Unlock()
+	gui.accessRequests = count
+	if gui.menu.accessRequests != nil {
+		gui.setAccessRequests()
+	}
+}
+
+func (gui *GUI) setAccessRequests() {
+	if gui.accessRequests == 0 {
+		gui.menu.accessRequests.Hide()
+		return
+	}
+	gui.menu.accessRequests.SetTitle(fmt.Sprintf("%d access requests", gui.accessRequests))
+	gui.menu.accessRequests.Show()
+}
+
+// SetInvalidRules updates the number of invalid rules shown by the GUI
+func (gui *GUI) SetInvalidRules(count int) {
+	gui.mu.Lock()
+	defer gui.mu.Unlock()
+	gui.invalidRules = count
+	if gui.menu.invalidRules != nil {
+		gui.setInvalidRules()
+	}
+}
+
+func (gui *GUI) setInvalidRules() {
+	if gui.invalidRules == 0 {
+		gui.menu.invalidRules.Hide()
+		return
+	}
+	gui.menu.invalidRules.SetTitle(fmt.Sprintf("%d invalid rules", gui.invalidRules))
+	gui.menu.invalidRules.Show()
+}
+
+func (gui *GUI) setBudgets() {
+	if gui.budgets == nil {
+		return
+	}
+	for i, status := range gui.budgets() {
+		if i >= len(gui.menu.budgets) {
+			break
+		}
+		left := "time is up"
+		if status.Remaining > 0 {
+			left = formatRemaining(time.Duration(status.Remaining)*time.Second) + " left"
+		}
+		gui.menu.budgets[i].SetTitle(status.Rule + ": " + left)
 	}
 }
 
 func (gui *GUI) listen() {
+	refresh := time.NewTicker(guiRefresh)
+	defer refresh.Stop()
 	for {
 		select {
+		case <-refresh.C:
+			gui.mu.Lock()
+			if gui.paused && !gui.pausedUntil.IsZero() {
+				gui.setEnabled()
+			}
+			gui.mu.Unlock()
+			gui.setBudgets()
 		case <-gui.menu.enabledAction.ClickedCh:
-			gui.enabled = !gui.enabled
-			gui.EnabledCh <- gui.enabled
-			gui.setEnabled()
+			gui.mu.Lock()
+			enabled := !gui.enabled
+			gui.mu.Unlock()
+			gui.EnabledCh <- enabled
+		case <-gui.menu.focus.ClickedCh:
+			gui.mu.Lock()
+			focus := !gui.focus
+			gui.mu.Unlock()
+			gui.FocusCh <- focus
 		case <-gui.menu.autostartAction.ClickedCh:
 			gui.autostart = !gui.autostart
 			gui.AutostartCh <- gui.autostart
 			gui.setAutostart()
+		case <-gui.menu.allowBlocked.ClickedCh:
+			gui.mu.Lock()
+			host := gui.lastBlocked
+			gui.mu.Unlock()
+			gui.AllowCh <- host
 		case <-gui.menu.update.ClickedCh:
 			gui.UpdateCh <- struct{}{}
+		case <-gui.menu.dashboard.ClickedCh:
+			gui.DashboardCh <- struct{}{}
 		case <-gui.menu.quit.ClickedCh:
 			gui.QuitCh <- struct{}{}
 			gui.Quit()
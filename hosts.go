@@ -3,7 +3,9 @@ package main
 import (
 	"bufio"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"strings"
@@ -31,6 +33,20 @@ func getHost(line string) (string, error) {
 	}
 }
 
+// getHostEntry extracts the IP address and the hosts from a line of
+// the hosts file format
+func getHostEntry(line string) (net.IP, []string, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, nil, errParseHosts
+	}
+	ip := net.ParseIP(fields[0])
+	if ip == nil {
+		return nil, nil, fmt.Errorf("invalid IP address: %s", fields[0])
+	}
+	return ip, fields[1:], nil
+}
+
 func ignoredHost(host string) bool {
 	if host == "localhost" {
 		return true
@@ -77,14 +93,43 @@ func parseHosts(r io.Reader) ([]string, error) {
 	return hosts, nil
 }
 
-func parseHostsFile(path string) ([]string, error) {
+// parseRulesFile reads the rules of a rule file with their line numbers.
+// The lines that cannot be parsed are skipped and returned as ruleErrors
+// with the valid rules.
+func parseRulesFile(path string) ([]string, []int, error) {
 	file, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer file.Close()
 
-	return parseHosts(file)
+	rules := []string{}
+	lines := []int{}
+	var errs ruleErrors
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := removeComment(scanner.Text(), "#")
+		if line == "" {
+			continue
+		}
+		rule, err := getHost(line)
+		if err != nil {
+			errs = append(errs, ruleError{File: path, Line: n, Rule: line, Reason: err.Error()})
+			continue
+		}
+		if ignoredHost(rule) {
+			continue
+		}
+		rules = append(rules, rule)
+		lines = append(lines, n)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if errs != nil {
+		return rules, lines, errs
+	}
+	return rules, lines, nil
 }
 
 // Getter can make HTTP GET requests
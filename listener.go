@@ -0,0 +1,144 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// rejectLogInterval is how often the same rejection of a client is logged.
+const rejectLogInterval = time.Minute
+
+// aclNetworks are the named client ranges of the ACL.
+var aclNetworks = map[string][]string{
+	"loopback": {"127.0.0.0/8", "::1/128"},
+	"lan":      {"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16", "fc00::/7", "fe80::/10"},
+}
+
+// parseACL returns the client ranges of an ACL of IP addresses, CIDR
+// ranges and the names of aclNetworks.
+func parseACL(acl []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, entry := range acl {
+		values, ok := aclNetworks[entry]
+		if !ok {
+			values = []string{entry}
+		}
+		for _, value := range values {
+			network, err := parseNetwork(value)
+			if err != nil {
+				return nil, err
+			}
+			networks = append(networks, network)
+		}
+	}
+	return networks, nil
+}
+
+// rejectLog logs the rejections, each kind at most once per
+// rejectLogInterval.
+type rejectLog struct {
+	mu     sync.Mutex
+	logged map[string]time.Time
+}
+
+func (l *rejectLog) log(what, reason, subject string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	key := what + " " + reason + " " + subject
+	if now.Sub(l.logged[key]) < rejectLogInterval {
+		return
+	}
+	if l.logged == nil {
+		l.logged = make(map[string]time.Time)
+	}
+	for k, t := range l.logged {
+		if now.Sub(t) >= rejectLogInterval {
+			delete(l.logged, k)
+		}
+	}
+	l.logged[key] = now
+	log.Printf("%s rejected (%s): %s\n", what, reason, subject)
+}
+
+// clientListener accepts the connections of the clients in the ACL up to
+// maxConns open connections per client (0 is unlimited).
+type clientListener struct {
+	net.Listener
+	acl      []*net.IPNet
+	maxConns int
+
+	mu      sync.Mutex
+	conns   map[string]int
+	rejects rejectLog
+}
+
+func newClientListener(l net.Listener, acl []*net.IPNet, maxConns int) *clientListener {
+	return &clientListener{
+		Listener: l,
+		acl:      acl,
+		maxConns: maxConns,
+		conns:    make(map[string]int),
+	}
+}
+
+// allowed reports whether a client address is in the ACL.
+func (l *clientListener) allowed(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range l.acl {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Accept returns the next connection of an allowed client and closes
+// the rejected ones.
+func (l *clientListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		address := stripPort(conn.RemoteAddr().String())
+		if !l.allowed(address) {
+			l.rejects.log("Client", "not in acl", address)
+			conn.Close()
+			continue
+		}
+		l.mu.Lock()
+		if l.maxConns > 0 && l.conns[address] >= l.maxConns {
+			l.mu.Unlock()
+			l.rejects.log("Client", "too many connections", address)
+			conn.Close()
+			continue
+		}
+		l.conns[address]++
+		l.mu.Unlock()
+		return &clientConn{Conn: conn, onClose: func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.conns[address]--; l.conns[address] <= 0 {
+				delete(l.conns, address)
+			}
+		}}, nil
+	}
+}
+
+// clientConn calls onClose once when the connection is closed.
+type clientConn struct {
+	net.Conn
+	onClose   func()
+	closeOnce sync.Once
+}
+
+func (c *clientConn) Close() error {
+	c.closeOnce.Do(c.onClose)
+	return c.Conn.Close()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseACL(t *testing.T) {
+	acl, err := parseACL([]string{"loopback", "192.168.1.0/24", "10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newClientListener(nil, acl, 0)
+	tt := []struct {
+		address string
+		allowed bool
+	}{
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"192.168.1.20", true},
+		{"10.0.0.1", true},
+		{"10.0.0.2", false},
+		{"8.8.8.8", false},
+		{"", false},
+	}
+	for _, tc := range tt {
+		if allowed := l.allowed(tc.address); allowed != tc.allowed {
+			t.Errorf("%v should be allowed: %v; got: %v", tc.address, tc.allowed, allowed)
+		}
+	}
+
+	lan, _ := parseACL([]string{"lan"})
+	if l := newClientListener(nil, lan, 0); !l.allowed("192.168.1.20") || !l.allowed("fd00::1") || l.allowed("127.0.0.1") {
+		t.Errorf("lan should allow the private ranges only")
+	}
+	if _, err := parseACL([]string{"wan"}); err == nil {
+		t.Errorf("unknown name should be an error")
+	}
+}
+
+func TestClientListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl, _ := parseACL([]string{"loopback"})
+	l := newClientListener(inner, acl, 2)
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	accept := func() net.Conn {
+		select {
+		case conn := <-accepted:
+			return conn
+		case <-time.After(100 * time.Millisecond):
+			return nil
+		}
+	}
+
+	first, second := dial(), dial()
+	defer first.Close()
+	defer second.Close()
+	conn1, conn2 := accept(), accept()
+	if conn1 == nil || conn2 == nil {
+		t.Fatalf("the first two connections should be accepted")
+	}
+	third := dial()
+	defer third.Close()
+	if conn := accept(); conn != nil {
+		t.Errorf("the third connection should be rejected")
+	}
+	// the rejected connection is closed
+	if !closedByPeer(third) {
+		t.Errorf("the third connection should be closed")
+	}
+
+	conn1.Close()
+	conn1.Close()
+	fourth := dial()
+	defer fourth.Close()
+	if conn := accept(); conn == nil {
+		t.Errorf("a connection should be accepted after closing one")
+	}
+}
+
+func TestClientListenerACL(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl, _ := parseACL([]string{"lan"})
+	l := newClientListener(inner, acl, 0)
+	defer l.Close()
+	go l.Accept()
+
+	conn, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !closedByPeer(conn) {
+		t.Errorf("connection of a client outside the ACL should be closed")
+	}
+}
+
+// closedByPeer reports whether the other end closes a connection.
+func closedByPeer(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	return err != nil
+}
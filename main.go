@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
@@ -8,21 +9,52 @@ import (
 )
 
 func main() {
-	config := parseConfig(os.Args)
+	name, args := splitCommand(os.Args)
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", name)
+		printUsage(os.Stderr)
+		os.Exit(2)
+	}
+
+	config, args := parseConfig(args)
+	if err := cmd.run(config, args); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
 
+// runCommand runs the blocker and the GUI until the app is quit.
+func runCommand(config *Config, args []string) error {
 	initLog(config)
 
 	log.Printf("Starting Lycurgus version: %s built @ %s\n", Version, BuildDate)
 
 	app, err := NewApp(*config)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	go func() {
 		log.Fatal(app.RunBlocker())
 	}()
 
+	if config.ControlAddress != "" {
+		go func() {
+			if err := app.RunControl(); err != nil {
+				log.Println("Error running control endpoint: ", err)
+			}
+		}()
+	}
+
+	if config.AdminAddress != "" {
+		go func() {
+			if err := app.RunAdmin(); err != nil {
+				log.Println("Error running admin API: ", err)
+			}
+		}()
+	}
+
 	if config.GUIEnabled {
 		app.RunGUI()
 	}
@@ -33,6 +65,6 @@ func main() {
 	select {
 	case <-app.QuitCh:
 	case <-stopCh:
-		return
 	}
+	return app.Close()
 }
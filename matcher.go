@@ -1,48 +1,341 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"regexp"
+	"regexp/syntax"
 	"strings"
 )
 
 // Matcher decides if an input text is matched by its loaded rules
 type Matcher interface {
-	// Load loads rules to be used to match input texts
-	Load(rules []string)
+	// Load loads rules to be used to match input texts. Invalid rules
+	// are skipped and reported in a ruleErrors error.
+	Load(rules []string) error
 	Match(text string) bool
 }
 
+// ruleError is an invalid rule of a rule list.
+type ruleError struct {
+	// File is the rule file, empty if the rules are not read from a file
+	File string `json:"file,omitempty"`
+	// Line is the line of the rule in the file or its position in the rules
+	Line   int    `json:"line"`
+	Rule   string `json:"rule"`
+	Reason string `json:"reason"`
+}
+
+func (e ruleError) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("rule %d: invalid rule %q: %s", e.Line, e.Rule, e.Reason)
+	}
+	return fmt.Sprintf("%s:%d: invalid rule %q: %s", e.File, e.Line, e.Rule, e.Reason)
+}
+
+// ruleErrors are the invalid rules found by Matcher.Load.
+type ruleErrors []ruleError
+
+func (errs ruleErrors) Error() string {
+	if len(errs) == 1 {
+		return errs[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more invalid rules)", errs[0].Error(), len(errs)-1)
+}
+
+// validateRule checks that a rule can be stored in a rule file
+// and parsed.
+func validateRule(rule string) error {
+	if rule == "" {
+		return errors.New("rule is empty")
+	}
+	if strings.ContainsAny(rule, " \t\r\n#") {
+		return errors.New("rule cannot contain whitespace or '#'")
+	}
+	_, _, err := parseRule(rule)
+	return err
+}
+
+// Kinds of whitelist and blacklist rules.
+const (
+	// ruleExact matches a domain exactly
+	ruleExact = "exact"
+	// ruleDomain matches a domain and its subdomains
+	ruleDomain = "domain"
+	// ruleRegexp matches a regular expression
+	ruleRegexp = "regexp"
+)
+
+var domainPattern = regexp.MustCompile(`^[a-z0-9_-]+(\.[a-z0-9_-]+)*$`)
+
+// parseRule returns the kind of a rule and its domain or regular expression.
+// Plain domains with a dot match exactly, *.example.com and ||example.com match the
+// domain and its subdomains, /regex/ is a regular expression and any
+// other rule is a regular expression as well.
+func parseRule(rule string) (string, string, error) {
+	if len(rule) >= 2 && strings.HasPrefix(rule, "/") && strings.HasSuffix(rule, "/") {
+		expr := rule[1 : len(rule)-1]
+		if expr == "" {
+			return "", "", errors.New("empty regular expression")
+		}
+		if err := compileRule(expr); err != nil {
+			return "", "", err
+		}
+		return ruleRegexp, expr, nil
+	}
+	for _, prefix := range []string{"||", "*."} {
+		if strings.HasPrefix(rule, prefix) {
+			domain := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(rule, prefix), "^"))
+			if !domainPattern.MatchString(domain) {
+				return "", "", fmt.Errorf("invalid domain: %s", domain)
+			}
+			return ruleDomain, domain, nil
+		}
+	}
+	// single labels are kept as regular expressions of older rule files
+	if domain := strings.ToLower(rule); domainPattern.MatchString(domain) && strings.Contains(domain, ".") {
+		return ruleExact, domain, nil
+	}
+	if err := compileRule(rule); err != nil {
+		return "", "", err
+	}
+	return ruleRegexp, rule, nil
+}
+
+func compileRule(expr string) error {
+	if _, err := regexp.Compile(expr); err != nil {
+		return errors.New(regexpReason(err))
+	}
+	return nil
+}
+
 // regexpMatcher uses regular expression rules to match input text
 type regexpMatcher struct {
-	regexp *regexp.Regexp
+	// regexp is the alternation of the rules
+	regexp   *regexp.Regexp
+	rules    []string
+	compiled []*regexp.Regexp
+}
+
+// Load loads regular expression rules skipping the invalid ones
+func (m *regexpMatcher) Load(rules []string) error {
+	m.regexp = nil
+	m.rules = []string{}
+	m.compiled = []*regexp.Regexp{}
+	var errs ruleErrors
+	for i, rule := range rules {
+		re, err := regexp.Compile(rule)
+		if err != nil {
+			errs = append(errs, ruleError{Line: i + 1, Rule: rule, Reason: regexpReason(err)})
+			continue
+		}
+		m.rules = append(m.rules, rule)
+		m.compiled = append(m.compiled, re)
+	}
+	if len(m.rules) > 0 {
+		m.regexp = regexp.MustCompile(strings.Join(m.rules, "|"))
+	}
+	if errs != nil {
+		return errs
+	}
+	return nil
 }
 
-// Load loads regular expression rules
-func (m *regexpMatcher) Load(rules []string) {
-	regexes := strings.Join(rules, "|")
-	m.regexp = regexp.MustCompile(regexes)
+// regexpReason returns the reason of a compile error without the pattern.
+func regexpReason(err error) string {
+	if re, ok := err.(*syntax.Error); ok {
+		return string(re.Code)
+	}
+	return err.Error()
 }
 
 func (m *regexpMatcher) Match(text string) bool {
-	return m.regexp.MatchString(text)
+	return m.regexp != nil && m.regexp.MatchString(text)
+}
+
+// MatchRule matches like Match and returns the first matching rule
+func (m *regexpMatcher) MatchRule(text string) (string, string, bool) {
+	if !m.Match(text) {
+		return "", "", false
+	}
+	for i, re := range m.compiled {
+		if re.MatchString(text) {
+			return m.rules[i], "", true
+		}
+	}
+	return "", "", true
+}
+
+// Len returns the number of rules
+func (m *regexpMatcher) Len() int {
+	return len(m.rules)
+}
+
+// listMatcher matches the rules of a whitelist or blacklist
+// with a matcher for each kind of rule
+type listMatcher struct {
+	// exact and domains map the domains to their rules
+	exact   map[string]string
+	domains map[string]string
+	regexps regexpMatcher
+	// regexpRules maps the regular expressions to their rules
+	regexpRules map[string]string
+	count       int
+}
+
+// Load loads the rules skipping the invalid ones
+func (m *listMatcher) Load(rules []string) error {
+	m.exact = make(map[string]string)
+	m.domains = make(map[string]string)
+	m.regexpRules = make(map[string]string)
+	m.count = 0
+	exprs := []string{}
+	var errs ruleErrors
+	for i, rule := range rules {
+		kind, value, err := parseRule(rule)
+		if err != nil {
+			errs = append(errs, ruleError{Line: i + 1, Rule: rule, Reason: err.Error()})
+			continue
+		}
+		m.count++
+		switch kind {
+		case ruleExact:
+			m.exact[value] = rule
+		case ruleDomain:
+			m.domains[value] = rule
+		case ruleRegexp:
+			exprs = append(exprs, value)
+			m.regexpRules[value] = rule
+		}
+	}
+	// the expressions are valid
+	m.regexps.Load(exprs)
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+func (m *listMatcher) Match(text string) bool {
+	_, _, ok := m.MatchRule(text)
+	return ok
+}
+
+// MatchRule matches the host of the text exactly, then the domains
+// of the host and then the text with the regular expressions
+func (m *listMatcher) MatchRule(text string) (string, string, bool) {
+	host := strings.ToLower(stripPort(text))
+	if rule, ok := m.exact[host]; ok {
+		return rule, "", true
+	}
+	for domain := host; ; {
+		if rule, ok := m.domains[domain]; ok {
+			return rule, "", true
+		}
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+	if expr, _, ok := m.regexps.MatchRule(text); ok {
+		return m.regexpRules[expr], "", true
+	}
+	return "", "", false
+}
+
+// MatchRules returns all the rules matching the text
+func (m *listMatcher) MatchRules(text string) []string {
+	rules := []string{}
+	host := strings.ToLower(stripPort(text))
+	if rule, ok := m.exact[host]; ok {
+		rules = append(rules, rule)
+	}
+	for domain := host; ; {
+		if rule, ok := m.domains[domain]; ok {
+			rules = append(rules, rule)
+		}
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+	if m.regexps.Match(text) {
+		for i, re := range m.regexps.compiled {
+			if re.MatchString(text) {
+				rules = append(rules, m.regexpRules[m.regexps.rules[i]])
+			}
+		}
+	}
+	return rules
+}
+
+// Len returns the number of rules
+func (m *listMatcher) Len() int {
+	return m.count
+}
+
+// ruleMatcher is a Matcher that can tell which rule matched
+type ruleMatcher interface {
+	Matcher
+	// MatchRule returns the rule matching the input text and its source
+	MatchRule(text string) (rule string, source string, ok bool)
+}
+
+// matchRule matches an input text and returns the matching rule
+// and its source if the matcher knows them.
+func matchRule(m Matcher, text string) (string, string, bool) {
+	if rm, ok := m.(ruleMatcher); ok {
+		return rm.MatchRule(text)
+	}
+	return "", "", m.Match(text)
 }
 
 // hashMatcher uses string rules to match input texts exactly
 // or texts with ":443" as suffix
 type hashMatcher struct {
-	hm map[string]int
+	// hm maps the rules to the index of their first source
+	hm      map[string]int
+	sources []string
 }
 
-func (m *hashMatcher) Load(rules []string) {
+func (m *hashMatcher) Load(rules []string) error {
+	m.LoadSources([]blocklistSource{{Hosts: rules}})
+	return nil
+}
+
+// LoadSources loads the hosts of blocklist sources as rules
+func (m *hashMatcher) LoadSources(sources []blocklistSource) {
 	m.hm = make(map[string]int)
-	for _, rule := range rules {
-		m.hm[rule] = 0
+	m.sources = make([]string, len(sources))
+	for i, source := range sources {
+		m.sources[i] = source.URL
+		for _, rule := range source.Hosts {
+			if _, ok := m.hm[rule]; !ok {
+				m.hm[rule] = i
+			}
+		}
 	}
 }
 
 // Match matches an input text exactly or a text with ":443" as suffix
 func (m *hashMatcher) Match(rule string) bool {
-	rule = strings.TrimSuffix(rule, ":443")
-	_, ok := m.hm[rule]
+	_, _, ok := m.MatchRule(rule)
 	return ok
 }
+
+// MatchRule matches like Match and returns the rule and its source
+func (m *hashMatcher) MatchRule(rule string) (string, string, bool) {
+	rule = strings.TrimSuffix(rule, ":443")
+	i, ok := m.hm[rule]
+	if !ok {
+		return "", "", false
+	}
+	return rule, m.sources[i], true
+}
+
+// Len returns the number of rules
+func (m *hashMatcher) Len() int {
+	return len(m.hm)
+}
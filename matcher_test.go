@@ -43,6 +43,52 @@ func TestRegexpMatcher(t *testing.T) {
 	}
 }
 
+func TestRegexpMatcherRule(t *testing.T) {
+	matcher := regexpMatcher{}
+	matcher.Load([]string{`^(.*\.)?reddit\.com`, `twitter`, `\.com$`})
+
+	tt := []struct {
+		value, rule string
+		matched     bool
+	}{
+		{"www.reddit.com", `^(.*\.)?reddit\.com`, true},
+		{"twitter.com", `twitter`, true},
+		{"example.com", `\.com$`, true},
+		{"example.org", "", false},
+	}
+	for _, tc := range tt {
+		rule, _, ok := matcher.MatchRule(tc.value)
+		if ok != tc.matched || rule != tc.rule {
+			t.Errorf("MatchRule '%s' should be: %v %v; got: %v %v", tc.value, tc.rule, tc.matched, rule, ok)
+		}
+	}
+	if matcher.Len() != 3 {
+		t.Errorf("Len should be 3; got: %v", matcher.Len())
+	}
+}
+
+func TestRegexpMatcherInvalid(t *testing.T) {
+	matcher := regexpMatcher{}
+	err := matcher.Load([]string{`(`, `valid`, `[`})
+	errs, ok := err.(ruleErrors)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("Load should return 2 invalid rules; got: %v", err)
+	}
+	if errs[0].Line != 1 || errs[0].Rule != `(` || errs[1].Line != 3 || errs[1].Rule != `[` {
+		t.Errorf("invalid rules should be 1 ( and 3 [; got: %+v", errs)
+	}
+	if !matcher.Match("valid") || matcher.Len() != 1 {
+		t.Errorf("valid rule should be loaded")
+	}
+
+	if err := matcher.Load([]string{`(`}); err == nil {
+		t.Errorf("Load should return an error")
+	}
+	if matcher.Match("(") {
+		t.Errorf("matcher without valid rules should not match")
+	}
+}
+
 func TestHashMatcher(t *testing.T) {
 	rules := []string{
 		"reddit.com",
@@ -77,3 +123,97 @@ func TestHashMatcher(t *testing.T) {
 		}
 	}
 }
+
+func TestHashMatcherRule(t *testing.T) {
+	matcher := hashMatcher{}
+	matcher.LoadSources([]blocklistSource{
+		{URL: "https://asdf.aa", Hosts: []string{"reddit.com", "twitter.com"}},
+		{URL: "https://qwer.qq", Hosts: []string{"twitter.com", "facebook.com"}},
+	})
+
+	tt := []struct {
+		value, rule, source string
+		matched             bool
+	}{
+		{"reddit.com:443", "reddit.com", "https://asdf.aa", true},
+		{"twitter.com", "twitter.com", "https://asdf.aa", true},
+		{"facebook.com", "facebook.com", "https://qwer.qq", true},
+		{"google.com", "", "", false},
+	}
+	for _, tc := range tt {
+		rule, source, ok := matcher.MatchRule(tc.value)
+		if ok != tc.matched || rule != tc.rule || source != tc.source {
+			t.Errorf("MatchRule '%s' should be: %v %v %v; got: %v %v %v", tc.value, tc.rule, tc.source, tc.matched, rule, source, ok)
+		}
+	}
+	if matcher.Len() != 3 {
+		t.Errorf("Len should be 3; got: %v", matcher.Len())
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	tt := []struct {
+		rule, kind, value string
+		valid             bool
+	}{
+		{"example.com", ruleExact, "example.com", true},
+		{"Example.COM", ruleExact, "example.com", true},
+		{"*.example.com", ruleDomain, "example.com", true},
+		{"||example.com^", ruleDomain, "example.com", true},
+		{"||example.com", ruleDomain, "example.com", true},
+		{`/^ads\d+\./`, ruleRegexp, `^ads\d+\.`, true},
+		{`^(.*\.)?example\.com$`, ruleRegexp, `^(.*\.)?example\.com$`, true},
+		{"example", ruleRegexp, "example", true},
+		{"//", "", "", false},
+		{"/(/", "", "", false},
+		{"*.", "", "", false},
+		{"||exa[mple.com", "", "", false},
+	}
+	for _, tc := range tt {
+		kind, value, err := parseRule(tc.rule)
+		if (err == nil) != tc.valid || kind != tc.kind || value != tc.value {
+			t.Errorf("parseRule '%s' should be: %v %v %v; got: %v %v %v", tc.rule, tc.kind, tc.value, tc.valid, kind, value, err)
+		}
+	}
+}
+
+func TestListMatcher(t *testing.T) {
+	matcher := listMatcher{}
+	err := matcher.Load([]string{"reddit.com", "*.twitter.com", "||facebook.com^", `/^ads\d*\./`, "/(/"})
+	errs, ok := err.(ruleErrors)
+	if !ok || len(errs) != 1 || errs[0].Line != 5 {
+		t.Fatalf("Load should return the invalid rule 5; got: %v", err)
+	}
+
+	tt := []struct {
+		value, rule string
+		matched     bool
+	}{
+		{"reddit.com", "reddit.com", true},
+		{"reddit.com:443", "reddit.com", true},
+		{"REDDIT.com:443", "reddit.com", true},
+		{"www.reddit.com", "", false},
+		{"reddit.com.evil.io", "", false},
+		{"twitter.com:443", "*.twitter.com", true},
+		{"api.www.twitter.com:443", "*.twitter.com", true},
+		{"nottwitter.com", "", false},
+		{"m.facebook.com", "||facebook.com^", true},
+		{"ads7.example.com:443", `/^ads\d*\./`, true},
+		{"example.com", "", false},
+	}
+	for _, tc := range tt {
+		rule, _, ok := matcher.MatchRule(tc.value)
+		if ok != tc.matched || rule != tc.rule {
+			t.Errorf("MatchRule '%s' should be: %v %v; got: %v %v", tc.value, tc.rule, tc.matched, rule, ok)
+		}
+	}
+	if matcher.Len() != 4 {
+		t.Errorf("Len should be 4; got: %v", matcher.Len())
+	}
+
+	matcher.Load([]string{"ads.example.com", "*.example.com", "/example/"})
+	rules := matcher.MatchRules("ads.example.com:443")
+	if len(rules) != 3 {
+		t.Errorf("MatchRules should return 3 rules; got: %v", rules)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// decisionBuckets are the upper bounds in seconds of the decision latency histogram.
+var decisionBuckets = []float64{0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05}
+
+// metrics collects the counters exposed in the Prometheus text format.
+type metrics struct {
+	// the atomic counters come first to be 64-bit aligned on 32-bit platforms
+	activeTunnels int64
+	bytesSent     uint64
+	bytesReceived uint64
+
+	mu              sync.Mutex
+	requests        map[[2]string]uint64
+	blockedBySource map[string]uint64
+	latency         histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:        make(map[[2]string]uint64),
+		blockedBySource: make(map[string]uint64),
+		latency:         newHistogram(decisionBuckets),
+	}
+}
+
+// observe counts a decision and the time it took.
+func (m *metrics) observe(e event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[[2]string{decisionLabel(e.Blocked), e.Stage}]++
+	if e.Blocked {
+		source := e.Source
+		if source == "" {
+			source = e.Stage
+		}
+		m.blockedBySource[source]++
+	}
+	m.latency.observe(e.Elapsed.Seconds())
+}
+
+func decisionLabel(blocked bool) string {
+	if blocked {
+		return "blocked"
+	}
+	return "allowed"
+}
+
+// trackTunnel counts a CONNECT tunnel as active until the connection is closed
+// and counts the bytes passing through it.
+func (m *metrics) trackTunnel(conn net.Conn) net.Conn {
+	atomic.AddInt64(&m.activeTunnels, 1)
+	return &countingConn{
+		Conn:     conn,
+		received: &m.bytesReceived,
+		sent:     &m.bytesSent,
+		onClose: func() {
+			atomic.AddInt64(&m.activeTunnels, -1)
+		},
+	}
+}
+
+// countingConn counts the bytes read from and written to a connection.
+type countingConn struct {
+	net.Conn
+	received  *uint64
+	sent      *uint64
+	onClose   func()
+	closeOnce sync.Once
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(c.received, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(c.sent, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Close() error {
+	c.closeOnce.Do(c.onClose)
+	return c.Conn.Close()
+}
+
+// histogram is a cumulative histogram with fixed buckets.
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) histogram {
+	return histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// ruleCounter is a Matcher that knows the number of its rules.
+type ruleCounter interface {
+	Len() int
+}
+
+// metricsSnapshot is the state of the app collected at scrape time.
+type metricsSnapshot struct {
+	rules   map[string]uint64
+	sources []sourceStatus
+}
+
+// write writes the metrics in the Prometheus text format.
+func (m *metrics) write(w io.Writer, snapshot metricsSnapshot) error {
+	pw := &promWriter{w: w}
+
+	m.mu.Lock()
+	pw.header("lycurgus_requests_total", "counter", "Proxy requests by decision and stage.")
+	for _, key := range sortedLabelPairs(m.requests) {
+		pw.sample("lycurgus_requests_total", labels("decision", key[0], "stage", key[1]), float64(m.requests[key]))
+	}
+	pw.header("lycurgus_blocked_requests_total", "counter", "Blocked proxy requests by blocklist source or stage.")
+	for _, source := range sortedKeys(m.blockedBySource) {
+		pw.sample("lycurgus_blocked_requests_total", labels("source", source), float64(m.blockedBySource[source]))
+	}
+	pw.header("lycurgus_decision_duration_seconds", "histogram", "Time taken to decide about a proxy request.")
+	for i, bound := range m.latency.buckets {
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		pw.sample("lycurgus_decision_duration_seconds_bucket", labels("le", le), float64(m.latency.counts[i]))
+	}
+	pw.sample("lycurgus_decision_duration_seconds_bucket", labels("le", "+Inf"), float64(m.latency.count))
+	pw.sample("lycurgus_decision_duration_seconds_sum", "", m.latency.sum)
+	pw.sample("lycurgus_decision_duration_seconds_count", "", float64(m.latency.count))
+	m.mu.Unlock()
+
+	pw.header("lycurgus_active_tunnels", "gauge", "Open CONNECT tunnels.")
+	pw.sample("lycurgus_active_tunnels", "", float64(atomic.LoadInt64(&m.activeTunnels)))
+	pw.header("lycurgus_tunneled_bytes_total", "counter", "Bytes passed through CONNECT tunnels by direction.")
+	pw.sample("lycurgus_tunneled_bytes_total", labels("direction", "received"), float64(atomic.LoadUint64(&m.bytesReceived)))
+	pw.sample("lycurgus_tunneled_bytes_total", labels("direction", "sent"), float64(atomic.LoadUint64(&m.bytesSent)))
+
+	pw.header("lycurgus_rules", "gauge", "Loaded rules by matcher.")
+	for _, matcher := range sortedKeys(snapshot.rules) {
+		pw.sample("lycurgus_rules", labels("matcher", matcher), float64(snapshot.rules[matcher]))
+	}
+
+	var lastUpdate time.Time
+	pw.header("lycurgus_list_fetch_duration_seconds", "gauge", "Duration of the last fetch of a blocklist source.")
+	for _, source := range snapshot.sources {
+		pw.sample("lycurgus_list_fetch_duration_seconds", labels("source", source.URL), source.Duration.Seconds())
+		if source.LastUpdate.After(lastUpdate) {
+			lastUpdate = source.LastUpdate
+		}
+	}
+	pw.header("lycurgus_list_fetch_failures_total", "counter", "Failed fetches of a blocklist source.")
+	for _, source := range snapshot.sources {
+		pw.sample("lycurgus_list_fetch_failures_total", labels("source", source.URL), float64(source.Failures))
+	}
+	pw.header("lycurgus_list_last_update_timestamp_seconds", "gauge", "Time of the last successful fetch of a blocklist source.")
+	for _, source := range snapshot.sources {
+		pw.sample("lycurgus_list_last_update_timestamp_seconds", labels("source", source.URL), unixSeconds(source.LastUpdate))
+	}
+	pw.header("lycurgus_last_update_timestamp_seconds", "gauge", "Time of the last successful fetch of any blocklist source.")
+	pw.sample("lycurgus_last_update_timestamp_seconds", "", unixSeconds(lastUpdate))
+
+	return pw.err
+}
+
+func unixSeconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / 1e9
+}
+
+// promWriter writes metrics in the Prometheus text format
+// and keeps the first error.
+type promWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (pw *promWriter) header(name, typ, help string) {
+	pw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (pw *promWriter) sample(name, labels string, value float64) {
+	pw.printf("%s%s %s\n", name, labels, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (pw *promWriter) printf(format string, args ...interface{}) {
+	if pw.err != nil {
+		return
+	}
+	_, pw.err = fmt.Fprintf(pw.w, format, args...)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// labels formats name and value pairs as a label set.
+func labels(pairs ...string) string {
+	parts := []string{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, pairs[i], labelEscaper.Replace(pairs[i+1])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedLabelPairs(m map[[2]string]uint64) [][2]string {
+	keys := [][2]string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys
+}
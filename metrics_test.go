@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsWrite(t *testing.T) {
+	m := newMetrics()
+	m.observe(event{query{Host: "a.com", Blocked: true, Stage: stageBlocklist, Source: "https://asdf.aa"}, 20 * time.Microsecond})
+	m.observe(event{query{Host: "b.com", Blocked: true, Stage: stageBlacklist}, time.Millisecond})
+	m.observe(event{query{Host: "c.com", Stage: stageDefault}, time.Second})
+
+	lastUpdate := time.Unix(1607600000, 0)
+	buf := &bytes.Buffer{}
+	err := m.write(buf, metricsSnapshot{
+		rules: map[string]uint64{stageBlocklist: 100},
+		sources: []sourceStatus{
+			{URL: "https://asdf.aa", LastUpdate: lastUpdate, Duration: 1500 * time.Millisecond, Failures: 2},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		`lycurgus_requests_total{decision="allowed",stage="default"} 1`,
+		`lycurgus_requests_total{decision="blocked",stage="blocklist"} 1`,
+		`lycurgus_blocked_requests_total{source="blacklist"} 1`,
+		`lycurgus_blocked_requests_total{source="https://asdf.aa"} 1`,
+		`lycurgus_decision_duration_seconds_bucket{le="1e-05"} 0`,
+		`lycurgus_decision_duration_seconds_bucket{le="5e-05"} 1`,
+		`lycurgus_decision_duration_seconds_bucket{le="0.001"} 2`,
+		`lycurgus_decision_duration_seconds_bucket{le="+Inf"} 3`,
+		`lycurgus_decision_duration_seconds_count 3`,
+		`lycurgus_active_tunnels 0`,
+		`lycurgus_rules{matcher="blocklist"} 100`,
+		`lycurgus_list_fetch_duration_seconds{source="https://asdf.aa"} 1.5`,
+		`lycurgus_list_fetch_failures_total{source="https://asdf.aa"} 2`,
+		`lycurgus_last_update_timestamp_seconds 1.6076e+09`,
+		`# TYPE lycurgus_decision_duration_seconds histogram`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("metrics should contain %q", line)
+		}
+	}
+}
+
+func TestMetricsTunnel(t *testing.T) {
+	m := newMetrics()
+	client, server := net.Pipe()
+	conn := m.trackTunnel(client)
+
+	if m.activeTunnels != 1 {
+		t.Errorf("active tunnels should be 1; got: %v", m.activeTunnels)
+	}
+
+	go func() {
+		server.Write([]byte("hello"))
+		ioutil.ReadAll(server)
+	}()
+	buf := make([]byte, 5)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	conn.Close()
+
+	if m.activeTunnels != 0 {
+		t.Errorf("active tunnels should be 0; got: %v", m.activeTunnels)
+	}
+	if m.bytesReceived != 5 || m.bytesSent != 2 {
+		t.Errorf("bytes should be 5 received and 2 sent; got: %v, %v", m.bytesReceived, m.bytesSent)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	if l := labels("a", "1", "b", `x"y\`); l != `{a="1",b="x\"y\\"}` {
+		t.Errorf("labels should be escaped; got: %v", l)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// listOverrides is the list of the host overrides.
+const listOverrides = "hosts"
+
+// sinkIPs are the addresses of the hosts file entries that block.
+var sinkIPs = []net.IP{net.IPv4zero, net.IPv4(127, 0, 0, 1), net.IPv6unspecified, net.IPv6loopback}
+
+// hostEntries map the hosts to IP addresses in the config file.
+type hostEntries map[string]string
+
+// hostOverrides maps the hosts to the addresses dialed instead of the
+// resolved ones. The hosts mapped to a sink address are blocked.
+type hostOverrides struct {
+	addrs  map[string]net.IP
+	blocks map[string]net.IP
+}
+
+// loadOverrides reads a file in the hosts file format and adds the
+// entries of the config, which map the hosts to IP addresses. A missing
+// file has no entries. It loads the valid lines of the file and returns
+// the invalid ones as ruleErrors, the invalid config entries fail.
+func loadOverrides(path string, entries hostEntries) (*hostOverrides, error) {
+	o := &hostOverrides{addrs: make(map[string]net.IP), blocks: make(map[string]net.IP)}
+	var errs ruleErrors
+	file, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for n := 1; scanner.Scan(); n++ {
+			line := removeComment(scanner.Text(), "#")
+			if line == "" {
+				continue
+			}
+			ip, hosts, err := getHostEntry(line)
+			if err != nil {
+				errs = append(errs, ruleError{File: path, Line: n, Rule: line, Reason: err.Error()})
+				continue
+			}
+			for _, host := range hosts {
+				o.add(host, ip)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	// the config entries override the file
+	hosts := make([]string, 0, len(entries))
+	for host := range entries {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		ip := net.ParseIP(entries[host])
+		if ip == nil {
+			return nil, fmt.Errorf("host %s: invalid IP address: %s", host, entries[host])
+		}
+		o.add(host, ip)
+	}
+	if len(errs) > 0 {
+		return o, errs
+	}
+	return o, nil
+}
+
+func (o *hostOverrides) add(host string, ip net.IP) {
+	host = overrideName(host)
+	if ignoredHost(host) {
+		return
+	}
+	delete(o.addrs, host)
+	delete(o.blocks, host)
+	for _, sink := range sinkIPs {
+		if ip.Equal(sink) {
+			o.blocks[host] = ip
+			return
+		}
+	}
+	o.addrs[host] = ip
+}
+
+func overrideName(host string) string {
+	return strings.ToLower(strings.TrimSuffix(stripPort(host), "."))
+}
+
+// address returns the address a host is mapped to.
+func (o *hostOverrides) address(host string) (net.IP, bool) {
+	ip, ok := o.addrs[overrideName(host)]
+	return ip, ok
+}
+
+// block returns the entry blocking a host.
+func (o *hostOverrides) block(host string) (string, bool) {
+	name := overrideName(host)
+	if ip, ok := o.blocks[name]; ok {
+		return ip.String() + " " + name, true
+	}
+	return "", false
+}
+
+// Len returns the number of entries
+func (o *hostOverrides) Len() int {
+	return len(o.addrs) + len(o.blocks)
+}
+
+// overrideAddr returns the dial address of an overridden host or the
+// address itself.
+func (b *Blocker) overrideAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.overrides == nil {
+		return addr
+	}
+	if ip, ok := b.overrides.address(host); ok {
+		return net.JoinHostPort(ip.String(), port)
+	}
+	return addr
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lycurgus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts")
+	content := "# staging\n10.0.0.5 build.internal Staging.Example.com\n127.0.0.1 localhost\n0.0.0.0 ads.example.com\n::1 tracker.example.com # sink\n\nbuild.example.com\n10.0.0 broken.example.com\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := loadOverrides(path, hostEntries{"build.internal": "10.0.0.6", "pixel.example.com": "127.0.0.1"})
+	errs, ok := err.(ruleErrors)
+	if !ok || len(errs) != 2 || errs[0].Line != 7 || errs[1].Line != 8 {
+		t.Errorf("lines 7 and 8 should be invalid; got: %v", err)
+	}
+	if o.Len() != 5 {
+		t.Errorf("entries should be 5; got: %v", o.Len())
+	}
+	tt := []struct {
+		host    string
+		address string
+		block   string
+	}{
+		{"build.internal:443", "10.0.0.6", ""},
+		{"staging.example.com", "10.0.0.5", ""},
+		{"ads.example.com:443", "", "0.0.0.0 ads.example.com"},
+		{"tracker.example.com", "", "::1 tracker.example.com"},
+		{"pixel.example.com", "", "127.0.0.1 pixel.example.com"},
+		{"localhost", "", ""},
+		{"www.example.com", "", ""},
+	}
+	for _, tc := range tt {
+		address := ""
+		if ip, ok := o.address(tc.host); ok {
+			address = ip.String()
+		}
+		if address != tc.address {
+			t.Errorf("address of %v should be %q; got: %q", tc.host, tc.address, address)
+		}
+		if block, _ := o.block(tc.host); block != tc.block {
+			t.Errorf("block of %v should be %q; got: %q", tc.host, tc.block, block)
+		}
+	}
+
+	if _, err := loadOverrides(path, hostEntries{"build.internal": "10.0.0"}); err == nil {
+		t.Errorf("invalid config entry should fail")
+	} else if _, ok := err.(ruleErrors); ok {
+		t.Errorf("invalid config entry should not be an invalid rule; got: %v", err)
+	}
+	if o, err := loadOverrides(filepath.Join(dir, "missing"), nil); err != nil || o.Len() != 0 {
+		t.Errorf("missing file should have no entries; got: %v, %v", o, err)
+	}
+}
+
+func TestBlockerOverrides(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	_, port, _ := net.SplitHostPort(target.Listener.Addr().String())
+	blocker := NewBlocker(WithBlockerEnabled(true))
+	blocker.blacklist = &blacklistMatcher{}
+	// 127.0.0.1 blocks in the hosts entries, it is set directly to reach
+	// the target
+	blocker.SetOverrides(&hostOverrides{
+		addrs:  map[string]net.IP{"staging.example.invalid": net.ParseIP("127.0.0.1")},
+		blocks: map[string]net.IP{"ads.example.com": net.IPv4zero},
+	})
+
+	d := blocker.Decide("ads.example.com:443")
+	if !d.Blocked || d.Stage != stageHosts || d.Rule != "0.0.0.0 ads.example.com" {
+		t.Errorf("ads.example.com should be blocked by the hosts entry; got: %+v", d)
+	}
+	if counts := blocker.RuleCounts(); counts[stageHosts] != 2 {
+		t.Errorf("hosts entries should be 2; got: %v", counts[stageHosts])
+	}
+
+	proxy := httptest.NewServer(blocker)
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get("http://" + net.JoinHostPort("staging.example.invalid", port) + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status of the overridden host should be %v; got: %v", http.StatusOK, resp.StatusCode)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// portRule allows more tunnel ports to the hosts of a rule.
+type portRule struct {
+	Rule  string `yaml:"rule"`
+	Ports []int  `yaml:"ports"`
+}
+
+func (r portRule) String() string {
+	ports := formatPorts(r.Ports)
+	if r.Rule == "" {
+		return ports
+	}
+	return r.Rule + ": " + ports
+}
+
+func formatPorts(ports []int) string {
+	s := make([]string, len(ports))
+	for i, port := range ports {
+		s[i] = strconv.Itoa(port)
+	}
+	return strings.Join(s, ", ")
+}
+
+// parsePorts parses a comma separated list of ports.
+func parsePorts(value string) ([]int, error) {
+	ports := []int{}
+	for _, item := range splitList(value) {
+		port, err := strconv.Atoi(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port: %s", item)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// portPolicy restricts the destination ports of the tunnels to the
+// default ports and the ports of the first matching port rule.
+type portPolicy struct {
+	defaults portRule
+	rules    []portRule
+	matchers []*listMatcher
+}
+
+// newPortPolicy returns the port policy of the ports and the port rules,
+// or nil without ports, which allows the tunnels to any port.
+func newPortPolicy(ports []int, rules []portRule) (*portPolicy, error) {
+	p := &portPolicy{defaults: portRule{Ports: ports}}
+	for _, r := range append([]portRule{p.defaults}, rules...) {
+		for _, port := range r.Ports {
+			if port < 1 || port > 65535 {
+				return nil, fmt.Errorf("invalid port: %d", port)
+			}
+		}
+	}
+	for _, r := range rules {
+		if len(r.Ports) == 0 {
+			return nil, fmt.Errorf("port rule %s: no ports", r.Rule)
+		}
+		m := &listMatcher{}
+		if err := m.Load([]string{r.Rule}); err != nil {
+			return nil, fmt.Errorf("port rule %s: %v", r.Rule, err)
+		}
+		p.rules = append(p.rules, r)
+		p.matchers = append(p.matchers, m)
+	}
+	if len(ports) == 0 {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// allowed reports whether a tunnel to host:port is allowed. Otherwise it
+// returns the rule with the allowed ports. A host without port is a
+// tunnel to 443.
+func (p *portPolicy) allowed(host string) (portRule, bool) {
+	name, portValue, err := net.SplitHostPort(host)
+	if err != nil {
+		name, portValue = host, "443"
+	}
+	port, err := strconv.Atoi(portValue)
+	if err != nil {
+		return p.defaults, false
+	}
+	for _, allowed := range p.defaults.Ports {
+		if port == allowed {
+			return portRule{}, true
+		}
+	}
+	for i, m := range p.matchers {
+		if !m.Match(name) {
+			continue
+		}
+		for _, allowed := range p.rules[i].Ports {
+			if port == allowed {
+				return portRule{}, true
+			}
+		}
+		return portRule{Rule: p.rules[i].Rule, Ports: append(append([]int{}, p.defaults.Ports...), p.rules[i].Ports...)}, false
+	}
+	return p.defaults, false
+}
@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestNewPortPolicy(t *testing.T) {
+	tt := []struct {
+		name  string
+		ports []int
+		rules []portRule
+		err   bool
+	}{
+		{"valid", []int{443, 8443}, []portRule{{Rule: "git.example.com", Ports: []int{22}}}, false},
+		{"no default ports", nil, nil, false},
+		{"invalid port", []int{0}, nil, true},
+		{"invalid rule port", []int{443}, []portRule{{Rule: "a.com", Ports: []int{65536}}}, true},
+		{"rule without ports", []int{443}, []portRule{{Rule: "a.com"}}, true},
+		{"invalid rule", []int{443}, []portRule{{Rule: "/[/", Ports: []int{22}}}, true},
+	}
+	for _, tc := range tt {
+		_, err := newPortPolicy(tc.ports, tc.rules)
+		if (err != nil) != tc.err {
+			t.Errorf("%v error should be %v; got: %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func TestPortPolicyAllowed(t *testing.T) {
+	p, err := newPortPolicy(defaultPorts, []portRule{{Rule: "*.git.example.com", Ports: []int{22, 2222}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		host    string
+		allowed bool
+		rule    string
+	}{
+		{"example.com:443", true, ""},
+		{"example.com:8443", true, ""},
+		{"mtalk.google.com:5228", true, ""},
+		{"example.com", true, ""},
+		{"example.com:25", false, "443, 8443, 5228"},
+		{"example.com:x", false, "443, 8443, 5228"},
+		{"ssh.git.example.com:22", true, ""},
+		{"ssh.git.example.com:443", true, ""},
+		{"ssh.git.example.com:25", false, "*.git.example.com: 443, 8443, 5228, 22, 2222"},
+		{"example.com:22", false, "443, 8443, 5228"},
+	}
+	for _, tc := range tt {
+		rule, allowed := p.allowed(tc.host)
+		if allowed != tc.allowed || rule.String() != tc.rule {
+			t.Errorf("%v should be allowed: %v by %q; got: %v %q", tc.host, tc.allowed, tc.rule, allowed, rule)
+		}
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	ports, err := parsePorts("443, 8443,,22")
+	if err != nil || formatPorts(ports) != "443, 8443, 22" {
+		t.Errorf("ports should be 443, 8443, 22; got: %v %v", ports, err)
+	}
+	if _, err := parsePorts("443,https"); err == nil {
+		t.Errorf("invalid port should be an error")
+	}
+}
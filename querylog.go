@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/natefinch/lumberjack"
+)
+
+// query is a decision of the blocker about a CONNECT request of a client.
+type query struct {
+	Time    time.Time `json:"time"`
+	Client  string    `json:"client"`
+	Host    string    `json:"host"`
+	Port    string    `json:"port,omitempty"`
+	Blocked bool      `json:"blocked"`
+	Stage   string    `json:"stage"`
+	Rule    string    `json:"rule,omitempty"`
+	Source  string    `json:"source,omitempty"`
+	// Overrides is the stage that would have blocked a whitelisted host
+	Overrides string `json:"overrides,omitempty"`
+	// Group is the client group of the client if any
+	Group string `json:"group,omitempty"`
+	// CNAME is the CNAME target of the host that matched the rule if any
+	CNAME string `json:"cname,omitempty"`
+}
+
+func newQuery(t time.Time, client string, d Decision) query {
+	host, port, err := net.SplitHostPort(d.Host)
+	if err != nil {
+		host, port = d.Host, ""
+	}
+	return query{
+		Time:      t,
+		Client:    client,
+		Host:      host,
+		Port:      port,
+		Blocked:   d.Blocked,
+		Stage:     d.Stage,
+		Rule:      d.Rule,
+		Source:    d.Source,
+		Overrides: d.Overrides,
+		Group:     d.Group,
+		CNAME:     d.CNAME,
+	}
+}
+
+// queryFilter selects queries from the query log.
+type queryFilter struct {
+	// Search is a substring of the host, client, rule or source
+	Search string
+	Client string
+	// Decision is "blocked", "allowed" or empty for both
+	Decision string
+	Since    time.Time
+	Limit    int
+}
+
+const defaultQueryLimit = 100
+
+func (f *queryFilter) match(q query) bool {
+	if f.Client != "" && q.Client != f.Client {
+		return false
+	}
+	if f.Decision != "" && f.Decision != decisionLabel(q.Blocked) {
+		return false
+	}
+	if !f.Since.IsZero() && q.Time.Before(f.Since) {
+		return false
+	}
+	if f.Search != "" &&
+		!strings.Contains(q.Host, f.Search) &&
+		!strings.Contains(q.Client, f.Search) &&
+		!strings.Contains(q.Rule, f.Search) &&
+		!strings.Contains(q.Source, f.Search) {
+		return false
+	}
+	return true
+}
+
+// parseQueryFilter reads a filter from the search, client, decision,
+// since (see parseSince) and limit parameters.
+func parseQueryFilter(values url.Values, now time.Time) (queryFilter, error) {
+	f := queryFilter{
+		Search:   values.Get("search"),
+		Client:   values.Get("client"),
+		Decision: values.Get("decision"),
+		Limit:    defaultQueryLimit,
+	}
+	if f.Decision != "" && f.Decision != "blocked" && f.Decision != "allowed" {
+		return f, fmt.Errorf("invalid decision: %s", f.Decision)
+	}
+	if since := values.Get("since"); since != "" {
+		t, err := parseSince(since, now)
+		if err != nil {
+			return f, err
+		}
+		f.Since = t
+	}
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return f, fmt.Errorf("invalid limit: %s", limit)
+		}
+		f.Limit = n
+	}
+	return f, nil
+}
+
+// parseSince parses an RFC 3339 time or a duration before now
+// that may be given in days (e.g. 7d).
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if strings.HasSuffix(value, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(value, "d")); err == nil && days >= 0 {
+			return now.AddDate(0, 0, -days), nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid since: %s", value)
+}
+
+// queryLog keeps the recent queries in a ring buffer
+// and optionally persists every query to rotated files.
+type queryLog struct {
+	mu     sync.Mutex
+	recent []query
+	next   int
+	full   bool
+
+	path      string
+	retention time.Duration
+	file      io.WriteCloser
+	// writes queues the queries to persist, they are written by writeLoop
+	writes  chan query
+	dropped int
+	closed  bool
+	done    chan struct{}
+}
+
+// queryLogQueue is the number of queries waiting to be persisted
+// before new ones are dropped.
+const queryLogQueue = 4096
+
+// newQueryLog creates a query log keeping size queries in memory.
+// If path is set, queries are appended to it as JSON lines and kept
+// for the retention period.
+func newQueryLog(size int, path string, retention time.Duration) *queryLog {
+	l := &queryLog{
+		recent:    make([]query, size),
+		path:      path,
+		retention: retention,
+	}
+	if path != "" {
+		l.file = &lumberjack.Logger{
+			Filename: path,
+			MaxSize:  100, // megabytes
+			MaxAge:   int(math.Ceil(retention.Hours() / 24)),
+		}
+		l.writes = make(chan query, queryLogQueue)
+		l.done = make(chan struct{})
+		go l.writeLoop()
+	}
+	return l
+}
+
+// record adds a query to the log. Persisting it does not block the caller,
+// when the disk cannot keep up the query is only kept in memory.
+func (l *queryLog) record(q query) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.recent) > 0 {
+		l.add(q)
+	}
+	if l.writes != nil && !l.closed {
+		select {
+		case l.writes <- q:
+		default:
+			l.dropped++
+		}
+	}
+}
+
+// writeLoop persists the queued queries, flushing them when the queue is empty.
+func (l *queryLog) writeLoop() {
+	defer close(l.done)
+
+	w := bufio.NewWriter(l.file)
+	flush := func() {
+		if err := w.Flush(); err != nil {
+			log.Println("Error writing query log: ", err)
+		}
+		l.mu.Lock()
+		dropped := l.dropped
+		l.dropped = 0
+		l.mu.Unlock()
+		if dropped > 0 {
+			log.Printf("Dropped %d queries from the query log", dropped)
+		}
+	}
+	for q := range l.writes {
+		line, err := json.Marshal(q)
+		if err == nil {
+			w.Write(append(line, '\n'))
+		}
+		if len(l.writes) == 0 {
+			flush()
+		}
+	}
+	flush()
+}
+
+func (l *queryLog) add(q query) {
+	l.recent[l.next] = q
+	l.next = (l.next + 1) % len(l.recent)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// load fills the ring buffer with the newest persisted queries.
+func (l *queryLog) load() error {
+	if l.path == "" || len(l.recent) == 0 {
+		return nil
+	}
+	queries, err := l.searchFiles(queryFilter{Limit: len(l.recent)}, time.Now())
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := len(queries) - 1; i >= 0; i-- {
+		l.add(queries[i])
+	}
+	return nil
+}
+
+// search returns the queries matching the filter, newest first. When the
+// ring buffer cannot satisfy the filter, the persisted queries are searched.
+func (l *queryLog) search(f queryFilter) ([]query, error) {
+	if f.Limit <= 0 {
+		f.Limit = defaultQueryLimit
+	}
+
+	l.mu.Lock()
+	count := l.next
+	if l.full {
+		count = len(l.recent)
+	}
+	queries := []query{}
+	var oldest time.Time
+	for i := 1; i <= count && len(queries) < f.Limit; i++ {
+		q := l.recent[(l.next-i+len(l.recent))%len(l.recent)]
+		oldest = q.Time
+		if f.match(q) {
+			queries = append(queries, q)
+		}
+	}
+	complete := !l.full || len(queries) >= f.Limit || (!f.Since.IsZero() && !oldest.After(f.Since))
+	l.mu.Unlock()
+
+	if complete || l.path == "" {
+		return queries, nil
+	}
+	return l.searchFiles(f, time.Now())
+}
+
+// searchFiles searches the persisted queries, newest first.
+func (l *queryLog) searchFiles(f queryFilter, now time.Time) ([]query, error) {
+	files, err := queryLogFiles(l.path)
+	if err != nil {
+		return nil, err
+	}
+	queries := []query{}
+	for _, path := range files {
+		err := readQueryFile(path, func(q query) bool {
+			if l.retention > 0 && now.Sub(q.Time) > l.retention {
+				return true
+			}
+			if f.match(q) {
+				queries = append(queries, q)
+			}
+			return len(queries) < f.Limit
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(queries) >= f.Limit {
+			break
+		}
+	}
+	return queries, nil
+}
+
+// queryLogFiles returns the query log file and its rotated backups, newest first.
+func queryLogFiles(path string) ([]string, error) {
+	ext := filepath.Ext(path)
+	backups, err := filepath.Glob(strings.TrimSuffix(path, ext) + "-*" + ext)
+	if err != nil {
+		return nil, err
+	}
+	// backup names end with their rotation time
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+
+	files := []string{}
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	}
+	return append(files, backups...), nil
+}
+
+// queryChunkSize is the size of the blocks a query file is read backwards in.
+const queryChunkSize = 64 * 1024
+
+// readQueryFile calls fn with the queries of a file, newest first, until
+// it returns false. The file is read backwards so a search stops without
+// reading the older part of it.
+func readQueryFile(path string, fn func(query) bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// next passes a line to fn, skipping lines cut short by a crash
+	next := func(line []byte) bool {
+		var q query
+		if len(bytes.TrimSpace(line)) == 0 || json.Unmarshal(line, &q) != nil {
+			return true
+		}
+		return fn(q)
+	}
+	buf := make([]byte, queryChunkSize)
+	// rest is the start of a line continuing in the previous block
+	var rest []byte
+	for offset := info.Size(); offset > 0; {
+		n := int64(len(buf))
+		if offset < n {
+			n = offset
+		}
+		offset -= n
+		if _, err := file.ReadAt(buf[:n], offset); err != nil {
+			return err
+		}
+		block := make([]byte, 0, int(n)+len(rest))
+		block = append(append(block, buf[:n]...), rest...)
+		lines := bytes.Split(block, []byte{'\n'})
+		rest = lines[0]
+		for i := len(lines) - 1; i > 0; i-- {
+			if !next(lines[i]) {
+				return nil
+			}
+		}
+	}
+	next(rest)
+	return nil
+}
+
+// Close closes the persisted query log.
+func (l *queryLog) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.writes)
+	}
+	l.mu.Unlock()
+	<-l.done
+	return l.file.Close()
+}
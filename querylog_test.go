@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func queryHosts(queries []query) []string {
+	hosts := []string{}
+	for _, q := range queries {
+		hosts = append(hosts, q.Host)
+	}
+	return hosts
+}
+
+func TestNewQuery(t *testing.T) {
+	q := newQuery(time.Time{}, "127.0.0.1", Decision{Host: "a.com:443", Blocked: true, Stage: stageBlacklist})
+	if q.Host != "a.com" || q.Port != "443" || !q.Blocked || q.Stage != stageBlacklist {
+		t.Errorf("query should be a.com 443 blocked blacklist; got: %+v", q)
+	}
+	q = newQuery(time.Time{}, "", Decision{Host: "a.com"})
+	if q.Host != "a.com" || q.Port != "" {
+		t.Errorf("query should be a.com without port; got: %+v", q)
+	}
+}
+
+func TestQueryLogSearch(t *testing.T) {
+	l := newQueryLog(3, "", 0)
+	now := time.Now()
+	l.record(query{Time: now.Add(-4 * time.Minute), Host: "a.com", Blocked: true})
+	l.record(query{Time: now.Add(-3 * time.Minute), Host: "b.com", Client: "10.0.0.2"})
+	l.record(query{Time: now.Add(-2 * time.Minute), Host: "c.com", Blocked: true})
+	l.record(query{Time: now.Add(-1 * time.Minute), Host: "d.com", Rule: "d.com"})
+
+	tt := []struct {
+		filter   queryFilter
+		expected []string
+	}{
+		{queryFilter{}, []string{"d.com", "c.com", "b.com"}},
+		{queryFilter{Limit: 1}, []string{"d.com"}},
+		{queryFilter{Search: "c."}, []string{"c.com"}},
+		{queryFilter{Client: "10.0.0.2"}, []string{"b.com"}},
+		{queryFilter{Decision: "blocked"}, []string{"c.com"}},
+		{queryFilter{Decision: "allowed"}, []string{"d.com", "b.com"}},
+		{queryFilter{Since: now.Add(-150 * time.Second)}, []string{"d.com", "c.com"}},
+	}
+
+	for _, tc := range tt {
+		queries, err := l.search(tc.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := queryHosts(queries); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("search %+v should be %v; got: %v", tc.filter, tc.expected, got)
+		}
+	}
+}
+
+func TestParseQueryFilter(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	f, err := parseQueryFilter(url.Values{"since": {"1h"}, "decision": {"blocked"}, "limit": {"5"}}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Since.Equal(now.Add(-time.Hour)) || f.Decision != "blocked" || f.Limit != 5 {
+		t.Errorf("filter should be since 1h blocked limit 5; got: %+v", f)
+	}
+	f, err = parseQueryFilter(url.Values{"since": {"2020-01-01T00:00:00Z"}}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Since.Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)) || f.Limit != defaultQueryLimit {
+		t.Errorf("filter should be since 2020-01-01; got: %+v", f)
+	}
+
+	f, err = parseQueryFilter(url.Values{"since": {"2d"}}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Since.Equal(now.AddDate(0, 0, -2)) {
+		t.Errorf("filter should be since 2 days; got: %+v", f)
+	}
+
+	for _, values := range []url.Values{
+		{"since": {"yesterday"}},
+		{"decision": {"maybe"}},
+		{"limit": {"-1"}},
+	} {
+		if _, err := parseQueryFilter(values, now); err == nil {
+			t.Errorf("filter %v should be invalid", values)
+		}
+	}
+}
+
+func TestQueryLogPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lycurgus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queries.log")
+
+	now := time.Now()
+	l := newQueryLog(2, path, time.Hour)
+	l.record(query{Time: now.Add(-2 * time.Hour), Host: "expired.com"})
+	l.record(query{Time: now.Add(-3 * time.Minute), Host: "a.com"})
+	l.record(query{Time: now.Add(-2 * time.Minute), Host: "b.com"})
+	l.record(query{Time: now.Add(-1 * time.Minute), Host: "c.com"})
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the older queries are searched in the file
+	queries, err := l.search(queryFilter{Search: "a."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := queryHosts(queries); !reflect.DeepEqual(got, []string{"a.com"}) {
+		t.Errorf("search should be [a.com]; got: %v", got)
+	}
+	queries, err = l.search(queryFilter{Search: "expired"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 0 {
+		t.Errorf("expired queries should not be found; got: %v", queryHosts(queries))
+	}
+
+	// a new log starts with the newest persisted queries
+	l = newQueryLog(2, path, time.Hour)
+	defer l.Close()
+	if err := l.load(); err != nil {
+		t.Fatal(err)
+	}
+	l.mu.Lock()
+	got := queryHosts(l.recent)
+	l.mu.Unlock()
+	if !reflect.DeepEqual(got, []string{"b.com", "c.com"}) {
+		t.Errorf("loaded queries should be [b.com c.com]; got: %v", got)
+	}
+}
+
+func TestReadQueryFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lycurgus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queries.log")
+
+	// enough queries to span several blocks and a line cut short by a crash
+	content := &bytes.Buffer{}
+	count := 3000
+	for i := 0; i < count; i++ {
+		fmt.Fprintf(content, `{"host":"%d.com"}`+"\n", i)
+	}
+	content.WriteString(`{"host":"cut`)
+	if err := ioutil.WriteFile(path, content.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hosts := []string{}
+	if err := readQueryFile(path, func(q query) bool {
+		hosts = append(hosts, q.Host)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != count {
+		t.Fatalf("all %d queries should be read; got: %d", count, len(hosts))
+	}
+	for i, host := range hosts {
+		if want := fmt.Sprintf("%d.com", count-1-i); host != want {
+			t.Fatalf("query %d should be %s; got: %s", i, want, host)
+		}
+	}
+
+	hosts = hosts[:0]
+	readQueryFile(path, func(q query) bool {
+		hosts = append(hosts, q.Host)
+		return len(hosts) < 2
+	})
+	if !reflect.DeepEqual(hosts, []string{"2999.com", "2998.com"}) {
+		t.Errorf("reading should stop after 2 queries; got: %v", hosts)
+	}
+}
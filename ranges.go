@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// listRanges is the list of the blocked address ranges.
+const listRanges = "ranges"
+
+// resolveTimeout is how long the addresses of a host are looked up for
+// the blocked ranges.
+const resolveTimeout = 2 * time.Second
+
+// lookupFunc returns the IP addresses of a host.
+type lookupFunc func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+// hostLookups holds the DNS answers of a decision. The stages needing an
+// answer not looked up yet set pending, which is run without holding the
+// blocker lock before deciding again.
+type hostLookups struct {
+	// addrs are the resolved addresses of the host, nil if the lookup failed
+	addrs    []net.IPAddr
+	resolved bool
+	// cnames are the CNAME targets of the host
+	cnames    []string
+	uncloaked bool
+	pending   func(ctx context.Context)
+}
+
+// wait sets the pending lookup unless an earlier stage set one.
+func (l *hostLookups) wait(lookup func(ctx context.Context)) {
+	if l.pending == nil {
+		l.pending = lookup
+	}
+}
+
+// ipRanges matches IP addresses against CIDR ranges.
+type ipRanges struct {
+	rules    []string
+	networks []*net.IPNet
+}
+
+// loadRanges reads a file of IP addresses and CIDR ranges, one per line.
+// A missing file has no ranges. It loads the valid ranges and returns the
+// invalid ones as ruleErrors.
+func loadRanges(path string) (*ipRanges, error) {
+	r := &ipRanges{}
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return r, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	var errs ruleErrors
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := removeComment(scanner.Text(), "#")
+		if line == "" {
+			continue
+		}
+		network, err := parseNetwork(line)
+		if err != nil {
+			errs = append(errs, ruleError{File: path, Line: n, Rule: line, Reason: err.Error()})
+			continue
+		}
+		r.rules = append(r.rules, line)
+		r.networks = append(r.networks, network)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		return r, errs
+	}
+	return r, nil
+}
+
+// match returns the first range containing an IP address.
+func (r *ipRanges) match(ip net.IP) (string, bool) {
+	for i, network := range r.networks {
+		if network.Contains(ip) {
+			return r.rules[i], true
+		}
+	}
+	return "", false
+}
+
+// Len returns the number of ranges
+func (r *ipRanges) Len() int {
+	return len(r.networks)
+}
+
+// hostIP returns the IP address of an IP-literal host or nil.
+func hostIP(host string) net.IP {
+	name := strings.TrimSuffix(strings.TrimPrefix(stripPort(host), "["), "]")
+	return net.ParseIP(name)
+}
+
+// containsIP reports whether one of the networks contains an IP address.
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAddress matches the address of an IP-literal host, or the
+// resolved addresses of a host name with lookups, against the blocked
+// ranges and the IP-literal policy. It returns the stage and the rule
+// that block the host.
+func (b *Blocker) matchAddress(host string, l *hostLookups) (string, string, bool) {
+	if ip := hostIP(host); ip != nil {
+		if b.ranges != nil {
+			if rule, ok := b.ranges.match(ip); ok {
+				return stageRange, rule, true
+			}
+		}
+		if b.blockIPs && !containsIP(b.allowIPs, ip) {
+			return stageIP, ip.String(), true
+		}
+		return "", "", false
+	}
+	if l == nil || !b.resolveRanges || b.ranges == nil || b.ranges.Len() == 0 {
+		return "", "", false
+	}
+	// the overridden hosts are not resolved
+	if b.overrides != nil {
+		if ip, ok := b.overrides.address(host); ok {
+			if rule, ok := b.ranges.match(ip); ok {
+				return stageRange, rule, true
+			}
+			return "", "", false
+		}
+	}
+	if !l.resolved {
+		lookup := b.lookup
+		l.wait(func(ctx context.Context) {
+			l.addrs, _ = lookup(ctx, stripPort(host))
+			l.resolved = true
+		})
+		return "", "", false
+	}
+	for _, addr := range l.addrs {
+		if rule, ok := b.ranges.match(addr.IP); ok {
+			return stageRange, rule, true
+		}
+	}
+	return "", "", false
+}
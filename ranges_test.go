@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadRanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lycurgus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "blockranges")
+	content := "# ad networks\n203.0.113.0/24\n198.51.100.7 # tracker\n\n2001:db8::/32\n10.0.0.0/33\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := loadRanges(path)
+	errs, ok := err.(ruleErrors)
+	if !ok || len(errs) != 1 || errs[0].Line != 6 || errs[0].Rule != "10.0.0.0/33" {
+		t.Errorf("line 6 should be invalid; got: %v", err)
+	}
+	if r.Len() != 3 {
+		t.Errorf("ranges should be 3; got: %v", r.Len())
+	}
+	tt := []struct {
+		ip   string
+		rule string
+	}{
+		{"203.0.113.9", "203.0.113.0/24"},
+		{"198.51.100.7", "198.51.100.7"},
+		{"198.51.100.8", ""},
+		{"2001:db8::1", "2001:db8::/32"},
+	}
+	for _, tc := range tt {
+		if rule, _ := r.match(net.ParseIP(tc.ip)); rule != tc.rule {
+			t.Errorf("range of %v should be %q; got: %q", tc.ip, tc.rule, rule)
+		}
+	}
+
+	if r, err := loadRanges(filepath.Join(dir, "missing")); err != nil || r.Len() != 0 {
+		t.Errorf("missing file should have no ranges; got: %v, %v", r, err)
+	}
+}
+
+func TestHostIP(t *testing.T) {
+	tt := []struct {
+		host string
+		ip   string
+	}{
+		{"203.0.113.9:443", "203.0.113.9"},
+		{"203.0.113.9", "203.0.113.9"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		{"example.com:443", "<nil>"},
+		{"1.2.3.example.com", "<nil>"},
+	}
+	for _, tc := range tt {
+		if ip := hostIP(tc.host); ip.String() != tc.ip {
+			t.Errorf("IP of %v should be %v; got: %v", tc.host, tc.ip, ip)
+		}
+	}
+}
+
+func TestBlockerAddresses(t *testing.T) {
+	allowIPs, _ := parseACL([]string{"lan"})
+	lookup := func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		switch host {
+		case "ads.example.com":
+			return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}, {IP: net.ParseIP("203.0.113.9")}}, nil
+		case "www.example.com":
+			return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	blocker := NewBlocker(WithBlockerEnabled(true), WithBlockerIPs(true, allowIPs), WithBlockerResolveRanges(true), WithBlockerLookup(lookup))
+	ranges := &ipRanges{}
+	for _, rule := range []string{"203.0.113.0/24", "192.168.1.66"} {
+		network, _ := parseNetwork(rule)
+		ranges.rules = append(ranges.rules, rule)
+		ranges.networks = append(ranges.networks, network)
+	}
+	blocker.SetRanges(ranges)
+	whitelist := &listMatcher{}
+	whitelist.Load([]string{"8.8.8.8"})
+	blocker.SetWhitelist(whitelist)
+
+	tt := []struct {
+		host    string
+		blocked bool
+		stage   string
+		rule    string
+	}{
+		{"203.0.113.9:443", true, stageRange, "203.0.113.0/24"},
+		{"198.51.100.7:443", true, stageIP, "198.51.100.7"},
+		{"[2001:db8::1]:443", true, stageIP, "2001:db8::1"},
+		{"192.168.1.20:443", false, stageDefault, ""},
+		{"192.168.1.66:443", true, stageRange, "192.168.1.66"},
+		{"8.8.8.8:443", false, stageWhitelist, "8.8.8.8"},
+		{"ads.example.com:443", true, stageRange, "203.0.113.0/24"},
+		{"www.example.com:443", false, stageDefault, ""},
+		{"unknown.example.com:443", false, stageDefault, ""},
+	}
+	for _, tc := range tt {
+		d := blocker.Decide(tc.host)
+		if d.Blocked != tc.blocked || d.Stage != tc.stage || d.Rule != tc.rule {
+			t.Errorf("%v should be blocked: %v by %v %v; got: %+v", tc.host, tc.blocked, tc.stage, tc.rule, d)
+		}
+	}
+	if d := blocker.Decide("8.8.8.8:443"); d.Overrides != stageIP {
+		t.Errorf("whitelisted IP should override %v; got: %+v", stageIP, d)
+	}
+}
+
+func TestBlockerLookupUnlocked(t *testing.T) {
+	var blocker *Blocker
+	lookup := func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		// a lookup under the blocker lock would deadlock here
+		blocker.mu.Lock()
+		blocker.mu.Unlock()
+		return []net.IPAddr{{IP: net.ParseIP("203.0.113.9")}}, nil
+	}
+	blocker = NewBlocker(WithBlockerEnabled(true), WithBlockerResolveRanges(true), WithBlockerLookup(lookup))
+	network, _ := parseNetwork("203.0.113.0/24")
+	blocker.SetRanges(&ipRanges{rules: []string{"203.0.113.0/24"}, networks: []*net.IPNet{network}})
+
+	decided := make(chan Decision)
+	go func() {
+		decided <- blocker.Decide("ads.example.com:443")
+	}()
+	select {
+	case d := <-decided:
+		if !d.Blocked || d.Stage != stageRange {
+			t.Errorf("ads.example.com should be blocked by %v; got: %+v", stageRange, d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the lookup should not hold the blocker lock")
+	}
+}
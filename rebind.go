@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// internalSuffixes are the suffixes of the internal host names, which
+// are dialed without the rebinding check.
+var internalSuffixes = []string{".localhost", ".local", ".lan", ".internal", ".home.arpa"}
+
+// dialFunc dials an address.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// rebindError is the error of a public host name resolving to an
+// internal address.
+type rebindError struct {
+	Host string
+	IP   net.IP
+}
+
+func (e *rebindError) Error() string {
+	return fmt.Sprintf("%s resolves to internal address %s", e.Host, e.IP)
+}
+
+// rebindGuard protects against DNS rebinding: it resolves the public
+// host names itself, refuses the ones resolving to loopback, private or
+// link-local addresses and dials the checked addresses.
+type rebindGuard struct {
+	allow    *listMatcher
+	internal []*net.IPNet
+	lookup   lookupFunc
+	rejects  rejectLog
+}
+
+// newRebindGuard creates the guard with the rules of the internal
+// domains allowed to resolve to internal addresses.
+func newRebindGuard(allow []string, lookup lookupFunc) (*rebindGuard, error) {
+	g := &rebindGuard{allow: &listMatcher{}, lookup: lookup}
+	if err := g.allow.Load(allow); err != nil {
+		return nil, fmt.Errorf("rebinding allowlist: %v", err)
+	}
+	internal, err := parseACL([]string{"loopback", "lan", "0.0.0.0/8", "::/128"})
+	if err != nil {
+		return nil, err
+	}
+	g.internal = internal
+	return g, nil
+}
+
+// publicName reports whether a host is a public host name.
+func publicName(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if net.ParseIP(host) != nil || host == "localhost" || !strings.Contains(host, ".") {
+		return false
+	}
+	for _, suffix := range internalSuffixes {
+		if strings.HasSuffix(host, suffix) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialContext wraps a dial function with the guard.
+func (g *rebindGuard) dialContext(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || !publicName(host) || g.allow.Match(host) {
+			return dial(ctx, network, addr)
+		}
+		addrs, err := g.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("no addresses for %s", host)
+		}
+		for _, a := range addrs {
+			if containsIP(g.internal, a.IP) {
+				g.rejects.log("Host", "resolves to "+a.IP.String(), host)
+				return nil, &rebindError{Host: host, IP: a.IP}
+			}
+		}
+		// dial the checked addresses, a second lookup could rebind
+		return dialAddrs(ctx, dial, network, port, addrs)
+	}
+}
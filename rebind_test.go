@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestPublicName(t *testing.T) {
+	tt := []struct {
+		host   string
+		public bool
+	}{
+		{"example.com", true},
+		{"www.example.com.", true},
+		{"localhost", false},
+		{"router", false},
+		{"nas.local", false},
+		{"printer.home.arpa", false},
+		{"app.localhost", false},
+		{"127.0.0.1", false},
+		{"::1", false},
+	}
+	for _, tc := range tt {
+		if public := publicName(tc.host); public != tc.public {
+			t.Errorf("%v should be public: %v; got: %v", tc.host, tc.public, public)
+		}
+	}
+}
+
+func TestRebindGuard(t *testing.T) {
+	lookup := func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		switch host {
+		case "example.com":
+			return []net.IPAddr{{IP: net.ParseIP("93.184.216.34")}}, nil
+		case "rebind.example.com":
+			return []net.IPAddr{{IP: net.ParseIP("93.184.216.34")}, {IP: net.ParseIP("127.0.0.1")}}, nil
+		case "lan.example.com", "jira.corp.example.com":
+			return []net.IPAddr{{IP: net.ParseIP("192.168.1.10")}}, nil
+		case "linklocal.example.com":
+			return []net.IPAddr{{IP: net.ParseIP("fe80::1")}}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	g, err := newRebindGuard([]string{"*.corp.example.com"}, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dialed string
+	dial := g.dialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = addr
+		return nil, nil
+	})
+
+	tt := []struct {
+		addr    string
+		dialed  string
+		rebound bool
+	}{
+		{"example.com:443", "93.184.216.34:443", false},
+		{"rebind.example.com:443", "", true},
+		{"lan.example.com:443", "", true},
+		{"linklocal.example.com:443", "", true},
+		{"jira.corp.example.com:443", "jira.corp.example.com:443", false},
+		{"nas.local:443", "nas.local:443", false},
+		{"192.168.1.10:443", "192.168.1.10:443", false},
+	}
+	for _, tc := range tt {
+		dialed = ""
+		_, err := dial(context.Background(), "tcp", tc.addr)
+		_, rebound := err.(*rebindError)
+		if dialed != tc.dialed || rebound != tc.rebound {
+			t.Errorf("%v should dial %q, rebound: %v; got: %q, %v", tc.addr, tc.dialed, tc.rebound, dialed, err)
+		}
+	}
+	if _, err := dial(context.Background(), "tcp", "unknown.example.com:443"); err == nil {
+		t.Errorf("failed lookup should be an error")
+	}
+
+	if _, err := newRebindGuard([]string{"/[/"}, lookup); err == nil {
+		t.Errorf("invalid allowlist should be an error")
+	}
+}
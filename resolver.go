@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TTL bounds of the cached addresses, the names without addresses are
+// cached for resolverNegativeTTL.
+const (
+	resolverMinTTL      = 10 * time.Second
+	resolverMaxTTL      = time.Hour
+	resolverNegativeTTL = 30 * time.Second
+	resolverCacheSize   = 10000
+)
+
+// happyEyeballsDelay is how long a connection attempt is waited for
+// before the next address is tried (RFC 8305).
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// resolverEntry is the cached addresses of a name.
+type resolverEntry struct {
+	addrs   []net.IPAddr
+	expires time.Time
+}
+
+// resolver looks up the addresses of the public host names on its own
+// DNS servers and caches them by TTL. The other names are looked up by
+// the system resolver.
+type resolver struct {
+	transport dnsTransport
+
+	mu    sync.Mutex
+	cache map[string]resolverEntry
+	// now returns the current time
+	now func() time.Time
+}
+
+func newResolver(t dnsTransport) *resolver {
+	return &resolver{
+		transport: t,
+		cache:     make(map[string]resolverEntry),
+		now:       time.Now,
+	}
+}
+
+// lookupIPAddr returns the IPv6 and IPv4 addresses of a host.
+func (r *resolver) lookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	if !publicName(host) {
+		return net.DefaultResolver.LookupIPAddr(ctx, host)
+	}
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	r.mu.Lock()
+	entry, ok := r.cache[name]
+	r.mu.Unlock()
+	now := r.now()
+	if ok && now.Before(entry.expires) {
+		return r.result(host, entry.addrs)
+	}
+
+	type answer struct {
+		qtype uint16
+		resp  dnsResponse
+		err   error
+	}
+	answers := make(chan answer, 2)
+	for _, qtype := range []uint16{dnsTypeAAAA, dnsTypeA} {
+		go func(qtype uint16) {
+			resp, err := queryDNS(ctx, r.transport, name, qtype)
+			answers <- answer{qtype, resp, err}
+		}(qtype)
+	}
+	addrs := []net.IPAddr{}
+	ttl := resolverMaxTTL
+	var err error
+	for i := 0; i < 2; i++ {
+		a := <-answers
+		if a.err == nil && a.resp.RCode != dnsRCodeSuccess && a.resp.RCode != dnsRCodeNameError {
+			a.err = fmt.Errorf("DNS lookup of %s failed with code %d", name, a.resp.RCode)
+		}
+		if a.err != nil {
+			err = a.err
+			continue
+		}
+		for _, record := range a.resp.Answers {
+			if record.Type != a.qtype {
+				continue
+			}
+			addrs = append(addrs, net.IPAddr{IP: record.IP})
+			if d := time.Duration(record.TTL) * time.Second; d < ttl {
+				ttl = d
+			}
+		}
+	}
+	// a failed query is not cached unless the other one has addresses
+	if err != nil && len(addrs) == 0 {
+		return nil, err
+	}
+	switch {
+	case len(addrs) == 0:
+		ttl = resolverNegativeTTL
+	case ttl < resolverMinTTL:
+		ttl = resolverMinTTL
+	}
+	r.mu.Lock()
+	if len(r.cache) >= resolverCacheSize {
+		r.prune(now)
+	}
+	r.cache[name] = resolverEntry{addrs: addrs, expires: now.Add(ttl)}
+	r.mu.Unlock()
+	return r.result(host, addrs)
+}
+
+func (r *resolver) result(host string, addrs []net.IPAddr) ([]net.IPAddr, error) {
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+// prune drops the expired entries, or all of them if none expired.
+func (r *resolver) prune(now time.Time) {
+	for name, entry := range r.cache {
+		if !now.Before(entry.expires) {
+			delete(r.cache, name)
+		}
+	}
+	if len(r.cache) >= resolverCacheSize {
+		r.cache = make(map[string]resolverEntry)
+	}
+}
+
+// dialContext wraps a dial function with the resolver.
+func (r *resolver) dialContext(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || !publicName(host) {
+			return dial(ctx, network, addr)
+		}
+		addrs, err := r.lookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		return dialAddrs(ctx, dial, network, port, addrs)
+	}
+}
+
+// dialAddrs dials the addresses in the order of sortAddrs, starting the
+// next attempt when one fails or after happyEyeballsDelay, and returns
+// the first connection.
+func dialAddrs(ctx context.Context, dial dialFunc, network, port string, addrs []net.IPAddr) (net.Conn, error) {
+	addrs = sortAddrs(network, addrs)
+	if len(addrs) == 0 {
+		return nil, errors.New("no addresses to dial")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		addr := net.JoinHostPort(addrs[next].IP.String(), port)
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ctx, network, addr)
+			results <- result{conn, err}
+		}()
+	}
+	start()
+	timer := time.NewTimer(happyEyeballsDelay)
+	defer timer.Stop()
+	var errs []string
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// close the connections of the attempts still running
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			errs = append(errs, r.err.Error())
+			if next < len(addrs) {
+				start()
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+				timer.Reset(happyEyeballsDelay)
+			}
+		}
+	}
+	return nil, errors.New(strings.Join(errs, "; "))
+}
+
+// sortAddrs returns the addresses of a network alternating between IPv6
+// and IPv4, starting with IPv6.
+func sortAddrs(network string, addrs []net.IPAddr) []net.IPAddr {
+	var v6, v4 []net.IPAddr
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			if !strings.HasSuffix(network, "6") {
+				v4 = append(v4, a)
+			}
+		} else if !strings.HasSuffix(network, "4") {
+			v6 = append(v6, a)
+		}
+	}
+	sorted := make([]net.IPAddr, 0, len(v6)+len(v4))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			sorted = append(sorted, v6[i])
+		}
+		if i < len(v4) {
+			sorted = append(sorted, v4[i])
+		}
+	}
+	return sorted
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResolverLookup(t *testing.T) {
+	server, queries := startDNSServer(t, map[string][]dnsRecord{
+		"dual.example.com": {
+			{Type: dnsTypeA, TTL: 300, IP: net.ParseIP("203.0.113.1")},
+			{Type: dnsTypeAAAA, TTL: 60, IP: net.ParseIP("2001:db8::1")},
+		},
+		"cdn.example.com": {
+			{Type: dnsTypeCNAME, TTL: 300, Target: "edge.cdn.net"},
+			{Name: "edge.cdn.net", Type: dnsTypeA, TTL: 300, IP: net.ParseIP("203.0.113.2")},
+		},
+	})
+	r := newResolver(plainDNS{server: server})
+	now := time.Date(2021, 3, 5, 10, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	addrs, err := r.lookupIPAddr(ctx, "cdn.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || !addrs[0].IP.Equal(net.ParseIP("203.0.113.2")) {
+		t.Errorf("addresses of cdn.example.com should be 203.0.113.2; got: %v", addrs)
+	}
+
+	for i := 0; i < 2; i++ {
+		addrs, err := r.lookupIPAddr(ctx, "Dual.Example.com.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) != 2 {
+			t.Errorf("dual.example.com should have 2 addresses; got: %v", addrs)
+		}
+	}
+	// A and AAAA queries of two names
+	if n := queries(); n != 4 {
+		t.Errorf("queries should be 4 while cached; got: %v", n)
+	}
+	// the lowest TTL counts
+	now = now.Add(61 * time.Second)
+	r.lookupIPAddr(ctx, "dual.example.com")
+	if n := queries(); n != 6 {
+		t.Errorf("queries should be 6 after the TTL; got: %v", n)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := r.lookupIPAddr(ctx, "missing.example.com")
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Errorf("missing.example.com should not be found; got: %v", err)
+		}
+	}
+	if n := queries(); n != 8 {
+		t.Errorf("missing names should be cached; got: %v queries", n)
+	}
+
+	addrs, err = r.lookupIPAddr(ctx, "192.0.2.1")
+	if err != nil || len(addrs) != 1 || !addrs[0].IP.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("addresses of an IP should be itself; got: %v, %v", addrs, err)
+	}
+}
+
+func TestSortAddrs(t *testing.T) {
+	addrs := []net.IPAddr{
+		{IP: net.ParseIP("203.0.113.1")},
+		{IP: net.ParseIP("203.0.113.2")},
+		{IP: net.ParseIP("2001:db8::1")},
+	}
+	tt := []struct {
+		network  string
+		expected []string
+	}{
+		{"tcp", []string{"2001:db8::1", "203.0.113.1", "203.0.113.2"}},
+		{"tcp4", []string{"203.0.113.1", "203.0.113.2"}},
+		{"tcp6", []string{"2001:db8::1"}},
+	}
+	for _, tc := range tt {
+		sorted := []string{}
+		for _, a := range sortAddrs(tc.network, addrs) {
+			sorted = append(sorted, a.IP.String())
+		}
+		if !reflect.DeepEqual(sorted, tc.expected) {
+			t.Errorf("%v addresses should be %v; got: %v", tc.network, tc.expected, sorted)
+		}
+	}
+}
+
+func TestDialAddrs(t *testing.T) {
+	addrs := []net.IPAddr{{IP: net.ParseIP("2001:db8::1")}, {IP: net.ParseIP("203.0.113.1")}}
+	dialer := func(behavior map[string]string) (dialFunc, chan string) {
+		dialed := make(chan string, 10)
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed <- addr
+			host, _, _ := net.SplitHostPort(addr)
+			switch behavior[host] {
+			case "hang":
+				<-ctx.Done()
+				return nil, ctx.Err()
+			case "fail":
+				return nil, errors.New("unreachable " + host)
+			}
+			conn, _ := net.Pipe()
+			return conn, nil
+		}, dialed
+	}
+
+	tt := []struct {
+		name     string
+		behavior map[string]string
+		err      bool
+		fast     bool
+	}{
+		{"first", map[string]string{}, false, true},
+		{"fallback after failure", map[string]string{"2001:db8::1": "fail"}, false, true},
+		{"fallback after delay", map[string]string{"2001:db8::1": "hang"}, false, false},
+		{"all fail", map[string]string{"2001:db8::1": "fail", "203.0.113.1": "fail"}, true, true},
+	}
+	for _, tc := range tt {
+		dial, dialed := dialer(tc.behavior)
+		start := time.Now()
+		conn, err := dialAddrs(context.Background(), dial, "tcp", "443", addrs)
+		elapsed := time.Since(start)
+		if (err != nil) != tc.err {
+			t.Errorf("%v error should be %v; got: %v", tc.name, tc.err, err)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		if fast := elapsed < happyEyeballsDelay; fast != tc.fast {
+			t.Errorf("%v should be fast %v; took: %v", tc.name, tc.fast, elapsed)
+		}
+		if first := <-dialed; first != "[2001:db8::1]:443" {
+			t.Errorf("%v should dial IPv6 first; got: %v", tc.name, first)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultDeadRuleDays is the period without hits after which a rule
+// is reported as dead.
+const defaultDeadRuleDays = 30
+
+// ruleHit is the usage of a whitelist or blacklist rule.
+type ruleHit struct {
+	Hits    int       `json:"hits"`
+	LastHit time.Time `json:"lastHit"`
+	// Added is when the rule was first loaded
+	Added time.Time `json:"added"`
+	// Overrides counts the whitelist hits that prevented a block
+	Overrides int `json:"overrides,omitempty"`
+}
+
+// ruleHits counts the hits of the rules of the rule lists
+// and persists them in a file.
+type ruleHits struct {
+	mu    sync.Mutex
+	path  string
+	lists map[string]map[string]*ruleHit
+
+	stop func()
+}
+
+// newRuleHits creates the rule hit counters persisted in path. Empty
+// path keeps them in memory.
+func newRuleHits(path string) *ruleHits {
+	return &ruleHits{
+		path:  path,
+		lists: make(map[string]map[string]*ruleHit),
+	}
+}
+
+// stageLists maps the stages of the rule lists to the lists.
+var stageLists = map[string]string{
+	stageWhitelist: listWhitelist,
+	stageBlacklist: listBlacklist,
+}
+
+// record counts a hit of the rule that decided about a query.
+func (h *ruleHits) record(q query) {
+	list, ok := stageLists[q.Stage]
+	if !ok || q.Rule == "" {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hit := h.hit(list, q.Rule, q.Time)
+	hit.Hits++
+	if q.Time.After(hit.LastHit) {
+		hit.LastHit = q.Time
+	}
+	if q.Overrides != "" {
+		hit.Overrides++
+	}
+}
+
+func (h *ruleHits) hit(list, rule string, now time.Time) *ruleHit {
+	rules, ok := h.lists[list]
+	if !ok {
+		rules = make(map[string]*ruleHit)
+		h.lists[list] = rules
+	}
+	hit, ok := rules[rule]
+	if !ok {
+		hit = &ruleHit{Added: now}
+		rules[rule] = hit
+	}
+	return hit
+}
+
+// seen updates the rules of a list after it is loaded. New rules are
+// added and the counters of removed rules are dropped.
+func (h *ruleHits) seen(list string, rules []string, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	current := make(map[string]bool)
+	for _, rule := range rules {
+		current[rule] = true
+		h.hit(list, rule, now)
+	}
+	for rule := range h.lists[list] {
+		if !current[rule] {
+			delete(h.lists[list], rule)
+		}
+	}
+}
+
+// load reads the persisted counters.
+func (h *ruleHits) load() error {
+	if h.path == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(h.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	lists := make(map[string]map[string]*ruleHit)
+	if err := json.Unmarshal(content, &lists); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lists = lists
+	return nil
+}
+
+// save persists the counters.
+func (h *ruleHits) save() error {
+	if h.path == "" {
+		return nil
+	}
+	h.mu.Lock()
+	content, err := json.Marshal(h.lists)
+	h.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := createDir(filepath.Dir(h.path)); err != nil {
+		return err
+	}
+	return writeFileAtomic(h.path, content)
+}
+
+// autosave persists the counters periodically until Close.
+func (h *ruleHits) autosave(interval time.Duration) {
+	h.stop = saveEvery(interval, "rule hits", h.save)
+}
+
+// Close stops saving periodically and persists the counters.
+func (h *ruleHits) Close() error {
+	if h.stop != nil {
+		h.stop()
+		h.stop = nil
+	}
+	return h.save()
+}
+
+// ruleUsage is the usage of a rule of a rule list.
+type ruleUsage struct {
+	List string `json:"list"`
+	Rule string `json:"rule"`
+	ruleHit
+}
+
+// usage returns the usage of the rules of a list in the order of the rules.
+// Rules never seen before are reported as added now.
+func (h *ruleHits) usage(list string, rules []string, now time.Time) []ruleUsage {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	usage := []ruleUsage{}
+	for _, rule := range rules {
+		u := ruleUsage{List: list, Rule: rule, ruleHit: ruleHit{Added: now}}
+		if hit, ok := h.lists[list][rule]; ok {
+			u.ruleHit = *hit
+		}
+		usage = append(usage, u)
+	}
+	return usage
+}
+
+// deadRules returns the rules that have been loaded for longer than
+// the period and have not matched within it, least recently hit first.
+func deadRules(usage []ruleUsage, period time.Duration, now time.Time) []ruleUsage {
+	since := now.Add(-period)
+	dead := []ruleUsage{}
+	for _, u := range usage {
+		if u.Added.Before(since) && u.LastHit.Before(since) {
+			dead = append(dead, u)
+		}
+	}
+	sort.SliceStable(dead, func(i, j int) bool {
+		return dead[i].LastHit.Before(dead[j].LastHit)
+	})
+	return dead
+}
+
+// redundantRules returns the whitelist rules that match none of the
+// blocklist hosts and none of the hosts of the exact and domain blacklist
+// rules, and have never prevented a block of the blacklist.
+func redundantRules(whitelist []ruleUsage, blocklist, blacklist []string) []ruleUsage {
+	m := &listMatcher{}
+	rules := []string{}
+	for _, u := range whitelist {
+		rules = append(rules, u.Rule)
+	}
+	if len(rules) == 0 {
+		return []ruleUsage{}
+	}
+	m.Load(rules)
+
+	// the exact and domain rules of the blacklist block their hosts,
+	// the regular expressions only show in the overrides
+	blocked := &listMatcher{}
+	hosts := append([]string{}, blocklist...)
+	blockedRules := []string{}
+	for _, rule := range blacklist {
+		if kind, domain, err := parseRule(rule); err == nil && kind != ruleRegexp {
+			hosts = append(hosts, domain)
+			blockedRules = append(blockedRules, rule)
+		}
+	}
+	blocked.Load(blockedRules)
+
+	needed := make(map[string]bool)
+	for _, u := range whitelist {
+		// a whitelisted host under a blacklisted domain
+		if kind, domain, err := parseRule(u.Rule); err == nil && kind != ruleRegexp && blocked.Match(domain) {
+			needed[u.Rule] = true
+		}
+	}
+	for _, host := range hosts {
+		// the blocker sees the hosts of CONNECT requests with a port
+		for _, text := range []string{host, host + ":443"} {
+			for _, rule := range m.MatchRules(text) {
+				needed[rule] = true
+			}
+		}
+	}
+	redundant := []ruleUsage{}
+	for _, u := range whitelist {
+		if !needed[u.Rule] && u.Overrides == 0 {
+			redundant = append(redundant, u)
+		}
+	}
+	return redundant
+}
+
+// ruleLists are the rule lists whose rule hits are counted.
+var ruleLists = []string{listWhitelist, listBlacklist}
+
+// listUsage returns the usage of the rules of the given lists.
+func listUsage(storage *Storage, hits *ruleHits, lists []string, now time.Time) ([]ruleUsage, error) {
+	usage := []ruleUsage{}
+	for _, list := range lists {
+		rules, err := storage.ListRules(list)
+		if err != nil {
+			return nil, err
+		}
+		usage = append(usage, hits.usage(list, rules, now)...)
+	}
+	return usage, nil
+}
+
+// redundantWhitelist returns the redundant rules of the whitelist.
+func redundantWhitelist(storage *Storage, hits *ruleHits, now time.Time) ([]ruleUsage, error) {
+	whitelist, err := listUsage(storage, hits, []string{listWhitelist}, now)
+	if err != nil {
+		return nil, err
+	}
+	blocklist, err := storage.GetBlocklistRules(true)
+	if err != nil {
+		return nil, err
+	}
+	blacklist, err := storage.ListRules(listBlacklist)
+	if err != nil {
+		return nil, err
+	}
+	return redundantRules(whitelist, blocklist, blacklist), nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func usageRules(usage []ruleUsage) []string {
+	rules := []string{}
+	for _, u := range usage {
+		rules = append(rules, u.Rule)
+	}
+	return rules
+}
+
+func TestRuleHits(t *testing.T) {
+	now := time.Date(2020, 3, 10, 12, 0, 0, 0, time.UTC)
+	h := newRuleHits("")
+	h.seen(listBlacklist, []string{"a", "b"}, now.Add(-time.Hour))
+	h.record(query{Time: now, Stage: stageBlacklist, Rule: "a"})
+	h.record(query{Time: now.Add(-time.Minute), Stage: stageBlacklist, Rule: "a"})
+	h.record(query{Time: now, Stage: stageWhitelist, Rule: "w", Overrides: stageBlocklist})
+	// blocklist hits are not counted
+	h.record(query{Time: now, Stage: stageBlocklist, Rule: "example.com"})
+
+	usage := h.usage(listBlacklist, []string{"a", "b"}, now)
+	expected := []ruleUsage{
+		{listBlacklist, "a", ruleHit{Hits: 2, LastHit: now, Added: now.Add(-time.Hour)}},
+		{listBlacklist, "b", ruleHit{Added: now.Add(-time.Hour)}},
+	}
+	if !reflect.DeepEqual(usage, expected) {
+		t.Errorf("usage should be %+v; got: %+v", expected, usage)
+	}
+	if hit := h.lists[listWhitelist]["w"]; hit == nil || hit.Overrides != 1 {
+		t.Errorf("whitelist rule should have 1 override; got: %+v", hit)
+	}
+	if _, ok := h.lists["blocklist"]; ok {
+		t.Errorf("blocklist hits should not be counted")
+	}
+
+	// removed rules are forgotten
+	h.seen(listBlacklist, []string{"b"}, now)
+	if _, ok := h.lists[listBlacklist]["a"]; ok {
+		t.Errorf("removed rule should be dropped")
+	}
+}
+
+func TestDeadRules(t *testing.T) {
+	now := time.Date(2020, 3, 10, 12, 0, 0, 0, time.UTC)
+	old := now.AddDate(0, 0, -60)
+	usage := []ruleUsage{
+		{listBlacklist, "recent-hit", ruleHit{Hits: 1, LastHit: now.AddDate(0, 0, -1), Added: old}},
+		{listBlacklist, "old-hit", ruleHit{Hits: 1, LastHit: now.AddDate(0, 0, -40), Added: old}},
+		{listWhitelist, "never-hit", ruleHit{Added: old}},
+		{listWhitelist, "new", ruleHit{Added: now.AddDate(0, 0, -1)}},
+	}
+
+	dead := deadRules(usage, 30*24*time.Hour, now)
+	if got := usageRules(dead); !reflect.DeepEqual(got, []string{"never-hit", "old-hit"}) {
+		t.Errorf("dead rules should be [never-hit old-hit]; got: %v", got)
+	}
+}
+
+func TestRedundantRules(t *testing.T) {
+	whitelist := []ruleUsage{
+		{List: listWhitelist, Rule: `^(.*\.)?example\.com:443$`},
+		{List: listWhitelist, Rule: `example`},
+		{List: listWhitelist, Rule: `^blacklisted\.com`, ruleHit: ruleHit{Overrides: 1}},
+		{List: listWhitelist, Rule: `^unused\.com`},
+		// needed by the blacklist rules without any traffic
+		{List: listWhitelist, Rule: `shop.blocked.org`},
+		{List: listWhitelist, Rule: `^exact\.org`},
+		{List: listWhitelist, Rule: `safe.org`},
+	}
+	blocklist := []string{"ads.example.com", "tracker.net"}
+	blacklist := []string{"||blocked.org", "exact.org", `/safe\.org/`}
+
+	redundant := redundantRules(whitelist, blocklist, blacklist)
+	if got := usageRules(redundant); !reflect.DeepEqual(got, []string{`^unused\.com`, `safe.org`}) {
+		t.Errorf("redundant rules should be [^unused\\.com safe.org]; got: %v", got)
+	}
+}
+
+func TestRuleHitsPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lycurgus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache", "rulehits.json")
+
+	now := time.Date(2020, 3, 10, 12, 0, 0, 0, time.UTC)
+	h := newRuleHits(path)
+	h.record(query{Time: now, Stage: stageBlacklist, Rule: "a"})
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	h = newRuleHits(path)
+	if err := h.load(); err != nil {
+		t.Fatal(err)
+	}
+	if hit := h.lists[listBlacklist]["a"]; hit == nil || hit.Hits != 1 || !hit.LastHit.Equal(now) {
+		t.Errorf("rule hit should be loaded; got: %+v", hit)
+	}
+}
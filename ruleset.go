@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ruleSetConfig is the name of the rule set of the allow and block
+// rules of the config file.
+const ruleSetConfig = "config"
+
+// ruleSet is a named set of whitelist and blacklist rules read from
+// files and from the config file.
+type ruleSet struct {
+	Name string `yaml:"name"`
+	// Enabled is true if not set
+	Enabled   *bool    `yaml:"enabled,omitempty"`
+	Whitelist string   `yaml:"whitelist,omitempty"`
+	Blacklist string   `yaml:"blacklist,omitempty"`
+	Allow     []string `yaml:"allow,omitempty"`
+	Block     []string `yaml:"block,omitempty"`
+
+	// scheduled is set if schedules turn the rule set on or off,
+	// so it is loaded even if disabled
+	scheduled bool
+}
+
+func (s ruleSet) enabled() bool {
+	return s.Enabled == nil || *s.Enabled
+}
+
+// loaded reports whether the rules of the rule set are loaded.
+func (s ruleSet) loaded() bool {
+	return s.enabled() || s.scheduled
+}
+
+func (s ruleSet) String() string {
+	if !s.enabled() {
+		return s.Name + " (disabled)"
+	}
+	return s.Name
+}
+
+// rules returns the rule file and the inline rules of a list.
+func (s ruleSet) rules(list string) (string, []string, error) {
+	switch list {
+	case listWhitelist:
+		return s.Whitelist, s.Allow, nil
+	case listBlacklist:
+		return s.Blacklist, s.Block, nil
+	}
+	return "", nil, errUnknownList
+}
+
+// inlineKey returns the config key of the inline rules of a list.
+func (s ruleSet) inlineKey(list string) string {
+	key := "allow"
+	if list == listBlacklist {
+		key = "block"
+	}
+	if s.Name == ruleSetConfig {
+		return key
+	}
+	return s.Name + "." + key
+}
+
+// validateRuleSets checks that the configured rule sets have unique names.
+func validateRuleSets(sets []ruleSet) error {
+	names := make(map[string]bool)
+	for _, set := range sets {
+		if set.Name == "" {
+			return errors.New("rule set without name")
+		}
+		if set.Name == ruleSetConfig || names[set.Name] {
+			return fmt.Errorf("duplicate rule set name: %s", set.Name)
+		}
+		names[set.Name] = true
+	}
+	return nil
+}
+
+// readRuleSet returns the rules of a list in a rule set, the rules of the
+// file first, with the file and line of each rule. With a ruleErrors
+// error it returns the valid rules.
+func readRuleSet(set ruleSet, list string) ([]string, []ruleError, error) {
+	path, inline, err := set.rules(list)
+	if err != nil {
+		return nil, nil, err
+	}
+	rules := []string{}
+	origins := []ruleError{}
+	var errs ruleErrors
+	if path != "" {
+		fileRules, lines, err := parseRulesFile(path)
+		if fileErrs, ok := err.(ruleErrors); ok {
+			errs = fileErrs
+		} else if err != nil && !os.IsNotExist(err) {
+			return nil, nil, err
+		}
+		for i, rule := range fileRules {
+			rules = append(rules, rule)
+			origins = append(origins, ruleError{File: path, Line: lines[i]})
+		}
+	}
+	for i, rule := range inline {
+		rules = append(rules, rule)
+		origins = append(origins, ruleError{File: set.inlineKey(list), Line: i + 1})
+	}
+	if errs != nil {
+		return rules, origins, errs
+	}
+	return rules, origins, nil
+}
+
+// ruleSetMatcher matches the rules of the rule sets in order
+// and reports the name of the matching rule set as source.
+type ruleSetMatcher struct {
+	names    []string
+	enabled  []bool
+	matchers []*listMatcher
+}
+
+func (m *ruleSetMatcher) add(name string, enabled bool, matcher *listMatcher) {
+	m.names = append(m.names, name)
+	m.enabled = append(m.enabled, enabled)
+	m.matchers = append(m.matchers, matcher)
+}
+
+// Load loads the rules as a single unnamed rule set
+func (m *ruleSetMatcher) Load(rules []string) error {
+	matcher := &listMatcher{}
+	err := matcher.Load(rules)
+	m.names, m.enabled, m.matchers = nil, nil, nil
+	m.add("", true, matcher)
+	return err
+}
+
+func (m *ruleSetMatcher) Match(text string) bool {
+	_, _, ok := m.MatchRule(text)
+	return ok
+}
+
+func (m *ruleSetMatcher) MatchRule(text string) (string, string, bool) {
+	return m.matchPolicy(text, policy{})
+}
+
+// matchPolicy matches the rule sets enabled under a policy.
+func (m *ruleSetMatcher) matchPolicy(text string, p policy) (string, string, bool) {
+	for i, matcher := range m.matchers {
+		if !p.ruleSetEnabled(m.names[i], m.enabled[i]) {
+			continue
+		}
+		if rule, _, ok := matcher.MatchRule(text); ok {
+			return rule, m.names[i], true
+		}
+	}
+	return "", "", false
+}
+
+// Len returns the number of rules of all the rule sets
+func (m *ruleSetMatcher) Len() int {
+	count := 0
+	for _, matcher := range m.matchers {
+		count += matcher.Len()
+	}
+	return count
+}
+
+// ruleSetStatus is the number of valid rules of a rule set by list.
+type ruleSetStatus struct {
+	// Name is empty for the whitelist and blacklist files
+	Name      string   `json:"name"`
+	Enabled   bool     `json:"enabled"`
+	Files     []string `json:"files,omitempty"`
+	Whitelist int      `json:"whitelist"`
+	Blacklist int      `json:"blacklist"`
+}
+
+// ruleSetStatuses returns the status of the rule sets in merge order.
+func ruleSetStatuses(sets []ruleSet) ([]ruleSetStatus, error) {
+	statuses := []ruleSetStatus{}
+	for _, set := range sets {
+		status := ruleSetStatus{Name: set.Name, Enabled: set.enabled()}
+		// count the rules of disabled rule sets as well
+		set.Enabled = nil
+		for _, path := range []string{set.Whitelist, set.Blacklist} {
+			if path != "" {
+				status.Files = append(status.Files, path)
+			}
+		}
+		for list, count := range map[string]*int{
+			listWhitelist: &status.Whitelist,
+			listBlacklist: &status.Blacklist,
+		} {
+			matcher, err := loadRuleSets([]ruleSet{set}, list)
+			if _, invalid := err.(ruleErrors); err != nil && !invalid {
+				return nil, err
+			}
+			if rc, ok := matcher.(ruleCounter); ok {
+				*count = rc.Len()
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadRuleSets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lycurgus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	team := filepath.Join(dir, "team")
+	ioutil.WriteFile(team, []byte("# team rules\nads.example.com\n*.tracker.net\n"), 0644)
+
+	disabled := false
+	storage := &Storage{
+		blacklistPath: filepath.Join(dir, "blacklist"),
+		blockRules:    []string{"ads.example.com", "("},
+		ruleSets: []ruleSet{
+			{Name: "team", Blacklist: team, Block: []string{"*.social.com"}},
+			{Name: "personal", Enabled: &disabled, Block: []string{"news.com"}},
+		},
+	}
+	matcher, err := storage.GetBlacklist()
+	errs, ok := err.(ruleErrors)
+	if !ok || len(errs) != 1 {
+		t.Fatalf("Error should be 1 invalid rule; got: %v", err)
+	}
+	if errs[0].File != "block" || errs[0].Line != 2 {
+		t.Errorf("invalid rule should be block:2; got: %v", errs[0])
+	}
+
+	tt := []struct {
+		host, rule, source string
+		matched            bool
+	}{
+		// the rules of the config file come before the rule sets
+		{"ads.example.com:443", "ads.example.com", ruleSetConfig, true},
+		{"www.tracker.net:443", "*.tracker.net", "team", true},
+		{"m.social.com:443", "*.social.com", "team", true},
+		{"news.com:443", "", "", false},
+	}
+	for _, tc := range tt {
+		rule, source, ok := matchRule(matcher, tc.host)
+		if ok != tc.matched || rule != tc.rule || source != tc.source {
+			t.Errorf("MatchRule '%s' should be: %v %v %v; got: %v %v %v", tc.host, tc.rule, tc.source, tc.matched, rule, source, ok)
+		}
+	}
+
+	rules, err := storage.ListRules(listBlacklist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 4 {
+		t.Errorf("ListRules should return 4 distinct rules; got: %v", rules)
+	}
+
+	statuses, err := ruleSetStatuses(storage.RuleSets())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 4 || statuses[2].Blacklist != 3 || statuses[3].Enabled || statuses[3].Blacklist != 1 {
+		t.Errorf("rule set statuses are wrong; got: %+v", statuses)
+	}
+
+	whitelist, err := storage.GetWhitelist()
+	if err != nil || whitelist != nil {
+		t.Errorf("Whitelist should be nil; got: %v %v", whitelist, err)
+	}
+}
+
+func TestValidateRuleSets(t *testing.T) {
+	tt := []struct {
+		sets  []ruleSet
+		valid bool
+	}{
+		{[]ruleSet{{Name: "team"}, {Name: "personal"}}, true},
+		{[]ruleSet{{Name: "team"}, {Name: "team"}}, false},
+		{[]ruleSet{{Name: ruleSetConfig}}, false},
+		{[]ruleSet{{}}, false},
+	}
+	for _, tc := range tt {
+		if err := validateRuleSets(tc.sets); (err == nil) != tc.valid {
+			t.Errorf("validateRuleSets %v should be valid: %v; got: %v", tc.sets, tc.valid, err)
+		}
+	}
+}
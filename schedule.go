@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// schedule turns rule sets or the blocker on and off during a daily time
+// window on some weekdays. The window is compared with the wall clock so
+// it keeps its local hours across DST changes.
+type schedule struct {
+	Name string `yaml:"name"`
+	// Days are the weekdays the window starts on, every day if empty
+	Days []string `yaml:"days,omitempty"`
+	// From and To are the local start and end of the window as 15:04.
+	// The window ends on the next day if To is not after From, and lasts
+	// all day if both are empty.
+	From string `yaml:"from,omitempty"`
+	To   string `yaml:"to,omitempty"`
+	// Enable and Disable are the rule sets turned on and off
+	Enable  []string `yaml:"enable,omitempty"`
+	Disable []string `yaml:"disable,omitempty"`
+	// Blocker turns blocking off during the window if false
+	Blocker *bool `yaml:"blocker,omitempty"`
+
+	days     [7]bool
+	from, to int
+}
+
+func (s schedule) String() string {
+	return s.Name
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseSchedules checks the schedules and the rule sets they name and
+// returns them ready to be evaluated.
+func parseSchedules(schedules []schedule, sets []ruleSet) ([]schedule, error) {
+	names := make(map[string]bool)
+	for _, set := range sets {
+		names[set.Name] = true
+	}
+	parsed := []schedule{}
+	seen := make(map[string]bool)
+	for _, s := range schedules {
+		if s.Name == "" {
+			return nil, errors.New("schedule without name")
+		}
+		if seen[s.Name] {
+			return nil, fmt.Errorf("duplicate schedule name: %s", s.Name)
+		}
+		seen[s.Name] = true
+		if err := s.parse(); err != nil {
+			return nil, fmt.Errorf("schedule %s: %v", s.Name, err)
+		}
+		for _, name := range append(append([]string{}, s.Enable...), s.Disable...) {
+			if !names[name] {
+				return nil, fmt.Errorf("schedule %s: unknown rule set: %s", s.Name, name)
+			}
+		}
+		parsed = append(parsed, s)
+	}
+	return parsed, nil
+}
+
+func (s *schedule) parse() error {
+	if len(s.Days) == 0 {
+		for i := range s.days {
+			s.days[i] = true
+		}
+	}
+	for _, day := range s.Days {
+		day = strings.ToLower(strings.TrimSpace(day))
+		if len(day) < 3 {
+			return fmt.Errorf("invalid day: %s", day)
+		}
+		wd, ok := weekdays[day[:3]]
+		if !ok {
+			return fmt.Errorf("invalid day: %s", day)
+		}
+		s.days[wd] = true
+	}
+	var err error
+	if s.from, err = parseClock(s.From); err != nil {
+		return err
+	}
+	if s.to, err = parseClock(s.To); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseClock returns the minutes since midnight of a 15:04 time.
+func parseClock(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time: %s", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// active reports whether the window contains the wall clock of t.
+func (s schedule) active(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+	switch {
+	case s.from == s.to:
+		return s.days[today]
+	case s.from < s.to:
+		return s.days[today] && s.from <= minute && minute < s.to
+	default:
+		// the window ends on the next day
+		return s.days[today] && minute >= s.from || s.days[yesterday] && minute < s.to
+	}
+}
+
+// policy is the state set by the active schedules.
+type policy struct {
+	// active are the names of the active schedules
+	active []string
+	// blockerOff is the schedule that turned blocking off if any
+	blockerOff string
+	// ruleSets are the enabled states of the scheduled rule sets
+	ruleSets map[string]bool
+}
+
+// policyAt returns the policy of the schedules at t. Later schedules
+// override earlier ones.
+func policyAt(schedules []schedule, t time.Time) policy {
+	p := policy{}
+	for _, s := range schedules {
+		if !s.active(t) {
+			continue
+		}
+		p.active = append(p.active, s.Name)
+		if s.Blocker != nil && !*s.Blocker {
+			p.blockerOff = s.Name
+		}
+		for _, names := range []struct {
+			sets    []string
+			enabled bool
+		}{{s.Enable, true}, {s.Disable, false}} {
+			for _, name := range names.sets {
+				if p.ruleSets == nil {
+					p.ruleSets = make(map[string]bool)
+				}
+				p.ruleSets[name] = names.enabled
+			}
+		}
+	}
+	return p
+}
+
+// ruleSetEnabled returns the enabled state of a rule set under the policy.
+func (p policy) ruleSetEnabled(name string, enabled bool) bool {
+	if scheduled, ok := p.ruleSets[name]; ok {
+		return scheduled
+	}
+	return enabled
+}
+
+// scheduledRuleSets returns the names of the rule sets the schedules
+// turn on or off.
+func scheduledRuleSets(schedules []schedule) map[string]bool {
+	names := make(map[string]bool)
+	for _, s := range schedules {
+		for _, name := range append(append([]string{}, s.Enable...), s.Disable...) {
+			names[name] = true
+		}
+	}
+	return names
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestParseSchedules(t *testing.T) {
+	sets := []ruleSet{{Name: "social"}}
+	tt := []struct {
+		schedule schedule
+		valid    bool
+	}{
+		{schedule{Name: "work", Days: []string{"mon", "Friday"}, From: "09:00", To: "17:00", Enable: []string{"social"}}, true},
+		{schedule{Name: "all day"}, true},
+		{schedule{From: "09:00"}, false},
+		{schedule{Name: "work", Days: []string{"mo"}}, false},
+		{schedule{Name: "work", Days: []string{"someday"}}, false},
+		{schedule{Name: "work", From: "9am"}, false},
+		{schedule{Name: "work", Disable: []string{"video"}}, false},
+	}
+	for _, tc := range tt {
+		_, err := parseSchedules([]schedule{tc.schedule}, sets)
+		if (err == nil) != tc.valid {
+			t.Errorf("schedule %+v should be valid: %v; got: %v", tc.schedule, tc.valid, err)
+		}
+	}
+
+	if _, err := parseSchedules([]schedule{{Name: "a"}, {Name: "a"}}, sets); err == nil {
+		t.Errorf("duplicate schedule names should return an error")
+	}
+}
+
+func TestScheduleActive(t *testing.T) {
+	schedules, err := parseSchedules([]schedule{
+		{Name: "work", Days: []string{"mon", "tue", "wed", "thu", "fri"}, From: "09:00", To: "17:00"},
+		{Name: "night", Days: []string{"fri"}, From: "22:00", To: "06:00"},
+		{Name: "weekend", Days: []string{"sat", "sun"}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	work, night, weekend := schedules[0], schedules[1], schedules[2]
+
+	// 2021-03-05 is a Friday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2021, 3, day, hour, minute, 0, 0, time.UTC)
+	}
+	tt := []struct {
+		schedule schedule
+		time     time.Time
+		active   bool
+	}{
+		{work, at(5, 8, 59), false},
+		{work, at(5, 9, 0), true},
+		{work, at(5, 16, 59), true},
+		{work, at(5, 17, 0), false},
+		{work, at(6, 10, 0), false},
+		{night, at(5, 21, 59), false},
+		{night, at(5, 23, 0), true},
+		// the window started on Friday
+		{night, at(6, 5, 59), true},
+		{night, at(6, 23, 0), false},
+		{night, at(7, 1, 0), false},
+		{weekend, at(6, 0, 0), true},
+		{weekend, at(7, 23, 59), true},
+		{weekend, at(8, 0, 0), false},
+	}
+	for _, tc := range tt {
+		if active := tc.schedule.active(tc.time); active != tc.active {
+			t.Errorf("%v at %v should be active: %v; got: %v", tc.schedule, tc.time, tc.active, active)
+		}
+	}
+}
+
+func TestScheduleDST(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	schedules, err := parseSchedules([]schedule{
+		{Name: "work", From: "09:00", To: "17:00"},
+		{Name: "night", From: "01:30", To: "03:30"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	work, night := schedules[0], schedules[1]
+
+	// the clocks go from 02:00 to 03:00 on 2021-03-28 and
+	// from 03:00 back to 02:00 on 2021-10-31
+	tt := []struct {
+		schedule schedule
+		time     time.Time
+		active   bool
+	}{
+		{work, time.Date(2021, 3, 28, 9, 0, 0, 0, loc), true},
+		{work, time.Date(2021, 3, 28, 8, 30, 0, 0, loc), false},
+		// 07:30 UTC is 08:30 before and 09:30 after the change
+		{work, time.Date(2021, 3, 27, 7, 30, 0, 0, time.UTC).In(loc), false},
+		{work, time.Date(2021, 3, 28, 7, 30, 0, 0, time.UTC).In(loc), true},
+		{work, time.Date(2021, 10, 31, 16, 30, 0, 0, time.UTC).In(loc), false},
+		{night, time.Date(2021, 3, 28, 1, 0, 0, 0, time.UTC).In(loc), true},
+		{night, time.Date(2021, 3, 28, 1, 30, 0, 0, time.UTC).In(loc), false},
+		// both 02:30 of the repeated hour
+		{night, time.Date(2021, 10, 31, 0, 30, 0, 0, time.UTC).In(loc), true},
+		{night, time.Date(2021, 10, 31, 1, 30, 0, 0, time.UTC).In(loc), true},
+	}
+	for _, tc := range tt {
+		if active := tc.schedule.active(tc.time); active != tc.active {
+			t.Errorf("%v at %v should be active: %v; got: %v", tc.schedule, tc.time, tc.active, active)
+		}
+	}
+}
+
+func TestPolicyAt(t *testing.T) {
+	off := false
+	schedules, err := parseSchedules([]schedule{
+		{Name: "work", From: "09:00", To: "17:00", Enable: []string{"social", "video"}},
+		{Name: "lunch", From: "12:00", To: "13:00", Disable: []string{"video"}},
+		{Name: "evening", From: "20:00", To: "23:00", Blocker: &off},
+	}, []ruleSet{{Name: "social"}, {Name: "video"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(hour int) time.Time {
+		return time.Date(2021, 3, 5, hour, 0, 0, 0, time.UTC)
+	}
+
+	p := policyAt(schedules, at(12))
+	if len(p.active) != 2 || !p.ruleSetEnabled("social", false) || p.ruleSetEnabled("video", true) {
+		t.Errorf("later schedules should override earlier ones; got: %+v", p)
+	}
+	if !p.ruleSetEnabled("other", true) || p.ruleSetEnabled("other", false) {
+		t.Errorf("unscheduled rule sets should keep their state")
+	}
+	if p := policyAt(schedules, at(21)); p.blockerOff != "evening" {
+		t.Errorf("blocker should be turned off by evening; got: %+v", p)
+	}
+	if p := policyAt(schedules, at(7)); len(p.active) != 0 || p.ruleSetEnabled("social", false) {
+		t.Errorf("no schedule should be active; got: %+v", p)
+	}
+}
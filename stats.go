@@ -0,0 +1,401 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Periods of the statistics buckets.
+const (
+	periodHourly = "hourly"
+	periodDaily  = "daily"
+)
+
+var (
+	// statsHourlyRetention is how long the hourly buckets are kept.
+	statsHourlyRetention = 7 * 24 * time.Hour
+	// statsDailyRetention is how long the daily buckets are kept.
+	statsDailyRetention = 365 * 24 * time.Hour
+	// statsHostsRetention is how long the host counters of the daily
+	// buckets are kept, the older days keep their totals only.
+	statsHostsRetention = 31 * 24 * time.Hour
+	// statsSaveInterval is how often the statistics are persisted.
+	statsSaveInterval = time.Minute
+)
+
+// statsMaxHosts is the number of hosts counted in a bucket. When twice as
+// many are counted, the others than the top ones are dropped.
+const statsMaxHosts = 1000
+
+// statsBucket holds the counters of an hour or a day.
+type statsBucket struct {
+	Start   time.Time `json:"start"`
+	Allowed int       `json:"allowed"`
+	Blocked int       `json:"blocked"`
+	// Sources counts the blocked requests by blocklist source or stage
+	Sources map[string]int `json:"sources,omitempty"`
+	// BlockedHosts and AllowedHosts are only counted in daily buckets
+	BlockedHosts map[string]int `json:"blockedHosts,omitempty"`
+	AllowedHosts map[string]int `json:"allowedHosts,omitempty"`
+}
+
+func (b *statsBucket) add(q query, hosts bool) {
+	if !q.Blocked {
+		b.Allowed++
+		if hosts {
+			b.AllowedHosts = trimHosts(increment(b.AllowedHosts, q.Host))
+		}
+		return
+	}
+	b.Blocked++
+	source := q.Source
+	if source == "" {
+		source = q.Stage
+	}
+	b.Sources = increment(b.Sources, source)
+	if hosts {
+		b.BlockedHosts = trimHosts(increment(b.BlockedHosts, q.Host))
+	}
+}
+
+// trimHosts keeps the top statsMaxHosts hosts of the counters once they
+// have twice as many.
+func trimHosts(counts map[string]int) map[string]int {
+	if len(counts) < 2*statsMaxHosts {
+		return counts
+	}
+	trimmed := make(map[string]int, 2*statsMaxHosts)
+	for _, c := range topHosts(counts, statsMaxHosts) {
+		trimmed[c.Host] = c.Count
+	}
+	return trimmed
+}
+
+func increment(m map[string]int, key string) map[string]int {
+	if m == nil {
+		m = make(map[string]int)
+	}
+	m[key]++
+	return m
+}
+
+// stats aggregates the decisions into hourly and daily buckets
+// and persists them in a file.
+type stats struct {
+	mu     sync.Mutex
+	path   string
+	hourly []*statsBucket
+	daily  []*statsBucket
+
+	stop func()
+}
+
+type statsState struct {
+	Hourly []*statsBucket `json:"hourly"`
+	Daily  []*statsBucket `json:"daily"`
+}
+
+// newStats creates the statistics persisted in path. Empty path keeps
+// them in memory.
+func newStats(path string) *stats {
+	return &stats{path: path}
+}
+
+// hourStart returns the start of the local hour of t.
+func hourStart(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, t.Hour(), 0, 0, 0, t.Location())
+}
+
+// dayStart returns the start of the local day of t.
+func dayStart(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// record counts a query in the buckets of its time.
+func (s *stats) record(q query) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.hourly = addToBucket(s.hourly, hourStart(q.Time), q, false)
+	s.daily = addToBucket(s.daily, dayStart(q.Time), q, true)
+}
+
+// addToBucket adds a query to the bucket starting at start, which
+// is the last bucket unless the clock went backwards.
+func addToBucket(buckets []*statsBucket, start time.Time, q query, hosts bool) []*statsBucket {
+	for i := len(buckets) - 1; i >= 0; i-- {
+		if buckets[i].Start.Equal(start) {
+			buckets[i].add(q, hosts)
+			return buckets
+		}
+		if buckets[i].Start.Before(start) {
+			break
+		}
+	}
+	b := &statsBucket{Start: start}
+	b.add(q, hosts)
+	buckets = append(buckets, b)
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Start.Before(buckets[j].Start)
+	})
+	return buckets
+}
+
+// prune drops the buckets older than the retention and the host
+// counters of the days older than statsHostsRetention.
+func (s *stats) prune(now time.Time) {
+	s.hourly = dropBefore(s.hourly, now.Add(-statsHourlyRetention))
+	s.daily = dropBefore(s.daily, now.Add(-statsDailyRetention))
+	for _, b := range s.daily {
+		if !b.Start.Before(now.Add(-statsHostsRetention)) {
+			break
+		}
+		b.BlockedHosts = nil
+		b.AllowedHosts = nil
+	}
+}
+
+func dropBefore(buckets []*statsBucket, t time.Time) []*statsBucket {
+	i := 0
+	for i < len(buckets) && buckets[i].Start.Before(t) {
+		i++
+	}
+	return buckets[i:]
+}
+
+// load reads the persisted statistics.
+func (s *stats) load() error {
+	if s.path == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	file := statsState{}
+	if err := json.Unmarshal(content, &file); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hourly = file.Hourly
+	s.daily = file.Daily
+	s.prune(time.Now())
+	return nil
+}
+
+// save persists the statistics.
+func (s *stats) save() error {
+	if s.path == "" {
+		return nil
+	}
+	s.mu.Lock()
+	s.prune(time.Now())
+	content, err := json.Marshal(statsState{Hourly: s.hourly, Daily: s.daily})
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := createDir(filepath.Dir(s.path)); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, content)
+}
+
+// autosave persists the statistics periodically until Close.
+func (s *stats) autosave(interval time.Duration) {
+	s.stop = saveEvery(interval, "statistics", s.save)
+}
+
+// Close stops saving periodically and persists the statistics.
+func (s *stats) Close() error {
+	if s.stop != nil {
+		s.stop()
+		s.stop = nil
+	}
+	return s.save()
+}
+
+// saveEvery calls save periodically until the returned function is called.
+func saveEvery(interval time.Duration, name string, save func() error) func() {
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := save(); err != nil {
+					log.Printf("Error saving %s: %v\n", name, err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+	}
+}
+
+// sourceCount is the number of requests blocked by a source.
+type sourceCount struct {
+	Source string `json:"source"`
+	Count  int    `json:"count"`
+}
+
+// statsBucketSummary is a bucket without the host counters.
+type statsBucketSummary struct {
+	Start   time.Time `json:"start"`
+	Allowed int       `json:"allowed"`
+	Blocked int       `json:"blocked"`
+}
+
+// statsReport is the statistics of a time range.
+type statsReport struct {
+	Period     string               `json:"period"`
+	Since      time.Time            `json:"since"`
+	Allowed    int                  `json:"allowed"`
+	Blocked    int                  `json:"blocked"`
+	Buckets    []statsBucketSummary `json:"buckets"`
+	TopBlocked []hostCount          `json:"topBlocked"`
+	TopAllowed []hostCount          `json:"topAllowed"`
+	Sources    []sourceCount        `json:"sources"`
+}
+
+// report returns the buckets of the period starting at or after since
+// with the top n hosts of the days since then.
+func (s *stats) report(period string, since time.Time, n int) (statsReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buckets := s.daily
+	start := dayStart(since)
+	switch period {
+	case periodDaily:
+	case periodHourly:
+		buckets = s.hourly
+		start = hourStart(since)
+	default:
+		return statsReport{}, fmt.Errorf("invalid period: %s", period)
+	}
+
+	r := statsReport{Period: period, Since: start, Buckets: []statsBucketSummary{}}
+	sources := make(map[string]int)
+	for _, b := range buckets {
+		if b.Start.Before(start) {
+			continue
+		}
+		r.Buckets = append(r.Buckets, statsBucketSummary{b.Start, b.Allowed, b.Blocked})
+		r.Allowed += b.Allowed
+		r.Blocked += b.Blocked
+		for source, count := range b.Sources {
+			sources[source] += count
+		}
+	}
+
+	blocked := make(map[string]int)
+	allowed := make(map[string]int)
+	for _, b := range s.daily {
+		if b.Start.Before(dayStart(since)) {
+			continue
+		}
+		for host, count := range b.BlockedHosts {
+			blocked[host] += count
+		}
+		for host, count := range b.AllowedHosts {
+			allowed[host] += count
+		}
+	}
+	r.TopBlocked = topHosts(blocked, n)
+	r.TopAllowed = topHosts(allowed, n)
+
+	r.Sources = []sourceCount{}
+	for source, count := range sources {
+		r.Sources = append(r.Sources, sourceCount{source, count})
+	}
+	sort.Slice(r.Sources, func(i, j int) bool {
+		if r.Sources[i].Count != r.Sources[j].Count {
+			return r.Sources[i].Count > r.Sources[j].Count
+		}
+		return r.Sources[i].Source < r.Sources[j].Source
+	})
+	return r, nil
+}
+
+// statsRequest selects a statistics report.
+type statsRequest struct {
+	Period string
+	Since  time.Time
+	Top    int
+	Format string
+}
+
+// statsFormats are the supported formats of the statistics export.
+var statsFormats = map[string]bool{"json": true, "csv": true}
+
+// parseStatsRequest reads a report request from the period, since
+// (see parseSince), top and format parameters.
+func parseStatsRequest(values url.Values, now time.Time) (statsRequest, error) {
+	req := statsRequest{
+		Period: periodDaily,
+		Since:  now.AddDate(0, 0, -7),
+		Top:    10,
+		Format: "json",
+	}
+	if period := values.Get("period"); period != "" {
+		if period != periodHourly && period != periodDaily {
+			return req, fmt.Errorf("invalid period: %s", period)
+		}
+		req.Period = period
+	}
+	if since := values.Get("since"); since != "" {
+		t, err := parseSince(since, now)
+		if err != nil {
+			return req, err
+		}
+		req.Since = t
+	}
+	if top := values.Get("top"); top != "" {
+		n, err := strconv.Atoi(top)
+		if err != nil || n < 0 {
+			return req, fmt.Errorf("invalid top: %s", top)
+		}
+		req.Top = n
+	}
+	if format := values.Get("format"); format != "" {
+		if !statsFormats[format] {
+			return req, fmt.Errorf("invalid format: %s", format)
+		}
+		req.Format = format
+	}
+	return req, nil
+}
+
+// writeStatsCSV writes the buckets of a report as CSV.
+func writeStatsCSV(w io.Writer, r statsReport) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"start", "allowed", "blocked"})
+	for _, b := range r.Buckets {
+		cw.Write([]string{b.Start.Format(time.RFC3339), strconv.Itoa(b.Allowed), strconv.Itoa(b.Blocked)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStatsReport(t *testing.T) {
+	day := time.Date(2020, 3, 10, 0, 0, 0, 0, time.Local)
+	s := newStats("")
+	s.record(query{Time: day.Add(-time.Hour), Host: "old.com", Blocked: true, Stage: stageBlacklist})
+	s.record(query{Time: day.Add(9 * time.Hour), Host: "a.com", Blocked: true, Stage: stageBlocklist, Source: "https://list"})
+	s.record(query{Time: day.Add(9*time.Hour + time.Minute), Host: "a.com", Blocked: true, Stage: stageBlocklist, Source: "https://list"})
+	s.record(query{Time: day.Add(10 * time.Hour), Host: "b.com", Blocked: true, Stage: stageBlacklist})
+	s.record(query{Time: day.Add(10 * time.Hour), Host: "c.com", Stage: stageDefault})
+
+	r, err := s.report(periodDaily, day.Add(time.Hour), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Allowed != 1 || r.Blocked != 3 {
+		t.Errorf("counts should be 1 allowed 3 blocked; got: %v %v", r.Allowed, r.Blocked)
+	}
+	if !reflect.DeepEqual(r.Buckets, []statsBucketSummary{{day, 1, 3}}) {
+		t.Errorf("daily buckets should be [%v 1 3]; got: %v", day, r.Buckets)
+	}
+	if !reflect.DeepEqual(r.TopBlocked, []hostCount{{"a.com", 2}}) {
+		t.Errorf("top blocked should be [a.com 2]; got: %v", r.TopBlocked)
+	}
+	if !reflect.DeepEqual(r.TopAllowed, []hostCount{{"c.com", 1}}) {
+		t.Errorf("top allowed should be [c.com 1]; got: %v", r.TopAllowed)
+	}
+	expectedSources := []sourceCount{{"https://list", 2}, {stageBlacklist, 1}}
+	if !reflect.DeepEqual(r.Sources, expectedSources) {
+		t.Errorf("sources should be %v; got: %v", expectedSources, r.Sources)
+	}
+
+	r, err = s.report(periodHourly, day.Add(-2*time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedBuckets := []statsBucketSummary{
+		{day.Add(-time.Hour), 0, 1},
+		{day.Add(9 * time.Hour), 0, 2},
+		{day.Add(10 * time.Hour), 1, 1},
+	}
+	if !reflect.DeepEqual(r.Buckets, expectedBuckets) {
+		t.Errorf("hourly buckets should be %v; got: %v", expectedBuckets, r.Buckets)
+	}
+
+	if _, err := s.report("weekly", day, 10); err == nil {
+		t.Errorf("weekly period should be invalid")
+	}
+}
+
+func TestStatsPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lycurgus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache", "stats.json")
+
+	now := time.Now()
+	s := newStats(path)
+	s.record(query{Time: now.Add(-400 * 24 * time.Hour), Host: "expired.com"})
+	s.record(query{Time: now, Host: "a.com", Blocked: true})
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = newStats(path)
+	if err := s.load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.hourly) != 1 || len(s.daily) != 1 {
+		t.Fatalf("expired buckets should be dropped; got: %v hourly %v daily", len(s.hourly), len(s.daily))
+	}
+	if s.daily[0].Blocked != 1 || s.daily[0].BlockedHosts["a.com"] != 1 {
+		t.Errorf("daily bucket should have a.com blocked; got: %+v", s.daily[0])
+	}
+}
+
+func TestParseStatsRequest(t *testing.T) {
+	now := time.Date(2020, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	req, err := parseStatsRequest(url.Values{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := statsRequest{periodDaily, now.AddDate(0, 0, -7), 10, "json"}
+	if req != expected {
+		t.Errorf("request should be %v; got: %v", expected, req)
+	}
+	req, err = parseStatsRequest(url.Values{"period": {"hourly"}, "since": {"1d"}, "top": {"3"}, "format": {"csv"}}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = statsRequest{periodHourly, now.AddDate(0, 0, -1), 3, "csv"}
+	if req != expected {
+		t.Errorf("request should be %v; got: %v", expected, req)
+	}
+
+	for _, values := range []url.Values{
+		{"period": {"weekly"}},
+		{"since": {"sometime"}},
+		{"top": {"many"}},
+		{"format": {"xml"}},
+	} {
+		if _, err := parseStatsRequest(values, now); err == nil {
+			t.Errorf("request %v should be invalid", values)
+		}
+	}
+}
+
+func TestWriteStatsCSV(t *testing.T) {
+	r := statsReport{Buckets: []statsBucketSummary{
+		{time.Date(2020, 3, 10, 0, 0, 0, 0, time.UTC), 5, 2},
+	}}
+	buf := &bytes.Buffer{}
+	if err := writeStatsCSV(buf, r); err != nil {
+		t.Fatal(err)
+	}
+	expected := "start,allowed,blocked\n2020-03-10T00:00:00Z,5,2\n"
+	if buf.String() != expected {
+		t.Errorf("CSV should be %q; got: %q", expected, buf.String())
+	}
+}
+
+func TestHourStart(t *testing.T) {
+	india := time.FixedZone("IST", 5*3600+1800)
+	start := hourStart(time.Date(2020, 3, 10, 9, 45, 10, 0, india))
+	if want := time.Date(2020, 3, 10, 9, 0, 0, 0, india); !start.Equal(want) {
+		t.Errorf("hour should start at %v; got: %v", want, start)
+	}
+}
+
+func TestStatsHostLimits(t *testing.T) {
+	now := time.Now()
+	s := newStats("")
+	for i := 0; i < 10; i++ {
+		s.record(query{Time: now, Host: "top.com", Blocked: true})
+	}
+	for i := 0; i < 2*statsMaxHosts; i++ {
+		s.record(query{Time: now, Host: fmt.Sprintf("%d.com", i), Blocked: true})
+	}
+	day := s.daily[len(s.daily)-1]
+	if len(day.BlockedHosts) > 2*statsMaxHosts || day.BlockedHosts["top.com"] != 10 {
+		t.Errorf("hosts should be trimmed keeping top.com; got %d hosts, top.com: %d", len(day.BlockedHosts), day.BlockedHosts["top.com"])
+	}
+	if day.Blocked != 10+2*statsMaxHosts {
+		t.Errorf("blocked should still count all requests; got: %d", day.Blocked)
+	}
+
+	s.record(query{Time: now.Add(-40 * 24 * time.Hour), Host: "old.com", Blocked: true})
+	s.prune(now)
+	if old := s.daily[0]; old.Blocked != 1 || old.BlockedHosts != nil {
+		t.Errorf("old day should keep its total without hosts; got: %+v", old)
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,6 +13,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -17,13 +21,42 @@ type Storage struct {
 	blocklistPath  string
 	blacklistPath  string
 	whitelistPath  string
+	focuslistPath  string
+	rangesPath     string
+	hostsPath      string
 	updateInterval time.Duration
+	// allowRules and blockRules are the rules of the config file
+	allowRules []string
+	blockRules []string
+	ruleSets   []ruleSet
+	// scheduled are the names of the rule sets turned on or off by schedules
+	scheduled map[string]bool
+	// hosts are the host overrides of the config file
+	hosts hostEntries
+	// rulesMu serializes the edits of the rule list files
+	rulesMu sync.Mutex
 }
 
 func (s *Storage) GetBlocklist(allowCache bool) (Matcher, error) {
+	sources, err := s.GetBlocklistSources(allowCache)
+	if err != nil {
+		return nil, err
+	}
+	if sources == nil {
+		return nil, nil
+	}
+
+	matcher := &hashMatcher{}
+	matcher.LoadSources(sources)
+	return matcher, nil
+}
+
+// GetBlocklistSources returns the hosts of every blocklist source.
+// If allowCache is set, a cached list younger than the update interval is used.
+func (s *Storage) GetBlocklistSources(allowCache bool) ([]blocklistSource, error) {
 	if allowCache {
-		if matcher, ok := getBlocklistFromCache(s.updateInterval); ok {
-			return matcher, nil
+		if sources, ok := getBlocklistFromCache(s.updateInterval); ok {
+			return sources, nil
 		}
 	}
 
@@ -33,8 +66,43 @@ func (s *Storage) GetBlocklist(allowCache bool) (Matcher, error) {
 	}
 	defer file.Close()
 
-	matcher := s.getBlocklist(file)
-	return matcher, nil
+	return s.getBlocklist(file), nil
+}
+
+// GetBlocklistRules returns the merged hosts of all the blocklist sources.
+func (s *Storage) GetBlocklistRules(allowCache bool) ([]string, error) {
+	sources, err := s.GetBlocklistSources(allowCache)
+	if err != nil || sources == nil {
+		return nil, err
+	}
+	return mergeHosts(sources), nil
+}
+
+// GetSources returns the blocklist sources with the status of their last fetch.
+func (s *Storage) GetSources() ([]sourceStatus, error) {
+	file, err := getBlocklists(s.blocklistPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	urls, err := readLines(file)
+	if err != nil {
+		return nil, err
+	}
+	statuses, err := loadSourceStatuses(sourceStatusFile())
+	if err != nil {
+		return nil, err
+	}
+	sources := []sourceStatus{}
+	for _, url := range urls {
+		status, ok := statuses[url]
+		if !ok {
+			status = sourceStatus{URL: url}
+		}
+		sources = append(sources, status)
+	}
+	return sources, nil
 }
 
 // getBlocklists reads a blocklists file.
@@ -67,7 +135,7 @@ func blocklistCachePath() (path string, lastUpdate time.Time, exist bool) {
 	return path, lastUpdate, true
 }
 
-func getBlocklistFromCache(updateInterval time.Duration) (Matcher, bool) {
+func getBlocklistFromCache(updateInterval time.Duration) ([]blocklistSource, bool) {
 	path, lastUpdate, ok := blocklistCachePath()
 	if !ok {
 		return nil, false
@@ -82,90 +150,424 @@ func getBlocklistFromCache(updateInterval time.Duration) (Matcher, bool) {
 	}
 	defer file.Close()
 
-	rules, err := readLines(file)
+	sources, err := readBlocklistCache(file)
 	if err != nil {
 		return nil, false
 	}
-	matcher := &hashMatcher{}
-	matcher.Load(rules)
-	//log.Printf("Blocklists loaded from cache (%v)\n", len(rules))
+	//log.Printf("Blocklists loaded from cache (%v)\n", len(sources))
 
-	return matcher, true
+	return sources, true
 }
 
-func cacheBlocklist(rules []string) error {
+// sourceMarker precedes the hosts of a source in the blocklist cache.
+const sourceMarker = "# source: "
+
+func cacheBlocklist(sources []blocklistSource) error {
+	if err := createDir(blocklistCacheDir()); err != nil {
+		return err
+	}
 	path := filepath.Join(blocklistCacheDir(), fmt.Sprintf("%v", time.Now().Unix()))
 
 	file, err := os.Create(path)
 	if err != nil {
 		return err
 	}
+	defer file.Close()
+
+	return writeBlocklistCache(file, sources)
+}
 
-	for _, rule := range rules {
-		file.WriteString(fmt.Sprintf("%s\n", rule))
+func writeBlocklistCache(w io.Writer, sources []blocklistSource) error {
+	bw := bufio.NewWriter(w)
+	for _, source := range sources {
+		bw.WriteString(sourceMarker + source.URL + "\n")
+		for _, host := range source.Hosts {
+			bw.WriteString(host + "\n")
+		}
 	}
-	defer file.Close()
+	return bw.Flush()
+}
 
-	return nil
+// readBlocklistCache reads the hosts of the cached sources.
+// Hosts of caches written without source markers belong to an unnamed source.
+func readBlocklistCache(r io.Reader) ([]blocklistSource, error) {
+	sources := []blocklistSource{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, sourceMarker) {
+			sources = append(sources, blocklistSource{URL: strings.TrimPrefix(line, sourceMarker)})
+			continue
+		}
+		line = removeComment(line, "#")
+		if line == "" {
+			continue
+		}
+		if len(sources) == 0 {
+			sources = append(sources, blocklistSource{})
+		}
+		last := &sources[len(sources)-1]
+		last.Hosts = append(last.Hosts, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return sources, nil
 }
 
-// getBloclist parses a blocklists file
-// and initializes a hashMatcher as a blocklist.
-func (s *Storage) getBlocklist(r io.Reader) Matcher {
-	rules := []string{}
+// getBloclist parses a blocklists file, downloads every source in it
+// and returns their hosts.
+func (s *Storage) getBlocklist(r io.Reader) []blocklistSource {
+	sources := []blocklistSource{}
 	urls, err := readLines(r)
 	if err != nil {
 		return nil
 	}
+	statuses, err := loadSourceStatuses(sourceStatusFile())
+	if err != nil {
+		log.Println("Error reading blocklist status: ", err)
+		statuses = make(map[string]sourceStatus)
+	}
 	for _, url := range urls {
+		status := statuses[url]
+		status.URL = url
+		status.LastAttempt = time.Now()
+
 		hosts, err := parseHostsURL(http.DefaultClient, url)
+		status.Duration = time.Since(status.LastAttempt)
 		if err != nil {
 			log.Println("Error reading blocklist: ", url)
+			status.Error = err.Error()
+			status.Failures++
+			statuses[url] = status
 			continue
 		}
-		rules = append(rules, hosts...)
+		status.Error = ""
+		status.Hosts = len(hosts)
+		status.LastUpdate = status.LastAttempt
+		statuses[url] = status
+		sources = append(sources, blocklistSource{URL: url, Hosts: hosts})
 	}
 
-	cacheBlocklist(rules)
+	// a failed update keeps the last cache
+	if len(sources) > 0 {
+		if err := cacheBlocklist(sources); err != nil {
+			log.Println("Error caching blocklist: ", err)
+		}
+	}
+	if err := saveSourceStatuses(sourceStatusFile(), statuses); err != nil {
+		log.Println("Error saving blocklist status: ", err)
+	}
 
-	//log.Printf("Blocklists loaded (%v - %v)\n", len(urls), len(rules))
-	matcher := &hashMatcher{}
-	matcher.Load(rules)
-	return matcher
+	//log.Printf("Blocklists loaded (%v)\n", len(urls))
+	return sources
 }
 
-func (s *Storage) GetBlacklist() (Matcher, error) {
-	blacklist, err := getMatcherFromFile(s.blacklistPath)
+// Names of the editable rule lists.
+const (
+	listWhitelist = "whitelist"
+	listBlacklist = "blacklist"
+)
+
+var (
+	errUnknownList  = errors.New("unknown rule list")
+	errRuleNotFound = errors.New("rule not found")
+)
+
+func (s *Storage) rulesPath(list string) (string, error) {
+	switch list {
+	case listWhitelist:
+		return s.whitelistPath, nil
+	case listBlacklist:
+		return s.blacklistPath, nil
+	}
+	return "", errUnknownList
+}
+
+// GetRules returns the rules of a rule list.
+func (s *Storage) GetRules(list string) ([]string, error) {
+	path, err := s.rulesPath(list)
 	if err != nil {
 		return nil, err
 	}
-	return blacklist, nil
+	// the invalid lines are reported when the rules are loaded
+	rules, _, err := parseRulesFile(path)
+	if _, invalid := err.(ruleErrors); err != nil && !invalid {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	return rules, nil
 }
 
-func (s *Storage) GetWhitelist() (Matcher, error) {
-	whitelist, err := getMatcherFromFile(s.whitelistPath)
+// AddRule appends a rule to a rule list file unless it is already present.
+func (s *Storage) AddRule(list, rule string) error {
+	s.rulesMu.Lock()
+	defer s.rulesMu.Unlock()
+
+	rules, err := s.GetRules(list)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return whitelist, nil
+	for _, r := range rules {
+		if r == rule {
+			return nil
+		}
+	}
+	path, _ := s.rulesPath(list)
+	if err := createDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
 
+	// make sure the rule starts on a new line
+	if info, err := file.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			rule = "\n" + rule
+		}
+	}
+	_, err = file.WriteString(rule + "\n")
+	return err
 }
 
-// getMatcherFromFile loads and initializes a regexpMatcher from a file.
-func getMatcherFromFile(path string) (Matcher, error) {
-	hosts, err := parseHostsFile(path)
+// RemoveRule removes a rule from a rule list file keeping the other lines
+// and comments intact. Lines are matched like GetRules parses them.
+func (s *Storage) RemoveRule(list, rule string) error {
+	path, err := s.rulesPath(list)
+	if err != nil {
+		return err
+	}
+	s.rulesMu.Lock()
+	defer s.rulesMu.Unlock()
+
+	file, err := os.Open(path)
 	if err != nil {
-		// ignore if file not exists
 		if os.IsNotExist(err) {
-			return nil, nil
+			return errRuleNotFound
+		}
+		return err
+	}
+	lines := []string{}
+	found := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if stripped := removeComment(line, "#"); stripped != "" {
+			if host, err := getHost(stripped); err == nil && host == rule {
+				found = true
+				continue
+			}
+		}
+		lines = append(lines, line)
+	}
+	file.Close()
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if !found {
+		return errRuleNotFound
+	}
+	return writeFileAtomic(path, []byte(strings.Join(lines, "\n")+"\n"))
+}
+
+// writeFileAtomic replaces the content of a file without leaving it
+// half written on failure.
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// GetBlacklist reads the blacklist of the enabled rule sets. With
+// a ruleErrors error it returns the matcher of the valid rules.
+func (s *Storage) GetBlacklist() (Matcher, error) {
+	return loadRuleSets(s.RuleSets(), listBlacklist)
+}
+
+// GetWhitelist reads the whitelist of the enabled rule sets. With
+// a ruleErrors error it returns the matcher of the valid rules.
+func (s *Storage) GetWhitelist() (Matcher, error) {
+	return loadRuleSets(s.RuleSets(), listWhitelist)
+}
+
+// GetFocuslist reads the focus list. With a ruleErrors error it returns
+// the matcher of the valid rules.
+func (s *Storage) GetFocuslist() (Matcher, error) {
+	return loadRuleSets([]ruleSet{{Name: listFocuslist, Whitelist: s.focuslistPath}}, listWhitelist)
+}
+
+// GetRanges returns the blocked address ranges.
+func (s *Storage) GetRanges() (*ipRanges, error) {
+	return loadRanges(s.rangesPath)
+}
+
+// GetOverrides returns the host overrides of the hosts file and the
+// config file.
+func (s *Storage) GetOverrides() (*hostOverrides, error) {
+	return loadOverrides(s.hostsPath, s.hosts)
+}
+
+// RuleSets returns the rule sets in the order they are matched: the
+// whitelist and blacklist files, the allow and block rules of the
+// config file and the configured rule sets.
+func (s *Storage) RuleSets() []ruleSet {
+	sets := []ruleSet{{Whitelist: s.whitelistPath, Blacklist: s.blacklistPath}}
+	if len(s.allowRules) > 0 || len(s.blockRules) > 0 {
+		sets = append(sets, ruleSet{Name: ruleSetConfig, Allow: s.allowRules, Block: s.blockRules})
+	}
+	for _, set := range s.ruleSets {
+		set.scheduled = s.scheduled[set.Name]
+		sets = append(sets, set)
+	}
+	return sets
+}
+
+// ListRules returns the distinct rules of a list in the enabled and
+// scheduled rule sets.
+func (s *Storage) ListRules(list string) ([]string, error) {
+	rules := []string{}
+	seen := make(map[string]bool)
+	for _, set := range s.RuleSets() {
+		if !set.loaded() {
+			continue
+		}
+		setRules, _, err := readRuleSet(set, list)
+		if _, invalid := err.(ruleErrors); err != nil && !invalid {
+			return nil, err
+		}
+		for _, rule := range setRules {
+			if !seen[rule] {
+				seen[rule] = true
+				rules = append(rules, rule)
+			}
 		}
-		return nil, err
 	}
-	// deal with existing but empty file
-	if len(hosts) <= 0 {
+	return rules, nil
+}
+
+// getMatcherFromFile loads and initializes a matcher from a file.
+func getMatcherFromFile(path string) (Matcher, error) {
+	return loadRuleSets([]ruleSet{{Blacklist: path}}, listBlacklist)
+}
+
+// loadRuleSets loads the rules of a list from the enabled and scheduled
+// rule sets.
+// Invalid rules are skipped and returned with the matcher of the valid
+// rules in a ruleErrors error naming the file and line of each rule.
+// Without rules it returns a nil matcher.
+func loadRuleSets(sets []ruleSet, list string) (Matcher, error) {
+	matcher := &ruleSetMatcher{}
+	var errs ruleErrors
+	for _, set := range sets {
+		if !set.loaded() {
+			continue
+		}
+		rules, origins, err := readRuleSet(set, list)
+		if fileErrs, ok := err.(ruleErrors); ok {
+			errs = append(errs, fileErrs...)
+		} else if err != nil {
+			return nil, err
+		}
+		// deal with missing or empty files
+		if len(rules) == 0 {
+			continue
+		}
+		m := &listMatcher{}
+		if err := m.Load(rules); err != nil {
+			setErrs, ok := err.(ruleErrors)
+			if !ok {
+				return nil, err
+			}
+			for _, e := range setErrs {
+				origin := origins[e.Line-1]
+				e.File, e.Line = origin.File, origin.Line
+				errs = append(errs, e)
+			}
+		}
+		matcher.add(set.Name, set.enabled(), m)
+	}
+	if matcher.Len() == 0 && errs == nil {
 		return nil, nil
 	}
-	matcher := &regexpMatcher{}
-	matcher.Load(hosts)
+	if errs != nil {
+		return matcher, errs
+	}
 	return matcher, nil
 }
+
+// blocklistSource holds the hosts downloaded from a blocklist source.
+type blocklistSource struct {
+	URL   string
+	Hosts []string
+}
+
+// mergeHosts returns the hosts of all the sources.
+func mergeHosts(sources []blocklistSource) []string {
+	hosts := []string{}
+	for _, source := range sources {
+		hosts = append(hosts, source.Hosts...)
+	}
+	return hosts
+}
+
+// sourceStatus is the outcome of the last fetch of a blocklist source.
+type sourceStatus struct {
+	URL         string    `json:"url"`
+	Hosts       int       `json:"hosts"`
+	LastUpdate  time.Time `json:"lastUpdate"`
+	LastAttempt time.Time `json:"lastAttempt"`
+	// Duration is the duration of the last fetch
+	Duration time.Duration `json:"duration"`
+	// Failures is the number of failed fetches
+	Failures int    `json:"failures"`
+	Error    string `json:"error,omitempty"`
+}
+
+// loadSourceStatuses reads the source statuses keyed by URL.
+// A missing file results in an empty set of statuses.
+func loadSourceStatuses(path string) (map[string]sourceStatus, error) {
+	statuses := make(map[string]sourceStatus)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return statuses, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &statuses); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+func saveSourceStatuses(path string, statuses map[string]sourceStatus) error {
+	if err := createDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(statuses, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, content, 0644)
+}
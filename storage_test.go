@@ -1,8 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -102,6 +108,59 @@ func TestLoadBlacklist(t *testing.T) {
 	}
 }
 
+func TestLoadInvalidBlacklist(t *testing.T) {
+	storage := &Storage{}
+	storage.blacklistPath = filepath.Join("testdata", "invalid-blacklist")
+	matcher, err := storage.GetBlacklist()
+	errs, ok := err.(ruleErrors)
+	if !ok || len(errs) != 1 {
+		t.Fatalf("Error should be 1 invalid rule; got: %v", err)
+	}
+	expected := ruleError{
+		File:   storage.blacklistPath,
+		Line:   4,
+		Rule:   `^(.*\.)?typo\.com(`,
+		Reason: "missing closing )",
+	}
+	if errs[0] != expected {
+		t.Errorf("Invalid rule should be %+v; got: %+v", expected, errs[0])
+	}
+	if matcher == nil || !matcher.Match("example.com") {
+		t.Errorf("Blacklist should match the valid rules")
+	}
+}
+
+func TestLoadUnparsableBlacklist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lycurgus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storage := &Storage{blacklistPath: filepath.Join(dir, "blacklist")}
+	ioutil.WriteFile(storage.blacklistPath, []byte("a.com\n0.0.0.0 b.com extra\nc.com\n"), 0644)
+
+	matcher, err := storage.GetBlacklist()
+	errs, ok := err.(ruleErrors)
+	if !ok || len(errs) != 1 {
+		t.Fatalf("Error should be 1 invalid rule; got: %v", err)
+	}
+	expected := ruleError{File: storage.blacklistPath, Line: 2, Rule: "0.0.0.0 b.com extra", Reason: errParseHosts.Error()}
+	if errs[0] != expected {
+		t.Errorf("Invalid rule should be %+v; got: %+v", expected, errs[0])
+	}
+	if matcher == nil || !matcher.Match("a.com") || !matcher.Match("c.com") {
+		t.Errorf("Blacklist should match the valid rules")
+	}
+
+	if err := storage.AddRule(listBlacklist, "d.com"); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := storage.GetRules(listBlacklist)
+	if err != nil || !reflect.DeepEqual(rules, []string{"a.com", "c.com", "d.com"}) {
+		t.Errorf("rules should be the valid ones; got: %v %v", rules, err)
+	}
+}
+
 func TestLoadWhitelist(t *testing.T) {
 	storage := &Storage{}
 	storage.whitelistPath = filepath.Join("testdata", "blacklist")
@@ -123,3 +182,112 @@ func TestLoadWhitelist(t *testing.T) {
 		t.Errorf("Whitelist should be nil")
 	}
 }
+
+func TestSourceStatuses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lycurgus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sources.json")
+
+	statuses, err := loadSourceStatuses(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 0 {
+		t.Errorf("statuses should be empty; got: %v", statuses)
+	}
+
+	statuses["https://asdf.aa"] = sourceStatus{URL: "https://asdf.aa", Hosts: 3, Error: "timeout"}
+	if err := saveSourceStatuses(path, statuses); err != nil {
+		t.Fatal(err)
+	}
+	statuses, err = loadSourceStatuses(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := statuses["https://asdf.aa"]
+	if status.Hosts != 3 || status.Error != "timeout" {
+		t.Errorf("status should be restored; got: %+v", status)
+	}
+}
+
+func TestRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lycurgus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storage := &Storage{whitelistPath: filepath.Join(dir, "whitelist")}
+	ioutil.WriteFile(storage.whitelistPath, []byte("# comment\na\\.com\n0.0.0.0 c\\.com # hosts format"), 0644)
+
+	if err := storage.AddRule(listWhitelist, "b\\.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.AddRule(listWhitelist, "a\\.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.RemoveRule(listWhitelist, "a\\.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.RemoveRule(listWhitelist, "a\\.com"); err != errRuleNotFound {
+		t.Errorf("error should be %v; got: %v", errRuleNotFound, err)
+	}
+	if err := storage.RemoveRule(listWhitelist, "c\\.com"); err != nil {
+		t.Errorf("hosts format rule should be removed; got: %v", err)
+	}
+	if _, err := storage.GetRules("nothing"); err != errUnknownList {
+		t.Errorf("error should be %v; got: %v", errUnknownList, err)
+	}
+
+	content, _ := ioutil.ReadFile(storage.whitelistPath)
+	if string(content) != "# comment\nb\\.com\n" {
+		t.Errorf("whitelist should be %q; got: %q", "# comment\nb\\.com\n", content)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			storage.AddRule(listWhitelist, fmt.Sprintf("d%d\\.com", i))
+		}(i)
+	}
+	wg.Wait()
+	rules, _ := storage.GetRules(listWhitelist)
+	if len(rules) != 11 {
+		t.Errorf("concurrent adds should all be kept; got: %v", rules)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("no temporary file should be left; got %d files", len(files))
+	}
+}
+
+func TestBlocklistCache(t *testing.T) {
+	sources := []blocklistSource{
+		{URL: "https://asdf.aa", Hosts: []string{"a.com", "b.com"}},
+		{URL: "https://qwer.qq", Hosts: []string{"c.com"}},
+	}
+	buf := &bytes.Buffer{}
+	if err := writeBlocklistCache(buf, sources); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readBlocklistCache(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, sources) {
+		t.Errorf("sources should be %v; got: %v", sources, read)
+	}
+
+	// caches written without source markers
+	read, err = readBlocklistCache(strings.NewReader("a.com\nb.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 1 || read[0].URL != "" || len(read[0].Hosts) != 2 {
+		t.Errorf("hosts should belong to an unnamed source; got: %v", read)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions of the temporary rules.
+const (
+	tempAllow = "allow"
+	tempBlock = "block"
+)
+
+// tempRule allows or blocks a host and its subdomains until it expires.
+type tempRule struct {
+	Host    string    `json:"host"`
+	Action  string    `json:"action"`
+	Expires time.Time `json:"expires"`
+}
+
+func (r tempRule) String() string {
+	return fmt.Sprintf("%s %s until %s", r.Action, r.Host, r.Expires.Format(time.Kitchen))
+}
+
+// tempRules holds the temporary rules by host and persists them in a file.
+// The expired rules are removed by a timer and never match.
+type tempRules struct {
+	mu    sync.RWMutex
+	path  string
+	rules map[string]tempRule
+	timer *time.Timer
+	// expired is called with the rules removed by the timer
+	expired func([]tempRule)
+}
+
+// newTempRules creates the temporary rules persisted in path. Empty
+// path keeps them in memory.
+func newTempRules(path string) *tempRules {
+	return &tempRules{
+		path:  path,
+		rules: make(map[string]tempRule),
+	}
+}
+
+// parseTempRule reads a temporary rule of a host for a duration.
+func parseTempRule(action, host, duration string, now time.Time) (tempRule, error) {
+	if action != tempAllow && action != tempBlock {
+		return tempRule{}, fmt.Errorf("invalid action: %s", action)
+	}
+	host = strings.ToLower(stripPort(strings.TrimSpace(host)))
+	if !domainPattern.MatchString(host) {
+		return tempRule{}, fmt.Errorf("invalid host: %s", host)
+	}
+	d, err := time.ParseDuration(duration)
+	if err != nil {
+		return tempRule{}, err
+	}
+	if d <= 0 {
+		return tempRule{}, errors.New("duration must be positive")
+	}
+	return tempRule{Host: host, Action: action, Expires: now.Add(d)}, nil
+}
+
+// add adds or replaces the temporary rule of a host.
+func (t *tempRules) add(r tempRule) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rules[r.Host] = r
+	t.schedule()
+	return t.save()
+}
+
+// remove removes the temporary rule of a host.
+func (t *tempRules) remove(host string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.rules[host]; !ok {
+		return errRuleNotFound
+	}
+	delete(t.rules, host)
+	t.schedule()
+	return t.save()
+}
+
+// match returns the rule of the host or of its closest parent domain
+// that has not expired.
+func (t *tempRules) match(host string, now time.Time) (tempRule, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if len(t.rules) == 0 {
+		return tempRule{}, false
+	}
+	for domain := strings.ToLower(stripPort(host)); ; {
+		if r, ok := t.rules[domain]; ok && now.Before(r.Expires) {
+			return r, true
+		}
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			return tempRule{}, false
+		}
+		domain = domain[i+1:]
+	}
+}
+
+// list returns the rules that have not expired, the first to expire first.
+func (t *tempRules) list(now time.Time) []tempRule {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	rules := []tempRule{}
+	for _, r := range t.rules {
+		if now.Before(r.Expires) {
+			rules = append(rules, r)
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if !rules[i].Expires.Equal(rules[j].Expires) {
+			return rules[i].Expires.Before(rules[j].Expires)
+		}
+		return rules[i].Host < rules[j].Host
+	})
+	return rules
+}
+
+// expire removes the expired rules and returns them.
+func (t *tempRules) expire(now time.Time) []tempRule {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	expired := []tempRule{}
+	for host, r := range t.rules {
+		if !now.Before(r.Expires) {
+			expired = append(expired, r)
+			delete(t.rules, host)
+		}
+	}
+	if len(expired) > 0 {
+		if err := t.save(); err != nil {
+			log.Println("Error saving temporary rules: ", err)
+		}
+	}
+	t.schedule()
+	return expired
+}
+
+// schedule sets the timer to the next expiry.
+func (t *tempRules) schedule() {
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	var next time.Time
+	for _, r := range t.rules {
+		if next.IsZero() || r.Expires.Before(next) {
+			next = r.Expires
+		}
+	}
+	if next.IsZero() {
+		return
+	}
+	t.timer = time.AfterFunc(time.Until(next), func() {
+		expired := t.expire(time.Now())
+		if len(expired) > 0 && t.expired != nil {
+			t.expired(expired)
+		}
+	})
+}
+
+type tempRulesState struct {
+	Rules []tempRule `json:"rules"`
+}
+
+// load reads the persisted rules that have not expired.
+func (t *tempRules) load() error {
+	if t.path == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(t.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var state tempRulesState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for _, r := range state.Rules {
+		if now.Before(r.Expires) {
+			t.rules[r.Host] = r
+		}
+	}
+	t.schedule()
+	return nil
+}
+
+func (t *tempRules) save() error {
+	if t.path == "" {
+		return nil
+	}
+	state := tempRulesState{Rules: []tempRule{}}
+	for _, r := range t.rules {
+		state.Rules = append(state.Rules, r)
+	}
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := createDir(filepath.Dir(t.path)); err != nil {
+		return err
+	}
+	return writeFileAtomic(t.path, content)
+}
+
+// Close stops the expiry timer.
+func (t *tempRules) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseTempRule(t *testing.T) {
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	tt := []struct {
+		action, host, duration string
+		valid                  bool
+	}{
+		{tempAllow, "Shop.Example.com:443", "10m", true},
+		{tempBlock, "example.com", "1h", true},
+		{"deny", "example.com", "1h", false},
+		{tempAllow, "^example", "1h", false},
+		{tempAllow, "example.com", "soon", false},
+		{tempAllow, "example.com", "-1m", false},
+	}
+	for _, tc := range tt {
+		_, err := parseTempRule(tc.action, tc.host, tc.duration, now)
+		if (err == nil) != tc.valid {
+			t.Errorf("parseTempRule %v %v %v should be valid: %v; got: %v", tc.action, tc.host, tc.duration, tc.valid, err)
+		}
+	}
+	r, _ := parseTempRule(tempAllow, "Shop.Example.com:443", "10m", now)
+	if r.Host != "shop.example.com" || !r.Expires.Equal(now.Add(10*time.Minute)) {
+		t.Errorf("rule should be shop.example.com until %v; got: %+v", now.Add(10*time.Minute), r)
+	}
+}
+
+func TestTempRules(t *testing.T) {
+	now := time.Now()
+	rules := newTempRules("")
+	defer rules.Close()
+	rules.add(tempRule{Host: "example.com", Action: tempAllow, Expires: now.Add(time.Hour)})
+	rules.add(tempRule{Host: "ads.example.com", Action: tempBlock, Expires: now.Add(time.Minute)})
+	rules.add(tempRule{Host: "old.com", Action: tempBlock, Expires: now.Add(-time.Minute)})
+
+	tt := []struct {
+		host, action string
+		matched      bool
+	}{
+		{"example.com:443", tempAllow, true},
+		{"shop.example.com:443", tempAllow, true},
+		{"x.ads.example.com:443", tempBlock, true},
+		{"notexample.com:443", "", false},
+		{"old.com:443", "", false},
+	}
+	for _, tc := range tt {
+		r, ok := rules.match(tc.host, now)
+		if ok != tc.matched || r.Action != tc.action {
+			t.Errorf("match '%s' should be: %v %v; got: %v %v", tc.host, tc.action, tc.matched, r.Action, ok)
+		}
+	}
+
+	list := rules.list(now)
+	if len(list) != 2 || list[0].Host != "ads.example.com" || list[1].Host != "example.com" {
+		t.Errorf("list should be [ads.example.com example.com]; got: %v", list)
+	}
+	// the parent domain matches after the rule of the host expired
+	if r, _ := rules.match("ads.example.com", now.Add(2*time.Minute)); r.Host != "example.com" {
+		t.Errorf("expired rule should not match; got: %v", r)
+	}
+	if err := rules.remove("nothing.com"); err != errRuleNotFound {
+		t.Errorf("remove should return %v; got: %v", errRuleNotFound, err)
+	}
+	if err := rules.remove("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rules.match("example.com", now); ok {
+		t.Errorf("removed rule should not match")
+	}
+}
+
+func TestTempRulesExpiry(t *testing.T) {
+	expired := make(chan []tempRule, 1)
+	rules := newTempRules("")
+	defer rules.Close()
+	rules.expired = func(r []tempRule) { expired <- r }
+	rules.add(tempRule{Host: "example.com", Action: tempAllow, Expires: time.Now().Add(20 * time.Millisecond)})
+
+	select {
+	case r := <-expired:
+		if len(r) != 1 || r[0].Host != "example.com" {
+			t.Errorf("expired should be [example.com]; got: %v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("rule should expire")
+	}
+	if list := rules.list(time.Now()); len(list) != 0 {
+		t.Errorf("expired rule should be removed; got: %v", list)
+	}
+}
+
+func TestTempRulesPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lycurgus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "temporary.json")
+
+	rules := newTempRules(path)
+	rules.add(tempRule{Host: "example.com", Action: tempBlock, Expires: time.Now().Add(time.Hour)})
+	rules.Close()
+
+	rules = newTempRules(path)
+	defer rules.Close()
+	if err := rules.load(); err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := rules.match("example.com", time.Now()); !ok || r.Action != tempBlock {
+		t.Errorf("rule should be restored; got: %v %v", r, ok)
+	}
+}
@@ -0,0 +1,360 @@
+"use strict";
+
+const api = "/api/v1";
+const refreshInterval = 2000;
+const maxQueries = 100;
+
+// The tray passes the token in the fragment so it never reaches the server logs.
+const fragment = new URLSearchParams(location.hash.slice(1));
+if (fragment.has("token")) {
+  localStorage.setItem("token", fragment.get("token"));
+  history.replaceState(null, "", location.pathname);
+}
+
+const $ = (selector, root = document) => root.querySelector(selector);
+
+async function request(method, path, body) {
+  const resp = await fetch(api + path, {
+    method,
+    headers: {
+      "Authorization": "Bearer " + localStorage.getItem("token"),
+      "Content-Type": "application/json",
+    },
+    body: body === undefined ? undefined : JSON.stringify(body),
+  });
+  if (resp.status === 401) {
+    showLogin();
+    throw new Error("unauthorized");
+  }
+  if (resp.status === 204) {
+    return null;
+  }
+  const data = await resp.json();
+  if (!resp.ok) {
+    throw new Error(data.error);
+  }
+  return data;
+}
+
+function cell(text) {
+  const td = document.createElement("td");
+  td.textContent = text;
+  return td;
+}
+
+function row({ cells, className }) {
+  const tr = document.createElement("tr");
+  if (className) {
+    tr.className = className;
+  }
+  tr.append(...cells.map(cell));
+  return tr;
+}
+
+function fillTable(table, rows) {
+  $("tbody", table).replaceChildren(...rows.map(row));
+}
+
+function formatTime(value) {
+  const time = new Date(value);
+  return time.getFullYear() > 1 ? time.toLocaleString() : "never";
+}
+
+async function refreshStatus() {
+  const status = await request("GET", "/status");
+  const state = $("#state");
+  state.textContent = status.enabled ? "Enabled" : "Disabled";
+  if (status.paused) {
+    state.textContent = status.pausedUntil
+      ? `Paused until ${new Date(status.pausedUntil).toLocaleTimeString()}`
+      : "Paused until restart";
+  }
+  state.className = "badge " + (status.enabled ? "enabled" : "disabled");
+  $("#toggle").textContent = status.enabled ? "Disable" : "Enable";
+  $("#toggle").dataset.action = status.enabled ? "/disable" : "/enable";
+  $("#focus").textContent = status.focus ? "Leave focus mode" : "Enter focus mode";
+  $("#focus").dataset.action = status.focus ? "/focus/disable" : "/focus/enable";
+  const budgets = status.budgets || [];
+  $("#budgets").hidden = budgets.length === 0;
+  $("#budgets ul").replaceChildren(...budgets.map(budgetItem));
+  const access = status.accessRequests || [];
+  $("#access").hidden = access.length === 0;
+  $("#access ul").replaceChildren(...access.map(accessItem));
+  $("#invalid").replaceChildren(...(status.invalidRules || []).map((e) => {
+    const li = document.createElement("li");
+    li.textContent = `Skipped ${e.file}:${e.line}: ${e.rule} (${e.reason})`;
+    return li;
+  }));
+  $("#temporary ul").replaceChildren(...(status.temporary || []).map(temporaryItem));
+}
+
+function temporaryItem(r) {
+  const li = document.createElement("li");
+  const text = document.createElement("span");
+  text.textContent = r.action + " " + r.host;
+  const expires = document.createElement("small");
+  expires.textContent = "until " + new Date(r.expires).toLocaleTimeString();
+  const remove = document.createElement("button");
+  remove.type = "button";
+  remove.textContent = "Remove";
+  remove.addEventListener("click", async () => {
+    await request("DELETE", "/temporary?host=" + encodeURIComponent(r.host));
+    refreshStatus();
+  });
+  li.append(text, expires, remove);
+  return li;
+}
+
+function budgetItem(b) {
+  const li = document.createElement("li");
+  const text = document.createElement("span");
+  text.textContent = b.rule;
+  const left = document.createElement("small");
+  left.textContent = `${Math.ceil(b.remaining / 60)} of ${Math.ceil(b.limit / 60)} minutes left`;
+  li.append(text, left);
+  return li;
+}
+
+function accessItem(r) {
+  const li = document.createElement("li");
+  const text = document.createElement("span");
+  text.textContent = r.host + (r.reason ? " (" + r.reason + ")" : "");
+  const client = document.createElement("small");
+  client.textContent = r.client + " at " + new Date(r.time).toLocaleTimeString();
+  const allow = document.createElement("button");
+  allow.type = "button";
+  allow.textContent = "Allow for 1 hour";
+  allow.addEventListener("click", async () => {
+    await request("POST", "/temporary", { host: r.host, action: "allow", duration: "1h" });
+    refreshStatus();
+  });
+  const dismiss = document.createElement("button");
+  dismiss.type = "button";
+  dismiss.textContent = "Dismiss";
+  dismiss.addEventListener("click", async () => {
+    await request("DELETE", "/access?host=" + encodeURIComponent(r.host));
+    refreshStatus();
+  });
+  li.append(text, client, allow, dismiss);
+  return li;
+}
+
+async function refreshActivity() {
+  const activity = await request("GET", "/activity?top=10");
+  $("#allowed").textContent = activity.allowed;
+  $("#blocked").textContent = activity.blocked;
+  fillTable($("#top"), activity.topBlocked.map(({ host, count }) => ({ cells: [host, count] })));
+}
+
+function queryFilter() {
+  return new URLSearchParams({ search: $("#search").value.trim(), decision: $("#decision").value });
+}
+
+function queryRow(q) {
+  return {
+    cells: [formatTime(q.time), q.client, q.port ? q.host + ":" + q.port : q.host, q.blocked ? "blocked" : "allowed", q.stage, (q.rule || "") + (q.cname ? ` (CNAME ${q.cname})` : "")],
+    className: q.blocked ? "blocked" : "",
+  };
+}
+
+async function refreshQueries() {
+  const params = queryFilter();
+  params.set("limit", maxQueries);
+  const queries = await request("GET", "/queries?" + params);
+  fillTable($("#queries"), queries.map(queryRow));
+}
+
+// streamQueries prepends the decisions to the queries as they happen.
+async function streamQueries(signal) {
+  const resp = await fetch(api + "/events?" + queryFilter(), {
+    headers: { "Authorization": "Bearer " + localStorage.getItem("token") },
+    signal,
+  });
+  if (!resp.ok) {
+    throw new Error(resp.statusText);
+  }
+  const tbody = $("#queries tbody");
+  const reader = resp.body.pipeThrough(new TextDecoderStream()).getReader();
+  let buffer = "";
+  for (;;) {
+    const { value, done } = await reader.read();
+    if (done) {
+      return;
+    }
+    buffer += value;
+    const messages = buffer.split("\n\n");
+    buffer = messages.pop();
+    for (const message of messages) {
+      const data = message.split("\n").find((line) => line.startsWith("data: "));
+      if (data) {
+        tbody.prepend(row(queryRow(JSON.parse(data.slice(6)))));
+        while (tbody.children.length > maxQueries) {
+          tbody.lastChild.remove();
+        }
+      }
+    }
+  }
+}
+
+let live = null;
+
+// setLive switches the queries between polling and streaming.
+function setLive(enabled) {
+  if (live) {
+    live.abort();
+    live = null;
+  }
+  if (enabled) {
+    live = new AbortController();
+    streamQueries(live.signal).catch(() => {});
+  }
+}
+
+async function refreshSources() {
+  const sources = await request("GET", "/sources");
+  fillTable($("#sources"), sources.map((s) => ({
+    cells: [s.url, s.hosts, formatTime(s.lastUpdate), s.error || ""],
+  })));
+}
+
+async function refreshRules(section) {
+  const list = section.dataset.list;
+  const [{ rules }, usage] = await Promise.all([
+    request("GET", "/rules/" + list),
+    request("GET", "/rulehits?list=" + list),
+  ]);
+  const hits = new Map(usage.map((u) => [u.rule, u]));
+  $("ul", section).replaceChildren(...rules.map((rule) => {
+    const li = document.createElement("li");
+    const text = document.createElement("span");
+    text.textContent = rule;
+    const count = document.createElement("small");
+    const u = hits.get(rule);
+    count.textContent = u && u.hits > 0 ? u.hits + " hits, last " + formatTime(u.lastHit) : "no hits";
+    const remove = document.createElement("button");
+    remove.type = "button";
+    remove.textContent = "Remove";
+    remove.addEventListener("click", async () => {
+      await request("DELETE", "/rules/" + list + "?rule=" + encodeURIComponent(rule));
+      refreshRules(section);
+    });
+    li.append(text, count, remove);
+    return li;
+  }));
+}
+
+function setupRules(section) {
+  const form = $("form", section);
+  const input = form.elements.rule;
+  const error = $(".error", form);
+
+  input.addEventListener("input", async () => {
+    if (input.value === "") {
+      error.textContent = "";
+      return;
+    }
+    const result = await request("GET", "/validate?rule=" + encodeURIComponent(input.value));
+    error.textContent = result.valid ? "" : result.error;
+  });
+
+  form.addEventListener("submit", async (event) => {
+    event.preventDefault();
+    try {
+      await request("POST", "/rules/" + section.dataset.list, { rule: input.value });
+      input.value = "";
+      error.textContent = "";
+      refreshRules(section);
+    } catch (err) {
+      error.textContent = err.message;
+    }
+  });
+}
+
+function refresh() {
+  const refreshes = [refreshStatus(), refreshActivity()];
+  if (!live) {
+    refreshes.push(refreshQueries());
+  }
+  return Promise.all(refreshes);
+}
+
+function showLogin() {
+  $("#dashboard").hidden = true;
+  $("#login").hidden = false;
+}
+
+async function start() {
+  $("#login").hidden = true;
+  $("#dashboard").hidden = false;
+  await refresh();
+  await refreshSources();
+  document.querySelectorAll(".rules").forEach(refreshRules);
+}
+
+$("#login").addEventListener("submit", (event) => {
+  event.preventDefault();
+  localStorage.setItem("token", $("#token").value);
+  start().catch(() => {});
+});
+
+$("#toggle").addEventListener("click", async () => {
+  await request("POST", $("#toggle").dataset.action);
+  refreshStatus();
+});
+
+$("#focus").addEventListener("click", async () => {
+  await request("POST", $("#focus").dataset.action);
+  refreshStatus();
+});
+
+$("#reload").addEventListener("click", async (event) => {
+  event.target.disabled = true;
+  try {
+    await request("POST", "/reload");
+    await refreshSources();
+  } finally {
+    event.target.disabled = false;
+  }
+});
+
+function filterQueries() {
+  refreshQueries().catch(() => {});
+  if (live) {
+    setLive(true);
+  }
+}
+
+$("#search").addEventListener("input", filterQueries);
+$("#decision").addEventListener("change", filterQueries);
+$("#live").addEventListener("change", (event) => setLive(event.target.checked));
+
+document.querySelectorAll(".rules").forEach(setupRules);
+
+$("#temporary form").addEventListener("submit", async (event) => {
+  event.preventDefault();
+  const form = event.target;
+  try {
+    await request("POST", "/temporary", {
+      host: form.elements.host.value,
+      action: form.elements.action.value,
+      duration: form.elements.duration.value,
+    });
+    form.elements.host.value = "";
+    $(".error", form).textContent = "";
+    refreshStatus();
+  } catch (err) {
+    $(".error", form).textContent = err.message;
+  }
+});
+
+if (localStorage.getItem("token")) {
+  start().catch(() => {});
+} else {
+  showLogin();
+}
+
+setInterval(() => {
+  if (!$("#dashboard").hidden) {
+    refresh().catch(() => {});
+  }
+}, refreshInterval);